@@ -0,0 +1,256 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package apkdiff compares the contents of apk packages.
+package apkdiff
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"chainguard.dev/apko/pkg/apk/expandapk"
+	"chainguard.dev/apko/pkg/sbom/generator/spdx"
+	"go.opentelemetry.io/otel"
+
+	"chainguard.dev/melange/pkg/pkginfo"
+)
+
+// Entry describes a single entry of the data section of a package.
+type Entry struct {
+	Path     string
+	Type     byte
+	Mode     fs.FileMode
+	UID, GID int
+	ModTime  time.Time
+	Size     int64
+	Linkname string
+
+	// Digest is the sha256 of the contents of a regular file.
+	Digest string
+
+	// ELFSections holds the sha256 of every section of an ELF file.
+	ELFSections map[string]string
+}
+
+// Package holds the parts of an apk that are compared.
+type Package struct {
+	Path string
+	Size int64
+
+	// PkgInfo holds the fields of .PKGINFO.
+	PkgInfo pkginfo.PkgInfo
+
+	// Control holds the sha256 of every other control file, e.g. scriptlets.
+	Control map[string]string
+
+	Entries map[string]*Entry
+
+	// SBOMs holds the SPDX documents found in the package, keyed by path.
+	SBOMs map[string]*spdx.Document
+}
+
+// Name returns the name of the package from .PKGINFO, falling back to the
+// file name.
+func (p *Package) Name() string {
+	if name := p.PkgInfo.Get("pkgname"); name != "" {
+		return name
+	}
+	return filepath.Base(p.Path)
+}
+
+const sbomDir = "var/lib/db/sbom/"
+
+// Read reads the apk at the given path.
+func Read(ctx context.Context, path string) (*Package, error) {
+	ctx, span := otel.Tracer("melange").Start(ctx, "apkdiff.Read")
+	defer span.End()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	exp, err := expandapk.ExpandApk(ctx, f, "")
+	if err != nil {
+		return nil, fmt.Errorf("expanding %s: %w", path, err)
+	}
+	defer exp.Close()
+
+	p := &Package{
+		Path:    path,
+		Size:    fi.Size(),
+		PkgInfo: pkginfo.PkgInfo{},
+		Control: map[string]string{},
+		Entries: map[string]*Entry{},
+		SBOMs:   map[string]*spdx.Document{},
+	}
+
+	control, err := exp.ControlData()
+	if err != nil {
+		return nil, fmt.Errorf("reading control section of %s: %w", path, err)
+	}
+	if err := p.readControl(bytes.NewReader(control)); err != nil {
+		return nil, fmt.Errorf("reading control section of %s: %w", path, err)
+	}
+
+	data, err := exp.PackageData()
+	if err != nil {
+		return nil, fmt.Errorf("reading data section of %s: %w", path, err)
+	}
+	defer data.Close()
+
+	if err := p.readData(data); err != nil {
+		return nil, fmt.Errorf("reading data section of %s: %w", path, err)
+	}
+
+	return p, nil
+}
+
+func (p *Package) readControl(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		if hdr.Name == ".PKGINFO" {
+			info, err := pkginfo.Parse(tr)
+			if err != nil {
+				return err
+			}
+			p.PkgInfo = info
+			continue
+		}
+
+		h := sha256.New()
+		if _, err := io.Copy(h, tr); err != nil {
+			return err
+		}
+		p.Control[hdr.Name] = hex.EncodeToString(h.Sum(nil))
+	}
+}
+
+var elfMagic = []byte{0x7f, 'E', 'L', 'F'}
+
+func (p *Package) readData(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		path := strings.TrimPrefix(hdr.Name, "./")
+		e := &Entry{
+			Path:     path,
+			Type:     hdr.Typeflag,
+			Mode:     hdr.FileInfo().Mode(),
+			UID:      hdr.Uid,
+			GID:      hdr.Gid,
+			ModTime:  hdr.ModTime.UTC(),
+			Size:     hdr.Size,
+			Linkname: hdr.Linkname,
+		}
+		p.Entries[path] = e
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		isSBOM := strings.HasPrefix(path, sbomDir) && strings.HasSuffix(path, ".spdx.json")
+
+		// Only ELF files and SBOMs are held in memory, everything else is
+		// just hashed.
+		br := bufio.NewReader(tr)
+		magic, _ := br.Peek(len(elfMagic))
+		if !isSBOM && !bytes.Equal(magic, elfMagic) {
+			h := sha256.New()
+			if _, err := io.Copy(h, br); err != nil {
+				return err
+			}
+			e.Digest = hex.EncodeToString(h.Sum(nil))
+			continue
+		}
+
+		b, err := io.ReadAll(br)
+		if err != nil {
+			return err
+		}
+		e.Digest = digest(b)
+
+		if isSBOM {
+			doc := &spdx.Document{}
+			if err := json.Unmarshal(b, doc); err != nil {
+				return fmt.Errorf("parsing SBOM %s: %w", path, err)
+			}
+			p.SBOMs[path] = doc
+			continue
+		}
+
+		// Not every file starting with the magic is a valid ELF file, so
+		// anything we can't parse is only compared by digest.
+		ef, err := elf.NewFile(bytes.NewReader(b))
+		if err != nil {
+			continue
+		}
+
+		e.ELFSections = map[string]string{}
+		for _, s := range ef.Sections {
+			if s.Name == "" || s.Type == elf.SHT_NOBITS {
+				continue
+			}
+
+			sb, err := s.Data()
+			if err != nil {
+				continue
+			}
+			e.ELFSections[s.Name] = digest(sb)
+		}
+		ef.Close()
+	}
+}
+
+func digest(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,504 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apkdiff
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"chainguard.dev/apko/pkg/apk/apk"
+	"chainguard.dev/apko/pkg/sbom/generator/spdx"
+)
+
+// Kind is the kind of a Difference.
+type Kind string
+
+const (
+	// KindPackage is a package that only exists on one side.
+	KindPackage Kind = "package"
+	// KindPkgInfo is a changed .PKGINFO field.
+	KindPkgInfo Kind = "pkginfo"
+	// KindControl is a changed control file, e.g. a scriptlet.
+	KindControl Kind = "control"
+	// KindFile is a file that only exists on one side.
+	KindFile    Kind = "file"
+	KindType    Kind = "type"
+	KindMode    Kind = "mode"
+	KindOwner   Kind = "owner"
+	KindModTime Kind = "mtime"
+	KindSize    Kind = "size"
+	KindLink    Kind = "link"
+	KindContent Kind = "content"
+	KindELF     Kind = "elf-section"
+	KindSBOM    Kind = "sbom"
+)
+
+// Difference is a single difference between two packages.  Old or New is
+// empty when the compared thing only exists on one side.
+type Difference struct {
+	Package string `json:"package"`
+	Kind    Kind   `json:"kind"`
+	Path    string `json:"path,omitempty"`
+	// Detail narrows down Path, e.g. the ELF section or the SBOM field.
+	Detail string `json:"detail,omitempty"`
+	Old    string `json:"old,omitempty"`
+	New    string `json:"new,omitempty"`
+}
+
+func (d Difference) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s", d.Kind)
+	if d.Path != "" {
+		fmt.Fprintf(&sb, " %s", d.Path)
+	}
+	if d.Detail != "" {
+		fmt.Fprintf(&sb, " [%s]", d.Detail)
+	}
+
+	switch {
+	case d.Old == "":
+		fmt.Fprintf(&sb, ": added %s", d.New)
+	case d.New == "":
+		fmt.Fprintf(&sb, ": removed %s", d.Old)
+	default:
+		fmt.Fprintf(&sb, ": %s -> %s", d.Old, d.New)
+	}
+
+	if d.Kind == KindSize {
+		o, oerr := strconv.ParseInt(d.Old, 10, 64)
+		n, nerr := strconv.ParseInt(d.New, 10, 64)
+		if oerr == nil && nerr == nil {
+			fmt.Fprintf(&sb, " (%+d)", n-o)
+		}
+	}
+
+	return sb.String()
+}
+
+// Report holds every difference found between two sets of packages.
+type Report struct {
+	Old         string       `json:"old"`
+	New         string       `json:"new"`
+	Differences []Difference `json:"differences"`
+}
+
+// Equal reports whether no differences were found.
+func (r *Report) Equal() bool {
+	return len(r.Differences) == 0
+}
+
+// WriteText writes the report in a human readable form, grouping the
+// differences by package.
+func (r *Report) WriteText(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "--- %s\n+++ %s\n", r.Old, r.New); err != nil {
+		return err
+	}
+
+	pkg := ""
+	for _, d := range r.Differences {
+		if d.Package != pkg {
+			pkg = d.Package
+			if _, err := fmt.Fprintf(w, "%s:\n", pkg); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "  %s\n", d); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ComparePackages reads and compares the apks at the given paths.
+func ComparePackages(ctx context.Context, oldPath, newPath string) (*Report, error) {
+	oldPkg, err := Read(ctx, oldPath)
+	if err != nil {
+		return nil, err
+	}
+
+	newPkg, err := Read(ctx, newPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Report{
+		Old:         oldPath,
+		New:         newPath,
+		Differences: Compare(oldPkg, newPkg),
+	}, nil
+}
+
+// CompareDirs compares the apks found in two directories, e.g. two package
+// repositories.  Packages are matched by their name and the directory they
+// are in (usually the architecture), so that different versions of the same
+// package are compared with each other.
+func CompareDirs(ctx context.Context, oldDir, newDir string) (*Report, error) {
+	oldPkgs, err := readDir(ctx, oldDir)
+	if err != nil {
+		return nil, err
+	}
+
+	newPkgs, err := readDir(ctx, newDir)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{
+		Old:         oldDir,
+		New:         newDir,
+		Differences: []Difference{},
+	}
+
+	for _, key := range unionKeys(oldPkgs, newPkgs) {
+		o, n := oldPkgs[key], newPkgs[key]
+		switch {
+		case o == nil:
+			report.Differences = append(report.Differences, Difference{
+				Package: n.Name(),
+				Kind:    KindPackage,
+				Path:    key,
+				New:     first(n.PkgInfo["pkgver"]),
+			})
+		case n == nil:
+			report.Differences = append(report.Differences, Difference{
+				Package: o.Name(),
+				Kind:    KindPackage,
+				Path:    key,
+				Old:     first(o.PkgInfo["pkgver"]),
+			})
+		default:
+			report.Differences = append(report.Differences, Compare(o, n)...)
+		}
+	}
+
+	return report, nil
+}
+
+// readDir reads the apks below dir, keyed by the directory they are in and
+// their package name.  When a directory holds several versions of a package
+// only the newest one is read.
+func readDir(ctx context.Context, dir string) (map[string]*Package, error) {
+	type candidate struct {
+		path    string
+		version apk.Version
+	}
+	newest := map[string]candidate{}
+
+	if err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() || filepath.Ext(path) != ".apk" {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		info, _, err := apk.ParsePackageInfo(f)
+		if err != nil {
+			return fmt.Errorf("parsing %s: %w", path, err)
+		}
+
+		version, err := apk.ParseVersion(info.Version)
+		if err != nil {
+			return fmt.Errorf("parsing version of %s: %w", path, err)
+		}
+
+		rel, err := filepath.Rel(dir, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		key := filepath.Join(rel, info.Name)
+
+		if c, ok := newest[key]; !ok || apk.CompareVersions(version, c.version) > 0 {
+			newest[key] = candidate{path: path, version: version}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	pkgs := make(map[string]*Package, len(newest))
+	for key, c := range newest {
+		p, err := Read(ctx, c.path)
+		if err != nil {
+			return nil, err
+		}
+		pkgs[key] = p
+	}
+
+	return pkgs, nil
+}
+
+// Compare returns the differences between two packages.
+func Compare(oldPkg, newPkg *Package) []Difference {
+	c := &comparison{pkg: newPkg.Name()}
+
+	if oldPkg.Size != newPkg.Size {
+		c.add(KindSize, "", "apk", strconv.FormatInt(oldPkg.Size, 10), strconv.FormatInt(newPkg.Size, 10))
+	}
+
+	c.pkgInfo(oldPkg.PkgInfo, newPkg.PkgInfo)
+
+	for _, name := range unionKeys(oldPkg.Control, newPkg.Control) {
+		if o, n := oldPkg.Control[name], newPkg.Control[name]; o != n {
+			c.add(KindControl, name, "", o, n)
+		}
+	}
+
+	for _, path := range unionKeys(oldPkg.Entries, newPkg.Entries) {
+		o, n := oldPkg.Entries[path], newPkg.Entries[path]
+		switch {
+		case o == nil:
+			c.add(KindFile, path, "", "", n.Mode.String())
+		case n == nil:
+			c.add(KindFile, path, "", o.Mode.String(), "")
+		default:
+			c.entry(o, n)
+		}
+	}
+
+	for _, path := range unionKeys(oldPkg.SBOMs, newPkg.SBOMs) {
+		o, n := oldPkg.SBOMs[path], newPkg.SBOMs[path]
+		if o != nil && n != nil {
+			c.sbom(path, o, n)
+		}
+	}
+
+	return c.diffs
+}
+
+type comparison struct {
+	pkg   string
+	diffs []Difference
+}
+
+func (c *comparison) add(kind Kind, path, detail, o, n string) {
+	c.diffs = append(c.diffs, Difference{
+		Package: c.pkg,
+		Kind:    kind,
+		Path:    path,
+		Detail:  detail,
+		Old:     o,
+		New:     n,
+	})
+}
+
+// relationKeys are the .PKGINFO fields that list other packages, possibly
+// with a version constraint.
+var relationKeys = []string{"depend", "provides", "replaces", "install_if"}
+
+func (c *comparison) pkgInfo(o, n map[string][]string) {
+	for _, key := range unionKeys(o, n) {
+		ov, nv := o[key], n[key]
+
+		if slices.Contains(relationKeys, key) {
+			c.relations(key, ov, nv)
+			continue
+		}
+
+		if len(ov) <= 1 && len(nv) <= 1 {
+			if first(ov) != first(nv) {
+				c.add(KindPkgInfo, key, "", first(ov), first(nv))
+			}
+			continue
+		}
+
+		// Repeated fields are compared as sets.
+		for _, v := range ov {
+			if !slices.Contains(nv, v) {
+				c.add(KindPkgInfo, key, "", v, "")
+			}
+		}
+		for _, v := range nv {
+			if !slices.Contains(ov, v) {
+				c.add(KindPkgInfo, key, "", "", v)
+			}
+		}
+	}
+}
+
+// relations compares dependencies or provides by name, so that a changed
+// version constraint shows up as a single change.  Virtuals like so: and
+// cmd: carry their namespace as the detail.
+func (c *comparison) relations(key string, ov, nv []string) {
+	om, nm := relationsByName(ov), relationsByName(nv)
+	for _, name := range unionKeys(om, nm) {
+		if o, n := om[name], nm[name]; o != n {
+			virtual, _, _ := strings.Cut(name, ":")
+			if virtual == name {
+				virtual = ""
+			}
+			c.add(KindPkgInfo, key, virtual, o, n)
+		}
+	}
+}
+
+func relationsByName(values []string) map[string]string {
+	m := make(map[string]string, len(values))
+	for _, v := range values {
+		name := v
+		if i := strings.IndexAny(v, "=<>~"); i >= 0 {
+			name = v[:i]
+		}
+		m[name] = v
+	}
+	return m
+}
+
+func (c *comparison) entry(o, n *Entry) {
+	if o.Type != n.Type {
+		c.add(KindType, n.Path, "", string(o.Type), string(n.Type))
+		return
+	}
+
+	if o.Mode != n.Mode {
+		c.add(KindMode, n.Path, "", o.Mode.String(), n.Mode.String())
+	}
+
+	if o.UID != n.UID || o.GID != n.GID {
+		c.add(KindOwner, n.Path, "", fmt.Sprintf("%d:%d", o.UID, o.GID), fmt.Sprintf("%d:%d", n.UID, n.GID))
+	}
+
+	if !o.ModTime.Equal(n.ModTime) {
+		c.add(KindModTime, n.Path, "", o.ModTime.Format(time.RFC3339), n.ModTime.Format(time.RFC3339))
+	}
+
+	if o.Size != n.Size {
+		c.add(KindSize, n.Path, "", strconv.FormatInt(o.Size, 10), strconv.FormatInt(n.Size, 10))
+	}
+
+	if o.Linkname != n.Linkname {
+		c.add(KindLink, n.Path, "", o.Linkname, n.Linkname)
+	}
+
+	if o.Digest == n.Digest {
+		return
+	}
+
+	c.add(KindContent, n.Path, "", o.Digest, n.Digest)
+
+	if o.ELFSections == nil || n.ELFSections == nil {
+		return
+	}
+
+	for _, name := range unionKeys(o.ELFSections, n.ELFSections) {
+		if oh, nh := o.ELFSections[name], n.ELFSections[name]; oh != nh {
+			c.add(KindELF, n.Path, name, oh, nh)
+		}
+	}
+}
+
+func (c *comparison) sbom(path string, o, n *spdx.Document) {
+	if o.CreationInfo.Created != n.CreationInfo.Created {
+		c.add(KindSBOM, path, "created", o.CreationInfo.Created, n.CreationInfo.Created)
+	}
+
+	if o.Namespace != n.Namespace {
+		c.add(KindSBOM, path, "documentNamespace", o.Namespace, n.Namespace)
+	}
+
+	ops, nps := sbomPackages(o), sbomPackages(n)
+	for _, name := range unionKeys(ops, nps) {
+		op, np := ops[name], nps[name]
+		switch {
+		case op == nil:
+			c.add(KindSBOM, path, "package "+name, "", np.Version)
+			continue
+		case np == nil:
+			c.add(KindSBOM, path, "package "+name, op.Version, "")
+			continue
+		}
+
+		for _, f := range []struct {
+			field string
+			o, n  string
+		}{
+			{"versionInfo", op.Version, np.Version},
+			{"licenseDeclared", op.LicenseDeclared, np.LicenseDeclared},
+			{"licenseConcluded", op.LicenseConcluded, np.LicenseConcluded},
+			{"supplier", op.Supplier, np.Supplier},
+			{"originator", op.Originator, np.Originator},
+			{"downloadLocation", op.DownloadLocation, np.DownloadLocation},
+			{"externalRefs", externalRefs(op), externalRefs(np)},
+			{"checksums", checksums(op), checksums(np)},
+		} {
+			if f.o != f.n {
+				c.add(KindSBOM, path, fmt.Sprintf("package %s %s", name, f.field), f.o, f.n)
+			}
+		}
+	}
+}
+
+func sbomPackages(doc *spdx.Document) map[string]*spdx.Package {
+	pkgs := make(map[string]*spdx.Package, len(doc.Packages))
+	for i := range doc.Packages {
+		pkgs[doc.Packages[i].Name] = &doc.Packages[i]
+	}
+	return pkgs
+}
+
+func externalRefs(p *spdx.Package) string {
+	refs := make([]string, 0, len(p.ExternalRefs))
+	for _, ref := range p.ExternalRefs {
+		refs = append(refs, ref.Locator)
+	}
+	slices.Sort(refs)
+	return strings.Join(refs, " ")
+}
+
+func checksums(p *spdx.Package) string {
+	sums := make([]string, 0, len(p.Checksums))
+	for _, sum := range p.Checksums {
+		sums = append(sums, sum.Algorithm+":"+sum.Value)
+	}
+	slices.Sort(sums)
+	return strings.Join(sums, " ")
+}
+
+func first(s []string) string {
+	if len(s) == 0 {
+		return ""
+	}
+	return s[0]
+}
+
+func unionKeys[V any](a, b map[string]V) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,195 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apkdiff
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+)
+
+type testFile struct {
+	name    string
+	mode    int64
+	modTime time.Time
+	content string
+}
+
+// writeAPK writes a minimal unsigned apk: a control and a data section, each
+// a gzipped tarball.
+func writeAPK(t *testing.T, path, pkginfo string, files []testFile) {
+	t.Helper()
+
+	section := func(files []testFile) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(zw)
+		for _, f := range files {
+			require.NoError(t, tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     f.name,
+				Mode:     f.mode,
+				ModTime:  f.modTime,
+				Size:     int64(len(f.content)),
+			}))
+			_, err := tw.Write([]byte(f.content))
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+		require.NoError(t, zw.Close())
+		return buf.Bytes()
+	}
+
+	control := section([]testFile{{name: ".PKGINFO", mode: 0o644, content: pkginfo}})
+	data := section(files)
+
+	require.NoError(t, os.WriteFile(path, append(control, data...), 0o644))
+}
+
+func TestComparePackages(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	dir := t.TempDir()
+
+	epoch := time.Unix(0, 0)
+	oldPath := filepath.Join(dir, "old.apk")
+	writeAPK(t, oldPath, "pkgname = hello\npkgver = 1.0.0-r0\ndepend = so:libc.so.6\n", []testFile{
+		{name: "usr/bin/hello", mode: 0o755, modTime: epoch, content: "hello"},
+		{name: "usr/share/doc/hello/README", mode: 0o644, modTime: epoch, content: "readme"},
+	})
+
+	newPath := filepath.Join(dir, "new.apk")
+	writeAPK(t, newPath, "pkgname = hello\npkgver = 1.0.0-r0\ndepend = so:libc.so.6\ndepend = so:libz.so.1\n", []testFile{
+		{name: "usr/bin/hello", mode: 0o775, modTime: epoch.Add(time.Hour), content: "hello, world"},
+		{name: "usr/share/hello/data", mode: 0o644, modTime: epoch, content: "data"},
+	})
+
+	same, err := ComparePackages(ctx, oldPath, oldPath)
+	require.NoError(t, err)
+	require.True(t, same.Equal(), "unexpected differences: %v", same.Differences)
+
+	report, err := ComparePackages(ctx, oldPath, newPath)
+	require.NoError(t, err)
+	require.False(t, report.Equal())
+
+	kinds := map[Kind][]string{}
+	for _, d := range withoutAPKSize(report.Differences) {
+		require.Equal(t, "hello", d.Package)
+		kinds[d.Kind] = append(kinds[d.Kind], d.Path)
+	}
+
+	require.Equal(t, map[Kind][]string{
+		KindPkgInfo: {"depend"},
+		KindMode:    {"usr/bin/hello"},
+		KindModTime: {"usr/bin/hello"},
+		KindSize:    {"usr/bin/hello"},
+		KindContent: {"usr/bin/hello"},
+		KindFile:    {"usr/share/doc/hello/README", "usr/share/hello/data"},
+	}, kinds)
+
+	var buf bytes.Buffer
+	require.NoError(t, report.WriteText(&buf))
+	require.Contains(t, buf.String(), "pkginfo depend [so]: added so:libz.so.1")
+	require.Contains(t, buf.String(), "mode usr/bin/hello: -rwxr-xr-x -> -rwxrwxr-x")
+}
+
+func TestCompareELFSections(t *testing.T) {
+	oldPkg := &Package{Path: "libfoo.apk", Entries: map[string]*Entry{
+		"usr/lib/libfoo.so.1": {
+			Path:        "usr/lib/libfoo.so.1",
+			Digest:      "a",
+			ELFSections: map[string]string{".text": "1", ".note.gnu.build-id": "2"},
+		},
+	}}
+	newPkg := &Package{Path: "libfoo.apk", Entries: map[string]*Entry{
+		"usr/lib/libfoo.so.1": {
+			Path:        "usr/lib/libfoo.so.1",
+			Digest:      "b",
+			ELFSections: map[string]string{".text": "1", ".note.gnu.build-id": "3"},
+		},
+	}}
+
+	diffs := Compare(oldPkg, newPkg)
+	require.Len(t, diffs, 2)
+	require.Equal(t, KindContent, diffs[0].Kind)
+	require.Equal(t, Difference{
+		Package: "libfoo.apk",
+		Kind:    KindELF,
+		Path:    "usr/lib/libfoo.so.1",
+		Detail:  ".note.gnu.build-id",
+		Old:     "2",
+		New:     "3",
+	}, diffs[1])
+}
+
+func TestCompareDirs(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	oldDir, newDir := t.TempDir(), t.TempDir()
+	for _, dir := range []string{oldDir, newDir} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "x86_64"), 0o755))
+	}
+
+	files := []testFile{{name: "usr/bin/hello", mode: 0o755, content: "hello"}}
+
+	writeAPK(t, filepath.Join(oldDir, "x86_64", "hello-1.0.0-r0.apk"),
+		"pkgname = hello\npkgver = 1.0.0-r0\nprovides = cmd:hello=1.0.0-r0\n", files)
+	writeAPK(t, filepath.Join(oldDir, "x86_64", "goodbye-1.0.0-r0.apk"),
+		"pkgname = goodbye\npkgver = 1.0.0-r0\n", files)
+
+	// The older version in the new repository is not compared.
+	writeAPK(t, filepath.Join(newDir, "x86_64", "hello-1.0.0-r0.apk"),
+		"pkgname = hello\npkgver = 1.0.0-r0\nprovides = cmd:hello=1.0.0-r0\n", files)
+	writeAPK(t, filepath.Join(newDir, "x86_64", "hello-1.1.0-r0.apk"),
+		"pkgname = hello\npkgver = 1.1.0-r0\nprovides = cmd:hello=1.1.0-r0\n", files)
+
+	report, err := CompareDirs(ctx, oldDir, newDir)
+	require.NoError(t, err)
+
+	require.Equal(t, []Difference{{
+		Package: "goodbye",
+		Kind:    KindPackage,
+		Path:    filepath.Join("x86_64", "goodbye"),
+		Old:     "1.0.0-r0",
+	}, {
+		Package: "hello",
+		Kind:    KindPkgInfo,
+		Path:    "pkgver",
+		Old:     "1.0.0-r0",
+		New:     "1.1.0-r0",
+	}, {
+		Package: "hello",
+		Kind:    KindPkgInfo,
+		Path:    "provides",
+		Detail:  "cmd",
+		Old:     "cmd:hello=1.0.0-r0",
+		New:     "cmd:hello=1.1.0-r0",
+	}}, withoutAPKSize(report.Differences))
+}
+
+// withoutAPKSize drops the difference in the size of the apk files, which
+// depends on how well the test data compresses.
+func withoutAPKSize(diffs []Difference) []Difference {
+	return slices.DeleteFunc(diffs, func(d Difference) bool {
+		return d.Kind == KindSize && d.Detail == "apk"
+	})
+}
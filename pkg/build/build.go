@@ -49,10 +49,12 @@ import (
 	"k8s.io/kube-openapi/pkg/util/sets"
 
 	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/configlint"
 	"chainguard.dev/melange/pkg/container"
 	"chainguard.dev/melange/pkg/index"
 	"chainguard.dev/melange/pkg/linter"
 	"chainguard.dev/melange/pkg/sbom"
+	"chainguard.dev/melange/pkg/util"
 )
 
 var ErrSkipThisArch = errors.New("error: skip this arch")
@@ -100,9 +102,61 @@ type Build struct {
 	Auth                  map[string]options.Auth
 
 	EnabledBuildOptions []string
+	// The build options applied to the configuration, recorded in .PKGINFO
+	// and the SBOM.  Set by New.
+	AppliedBuildOptions []string
+
+	// Allow references to variables that are not defined, leaving them in
+	// place, rather than failing.
+	AllowUnresolved bool
+
+	// Require the configuration to conform to its schema, rather than
+	// warning about the problems.
+	Strict bool
+
+	// The variant of the variants matrix of the configuration to build.
+	Variant config.Variant
+
+	// Directories searched for the files included by the configuration.
+	IncludeDirs []string
+
+	// Skip the build if the output directory already has packages built
+	// from the same inputs.
+	SkipIfUnchanged bool
+
+	// Digest of the build inputs, recorded in .PKGINFO.  Set by BuildPackage
+	// when SkipIfUnchanged, the step cache or resuming needs it.
+	InputHash string
+
+	// Build the package a second time and fail if the outputs differ.
+	VerifyReproducible bool
+
+	// the options the build was created with, used to rebuild it
+	opts []Option
+
+	// Directory holding workspace snapshots taken after each step of the
+	// main pipeline, and the size it is kept under.
+	StepCacheDir  string
+	StepCacheSize int64
+
+	// Keep the workspace and guest directory of a failed build, recording the
+	// failing step, so it can be resumed with ResumeFrom.
+	KeepWorkspace bool
+	// Name of the main pipeline step to resume a failed build from.
+	ResumeFrom string
+
+	// Steps that failed without failing the build.  Set by BuildPackage.
+	SoftFailures []SoftFailure
 
 	// mutated by Compile
 	externalRefs []purl.PackageURL
+
+	// set by ComputeInputHash
+	resolvedEnvironment []string
+	sourceDigests       map[string]string
+
+	// set when a step failed and KeepWorkspace kept the workspace for resuming
+	workspaceKept bool
 }
 
 func New(ctx context.Context, opts ...Option) (*Build, error) {
@@ -119,8 +173,12 @@ func New(ctx context.Context, opts ...Option) (*Build, error) {
 			return nil, err
 		}
 	}
+	b.opts = opts
 
 	log := clog.New(slog.Default().Handler()).With("arch", b.Arch.ToAPK())
+	if b.Variant != nil {
+		log = log.With("variant", b.Variant.String())
+	}
 	ctx = clog.WithLogger(ctx, log)
 
 	// If no workspace directory is explicitly requested, create a
@@ -170,6 +228,11 @@ func New(ctx context.Context, opts ...Option) (*Build, error) {
 		config.WithDefaultCPU(b.DefaultCPU),
 		config.WithDefaultMemory(b.DefaultMemory),
 		config.WithDefaultTimeout(b.DefaultTimeout),
+		config.WithAllowUnresolved(b.AllowUnresolved),
+		config.WithStrict(b.Strict),
+		config.WithIncludeDirs(b.IncludeDirs),
+		config.WithArch(b.Arch),
+		config.WithVariant(b.Variant),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load configuration: %w", err)
@@ -205,11 +268,21 @@ func New(ctx context.Context, opts ...Option) (*Build, error) {
 
 		if opt, ok := b.Configuration.Options[optName]; ok {
 			if err := b.ApplyBuildOption(opt); err != nil {
-				return nil, err
+				return nil, fmt.Errorf("applying build option %s: %w", optName, err)
 			}
+			b.AppliedBuildOptions = append(b.AppliedBuildOptions, optName)
 		}
 	}
 
+	// Drop the subpackages that are disabled, unless a build option enabled
+	// them.
+	b.Configuration.Subpackages = slices.DeleteFunc(b.Configuration.Subpackages, func(sp config.Subpackage) bool {
+		if sp.Disabled {
+			log.Infof("skipping subpackage %s because it is disabled", sp.Name)
+		}
+		return sp.Disabled
+	})
+
 	return &b, nil
 }
 
@@ -217,10 +290,12 @@ func (b *Build) Close(ctx context.Context) error {
 	log := clog.FromContext(ctx)
 	errs := []error{}
 	if b.Remove {
-		log.Infof("deleting guest dir %s", b.GuestDir)
-		errs = append(errs, os.RemoveAll(b.GuestDir))
-		log.Infof("deleting workspace dir %s", b.WorkspaceDir)
-		errs = append(errs, os.RemoveAll(b.WorkspaceDir))
+		if !b.workspaceKept {
+			log.Infof("deleting guest dir %s", b.GuestDir)
+			errs = append(errs, os.RemoveAll(b.GuestDir))
+			log.Infof("deleting workspace dir %s", b.WorkspaceDir)
+			errs = append(errs, os.RemoveAll(b.WorkspaceDir))
+		}
 		if b.containerConfig != nil && b.containerConfig.ImgRef != "" {
 			errs = append(errs, b.Runner.OCIImageLoader().RemoveImage(context.WithoutCancel(ctx), b.containerConfig.ImgRef))
 		}
@@ -355,9 +430,94 @@ func (b *Build) ApplyBuildOption(bo config.BuildOption) error {
 		b.Configuration.Environment.Contents.Packages = pkgList
 	}
 
+	// Patch the dependencies of the package.
+	sm, err := NewSubstitutionMap(&b.Configuration, b.Arch, b.BuildFlavor(), b.EnabledBuildOptions)
+	if err != nil {
+		return err
+	}
+	deps := &b.Configuration.Package.Dependencies
+	if deps.Runtime, err = applyListOption(deps.Runtime, bo.Dependencies.Runtime, sm.Substitutions); err != nil {
+		return fmt.Errorf("runtime dependencies: %w", err)
+	}
+	if deps.Provides, err = applyListOption(deps.Provides, bo.Dependencies.Provides, sm.Substitutions); err != nil {
+		return fmt.Errorf("provides: %w", err)
+	}
+
+	// Enable or disable subpackages.
+	for _, names := range []struct {
+		list     []string
+		disabled bool
+	}{{bo.Subpackages.Enable, false}, {bo.Subpackages.Disable, true}} {
+		for _, name := range names.list {
+			i := slices.IndexFunc(b.Configuration.Subpackages, func(sp config.Subpackage) bool {
+				return sp.Name == name
+			})
+			if i < 0 {
+				return fmt.Errorf("no subpackage named %q", name)
+			}
+			b.Configuration.Subpackages[i].Disabled = names.disabled
+		}
+	}
+
+	// Patch the pipeline.
+	for _, step := range bo.Pipeline.Replace {
+		if step.Name == "" {
+			return errors.New("pipeline steps to replace must be named")
+		}
+		if !replaceStep(b.Configuration.Pipeline, step) {
+			return fmt.Errorf("no pipeline step named %q", step.Name)
+		}
+	}
+	b.Configuration.Pipeline = append(b.Configuration.Pipeline, bo.Pipeline.Append...)
+
 	return nil
 }
 
+// applyListOption adds the entries of lo to list, and removes those it
+// lists, substituting variables in them.
+func applyListOption(list []string, lo config.ListOption, nw map[string]string) ([]string, error) {
+	mutate := func(entries []string) ([]string, error) {
+		out := make([]string, 0, len(entries))
+		for _, e := range entries {
+			m, err := util.MutateStringFromMap(nw, e)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, m)
+		}
+		return out, nil
+	}
+
+	remove, err := mutate(lo.Remove)
+	if err != nil {
+		return nil, err
+	}
+	add, err := mutate(lo.Add)
+	if err != nil {
+		return nil, err
+	}
+
+	list = slices.DeleteFunc(list, func(e string) bool {
+		return slices.Contains(remove, e)
+	})
+	return append(list, add...), nil
+}
+
+// replaceStep replaces the step of pipelines, or of the pipelines nested in
+// them, with the same name as step, reporting whether there was one.
+func replaceStep(pipelines []config.Pipeline, step config.Pipeline) bool {
+	for i := range pipelines {
+		if pipelines[i].Name == step.Name {
+			pipelines[i] = step
+			return true
+		}
+		if replaceStep(pipelines[i].Pipeline, step) {
+			return true
+		}
+	}
+	return false
+}
+
 func (b *Build) loadIgnoreRules(ctx context.Context) ([]*xignore.Pattern, error) {
 	log := clog.FromContext(ctx)
 	ignorePath := filepath.Join(b.SourceDir, b.WorkspaceIgnore)
@@ -494,8 +654,29 @@ func (b *Build) IsBuildLess() bool {
 // ConfigFileExternalRef calculates ExternalRef for the melange config
 // file itself.
 func (b *Build) ConfigFileExternalRef() (*purl.PackageURL, error) {
+	return fileExternalRef(b.ConfigFile)
+}
+
+// IncludedFilesExternalRefs calculates ExternalRefs for the files included by
+// the melange config file.
+func (b *Build) IncludedFilesExternalRefs() ([]purl.PackageURL, error) {
+	refs := []purl.PackageURL{}
+	for _, f := range b.Configuration.IncludedFiles() {
+		ref, err := fileExternalRef(f)
+		if err != nil {
+			return nil, fmt.Errorf("included file %s: %w", f, err)
+		}
+		if ref != nil {
+			refs = append(refs, *ref)
+		}
+	}
+	return refs, nil
+}
+
+// fileExternalRef calculates ExternalRef for a file in a GitHub repository.
+func fileExternalRef(file string) (*purl.PackageURL, error) {
 	// configFile must exist
-	configpath, err := filepath.Abs(b.ConfigFile)
+	configpath, err := filepath.Abs(file)
 	if err != nil {
 		return nil, err
 	}
@@ -685,14 +866,6 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 
 	pkg := &b.Configuration.Package
 
-	if b.GuestDir == "" {
-		guestDir, err := os.MkdirTemp(b.Runner.TempDir(), "melange-guest-*")
-		if err != nil {
-			return fmt.Errorf("unable to make guest directory: %w", err)
-		}
-		b.GuestDir = guestDir
-	}
-
 	log.Infof("evaluating pipelines for package requirements")
 	if err := b.Compile(ctx); err != nil {
 		return fmt.Errorf("compiling build: %w", err)
@@ -712,6 +885,34 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 		return !result
 	})
 
+	if b.needsInputHash() {
+		inputHash, err := b.ComputeInputHash(ctx)
+		if err != nil {
+			return fmt.Errorf("computing input hash: %w", err)
+		}
+		b.InputHash = inputHash
+		log.Infof("input hash: %s", inputHash)
+	}
+
+	if b.SkipIfUnchanged {
+		unchanged, err := b.unchanged(ctx, b.InputHash)
+		if err != nil {
+			return fmt.Errorf("comparing against existing packages: %w", err)
+		}
+		if unchanged {
+			log.Infof("skipping build of %s: packages in %s were built from identical inputs", b.Configuration.Name(), b.OutDir)
+			return nil
+		}
+	}
+
+	if b.GuestDir == "" {
+		guestDir, err := os.MkdirTemp(b.Runner.TempDir(), "melange-guest-*")
+		if err != nil {
+			return fmt.Errorf("unable to make guest directory: %w", err)
+		}
+		b.GuestDir = guestDir
+	}
+
 	configFileRef, err := b.ConfigFileExternalRef()
 	if err != nil {
 		return fmt.Errorf("failed to create ExternalRef for configfile: %w", err)
@@ -724,14 +925,29 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 		b.externalRefs = append(b.externalRefs, *configFileRef)
 	}
 
+	includedRefs, err := b.IncludedFilesExternalRefs()
+	if err != nil {
+		return fmt.Errorf("failed to create ExternalRef for included files: %w", err)
+	}
+	for _, ref := range includedRefs {
+		log.Infof("adding external ref %s for included file", ref)
+		b.externalRefs = append(b.externalRefs, ref)
+	}
+
 	pr := &pipelineRunner{
 		interactive: b.Interactive,
 		debug:       b.Debug,
 		config:      b.WorkspaceConfig(ctx),
 		runner:      b.Runner,
 	}
+	defer func() {
+		b.SoftFailures = pr.softFailures
+		b.SummarizeSoftFailures(ctx)
+	}()
 
-	if b.EmptyWorkspace {
+	if b.ResumeFrom != "" {
+		log.Infof("resuming build in workspace %s", b.WorkspaceDir)
+	} else if b.EmptyWorkspace {
 		log.Infof("empty workspace requested")
 	} else {
 		// Prepare workspace directory
@@ -792,7 +1008,7 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 
 		// run the main pipeline
 		log.Debug("running the main pipeline")
-		if err := pr.runPipelines(ctx, b.Configuration.Pipeline); err != nil {
+		if err := b.runMainPipeline(ctx, pr); err != nil {
 			return fmt.Errorf("unable to run package %s pipeline: %w", b.Configuration.Name(), err)
 		}
 
@@ -845,14 +1061,7 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 		log.Infof("running package linters for %s", lt.pkgName)
 		path := filepath.Join(b.WorkspaceDir, "melange-out", lt.pkgName)
 
-		// Downgrade disabled checks from required to warn
-		require := slices.DeleteFunc(b.LintRequire, func(s string) bool {
-			return slices.Contains(lt.disabled, s)
-		})
-		warn := slices.CompactFunc(append(b.LintWarn, lt.disabled...), func(a, b string) bool {
-			return a == b
-		})
-
+		require, warn := packageLinters(b.LintRequire, b.LintWarn, lt.disabled)
 		if err := linter.LintBuild(ctx, lt.pkgName, path, require, warn); err != nil {
 			return fmt.Errorf("unable to lint package %s: %w", lt.pkgName, err)
 		}
@@ -879,6 +1088,7 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 			Namespace:       namespace,
 			Arch:            b.Arch.ToAPK(),
 			SourceDateEpoch: b.SourceDateEpoch,
+			BuildOptions:    b.AppliedBuildOptions,
 		}); err != nil {
 			return fmt.Errorf("writing SBOMs: %w", err)
 		}
@@ -896,6 +1106,7 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 		Namespace:       namespace,
 		Arch:            b.Arch.ToAPK(),
 		SourceDateEpoch: b.SourceDateEpoch,
+		BuildOptions:    b.AppliedBuildOptions,
 	}); err != nil {
 		return fmt.Errorf("writing SBOMs: %w", err)
 	}
@@ -929,6 +1140,12 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 		log.Warnf("unable to clean workspace: %s", err)
 	}
 
+	if b.VerifyReproducible {
+		if err := b.verifyReproducible(ctx); err != nil {
+			return err
+		}
+	}
+
 	// generate APKINDEX.tar.gz and sign it
 	if b.GenerateIndex {
 		packageDir := filepath.Join(b.OutDir, b.Arch.ToAPK())
@@ -978,6 +1195,20 @@ func (b *Build) SummarizePaths(ctx context.Context) {
 	}
 }
 
+// SummarizeSoftFailures reports the steps that failed without failing the
+// build.
+func (b *Build) SummarizeSoftFailures(ctx context.Context) {
+	log := clog.FromContext(ctx)
+	if len(b.SoftFailures) == 0 {
+		return
+	}
+
+	log.Warnf("%d steps failed but were allowed to with continue-on-error:", len(b.SoftFailures))
+	for _, sf := range b.SoftFailures {
+		log.Warnf("  %s: %v", sf.Step, sf.Err)
+	}
+}
+
 func (b *Build) Summarize(ctx context.Context) {
 	log := clog.FromContext(ctx)
 	log.Infof("melange is building:")
@@ -1186,3 +1417,24 @@ func sourceDateEpoch(defaultTime time.Time) (time.Time, error) {
 
 	return time.Unix(sec, 0).UTC(), nil
 }
+
+// packageLinters returns the linters to require and to warn about for a
+// package whose checks disable the given names.  Disabled linters are
+// downgraded from required to warn.  The same list disables the rules of
+// melange lint-config, which are not linters and are left out.
+func packageLinters(require, warn, disabled []string) ([]string, []string) {
+	rules := configlint.Rules()
+	disabled = slices.DeleteFunc(slices.Clone(disabled), func(s string) bool {
+		return slices.Contains(rules, s)
+	})
+
+	// Downgrade disabled checks from required to warn
+	require = slices.DeleteFunc(slices.Clone(require), func(s string) bool {
+		return slices.Contains(disabled, s)
+	})
+	warn = slices.CompactFunc(append(slices.Clone(warn), disabled...), func(a, b string) bool {
+		return a == b
+	})
+
+	return require, warn
+}
@@ -22,6 +22,7 @@ import (
 	"time"
 
 	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/linter"
 
 	apko_types "chainguard.dev/apko/pkg/build/types"
 	"github.com/chainguard-dev/clog/slogtest"
@@ -369,3 +370,97 @@ func TestSourceDateEpoch(t *testing.T) {
 		})
 	}
 }
+
+func TestApplyBuildOption(t *testing.T) {
+	b := Build{
+		Arch: apko_types.ParseArchitecture("amd64"),
+		Configuration: config.Configuration{
+			Package: config.Package{
+				Name:    "openssl",
+				Version: "3.3.0",
+				Dependencies: config.Dependencies{
+					Runtime:  []string{"libcrypto3", "openssl-config"},
+					Provides: []string{"openssl-provider"},
+				},
+			},
+			Pipeline: []config.Pipeline{{
+				Name: "configure",
+				Runs: "./Configure",
+			}, {
+				Pipeline: []config.Pipeline{{
+					Name: "install",
+					Runs: "make install",
+				}},
+			}},
+			Subpackages: []config.Subpackage{{
+				Name: "openssl-config",
+			}, {
+				Name:     "openssl-config-fips",
+				Disabled: true,
+			}},
+		},
+	}
+
+	require.NoError(t, b.ApplyBuildOption(config.BuildOption{
+		Dependencies: config.DependenciesOption{
+			Runtime: config.ListOption{
+				Add:    []string{"openssl-config-fips"},
+				Remove: []string{"openssl-config"},
+			},
+			Provides: config.ListOption{
+				Add:    []string{"openssl-provider-fips=${{package.full-version}}"},
+				Remove: []string{"openssl-provider"},
+			},
+		},
+		Subpackages: config.SubpackagesOption{
+			Enable:  []string{"openssl-config-fips"},
+			Disable: []string{"openssl-config"},
+		},
+		Pipeline: config.PipelineOption{
+			Replace: []config.Pipeline{{
+				Name: "configure",
+				Runs: "./Configure enable-fips",
+			}, {
+				Name: "install",
+				Runs: "make install_fips",
+			}},
+			Append: []config.Pipeline{{
+				Runs: "openssl fipsinstall",
+			}},
+		},
+	}))
+
+	cfg := b.Configuration
+	require.Equal(t, []string{"libcrypto3", "openssl-config-fips"}, cfg.Package.Dependencies.Runtime)
+	require.Equal(t, []string{"openssl-provider-fips=3.3.0-r0"}, cfg.Package.Dependencies.Provides)
+	require.True(t, cfg.Subpackages[0].Disabled)
+	require.False(t, cfg.Subpackages[1].Disabled)
+	require.Equal(t, "./Configure enable-fips", cfg.Pipeline[0].Runs)
+	require.Equal(t, "make install_fips", cfg.Pipeline[1].Pipeline[0].Runs)
+	require.Equal(t, "openssl fipsinstall", cfg.Pipeline[2].Runs)
+
+	require.ErrorContains(t, b.ApplyBuildOption(config.BuildOption{
+		Subpackages: config.SubpackagesOption{Disable: []string{"openssl-doc"}},
+	}), `no subpackage named "openssl-doc"`)
+	require.ErrorContains(t, b.ApplyBuildOption(config.BuildOption{
+		Pipeline: config.PipelineOption{Replace: []config.Pipeline{{Name: "test"}}},
+	}), `no pipeline step named "test"`)
+}
+
+func TestPackageLinters(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	lintRequire := []string{"dev", "setuidgid"}
+	lintWarn := []string{"opt"}
+	req, warn := packageLinters(lintRequire, lintWarn, []string{"dev", "unused-vars"})
+	require.Equal(t, []string{"setuidgid"}, req)
+	require.Equal(t, []string{"opt", "dev"}, warn)
+
+	// The defaults are left alone.
+	require.Equal(t, []string{"dev", "setuidgid"}, lintRequire)
+	require.Equal(t, []string{"opt"}, lintWarn)
+
+	// Rules of lint-config disabled alongside the linters are not passed on
+	// to the linter, which would reject them.
+	require.NoError(t, linter.LintBuild(ctx, "foo", t.TempDir(), req, warn))
+}
@@ -0,0 +1,181 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"chainguard.dev/melange/pkg/config"
+	"github.com/chainguard-dev/clog"
+	"gopkg.in/yaml.v3"
+)
+
+// EmbeddedPipelines is the source of the pipelines built into melange.
+const EmbeddedPipelines = "embedded"
+
+// PipelineInfo describes a reusable pipeline that steps can refer to with
+// uses.
+type PipelineInfo struct {
+	// The name steps use the pipeline by, e.g. go/build
+	Name string `json:"name"`
+	// The human readable name of the pipeline
+	Description string `json:"description,omitempty"`
+	// The pipeline directory the pipeline was found in, or EmbeddedPipelines
+	Source string `json:"source"`
+	// The sources of pipelines with the same name that this one takes
+	// precedence over
+	Shadows []string `json:"shadows,omitempty"`
+	// The inputs the pipeline takes
+	Inputs map[string]config.Input `json:"inputs,omitempty"`
+	// The packages the pipeline needs
+	Needs []string `json:"needs,omitempty"`
+}
+
+// loadPipeline finds the definition of the pipeline uses in the pipeline
+// directories, in order, and then among the embedded pipelines.  It returns
+// the definition and where it was found.
+func loadPipeline(ctx context.Context, pipelineDirs []string, uses string) ([]byte, string, error) {
+	log := clog.FromContext(ctx)
+
+	for _, pd := range pipelineDirs {
+		log.Debugf("trying to load pipeline %q from %q", uses, pd)
+
+		data, err := os.ReadFile(filepath.Join(pd, uses+".yaml"))
+		if err == nil {
+			log.Debugf("found pipeline %q in %q", uses, pd)
+			return data, pd, nil
+		}
+	}
+
+	log.Debugf("trying to load pipeline %q from embedded fs pipelines/%q.yaml", uses, uses)
+	data, err := f.ReadFile("pipelines/" + uses + ".yaml")
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to load pipeline: %w", err)
+	}
+
+	return data, EmbeddedPipelines, nil
+}
+
+// pipelineNames returns the names of the pipelines in fsys.
+func pipelineNames(fsys fs.FS) ([]string, error) {
+	var names []string
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && path.Ext(p) == ".yaml" {
+			names = append(names, strings.TrimSuffix(p, ".yaml"))
+		}
+		return nil
+	})
+	return names, err
+}
+
+// ListPipelines returns the pipelines in the pipeline directories and the
+// embedded pipelines, sorted by name.  When several have the same name, the
+// one that steps would use is returned, in the same order of precedence used
+// when compiling a build.  Pipeline directories that do not exist are
+// ignored.
+func ListPipelines(ctx context.Context, pipelineDirs []string) ([]PipelineInfo, error) {
+	seen := map[string]bool{}
+
+	for _, pd := range pipelineDirs {
+		names, err := pipelineNames(os.DirFS(pd))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("listing pipelines in %s: %w", pd, err)
+		}
+		for _, name := range names {
+			seen[name] = true
+		}
+	}
+
+	embedded, err := fs.Sub(f, "pipelines")
+	if err != nil {
+		return nil, err
+	}
+	names, err := pipelineNames(embedded)
+	if err != nil {
+		return nil, fmt.Errorf("listing embedded pipelines: %w", err)
+	}
+	for _, name := range names {
+		seen[name] = true
+	}
+
+	infos := make([]PipelineInfo, 0, len(seen))
+	for name := range seen {
+		info, err := DescribePipeline(ctx, pipelineDirs, name)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, *info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+
+	return infos, nil
+}
+
+// DescribePipeline returns the pipeline that steps using name would use.
+func DescribePipeline(ctx context.Context, pipelineDirs []string, name string) (*PipelineInfo, error) {
+	data, source, err := loadPipeline(ctx, pipelineDirs, name)
+	if err != nil {
+		return nil, fmt.Errorf("pipeline %q: %w", name, err)
+	}
+
+	var p config.Pipeline
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("unable to parse pipeline %q: %w", name, err)
+	}
+
+	info := &PipelineInfo{
+		Name:        name,
+		Description: p.Name,
+		Source:      source,
+		Inputs:      p.Inputs,
+	}
+	if p.Needs != nil {
+		info.Needs = p.Needs.Packages
+	}
+
+	// Everything after the source that was used is shadowed by it.
+	shadowed := false
+	for _, pd := range pipelineDirs {
+		if pd == source {
+			shadowed = true
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(pd, name+".yaml")); shadowed && err == nil {
+			info.Shadows = append(info.Shadows, pd)
+		}
+	}
+	if source != EmbeddedPipelines {
+		if _, err := fs.Stat(f, "pipelines/"+name+".yaml"); err == nil {
+			info.Shadows = append(info.Shadows, EmbeddedPipelines)
+		}
+	}
+
+	return info, nil
+}
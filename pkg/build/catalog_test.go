@@ -0,0 +1,82 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListPipelines(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	write := func(dir, name, content string) {
+		t.Helper()
+		p := filepath.Join(dir, name+".yaml")
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+		require.NoError(t, os.WriteFile(p, []byte(content), 0o644))
+	}
+
+	first, second := t.TempDir(), t.TempDir()
+	write(first, "fetch", `
+name: Fetch with curl
+needs:
+  packages:
+    - curl
+inputs:
+  uri:
+    required: true
+`)
+	write(first, "custom/thing", "name: First thing\n")
+	write(second, "custom/thing", "name: Second thing\n")
+	write(second, "other", "name: Other\n")
+	dirs := []string{first, second, filepath.Join(t.TempDir(), "missing")}
+
+	infos, err := ListPipelines(ctx, dirs)
+	require.NoError(t, err)
+
+	byName := map[string]PipelineInfo{}
+	for i, info := range infos {
+		if i > 0 {
+			require.Less(t, infos[i-1].Name, info.Name, "pipelines are not sorted")
+		}
+		byName[info.Name] = info
+	}
+
+	fetch := byName["fetch"]
+	require.Equal(t, first, fetch.Source)
+	require.Equal(t, []string{EmbeddedPipelines}, fetch.Shadows)
+	require.Equal(t, []string{"curl"}, fetch.Needs)
+	require.True(t, fetch.Inputs["uri"].Required)
+
+	thing := byName["custom/thing"]
+	require.Equal(t, first, thing.Source)
+	require.Equal(t, "First thing", thing.Description)
+	require.Equal(t, []string{second}, thing.Shadows)
+
+	require.Equal(t, second, byName["other"].Source)
+	require.Empty(t, byName["other"].Shadows)
+
+	build := byName["go/build"]
+	require.Equal(t, EmbeddedPipelines, build.Source)
+	require.Contains(t, build.Inputs, "packages")
+
+	_, err = DescribePipeline(ctx, dirs, "does-not-exist")
+	require.Error(t, err)
+}
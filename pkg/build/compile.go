@@ -16,10 +16,11 @@ package build
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"maps"
-	"os"
-	"path/filepath"
+	"sort"
+	"strings"
 
 	"chainguard.dev/melange/pkg/cond"
 	"chainguard.dev/melange/pkg/config"
@@ -49,13 +50,12 @@ func (t *Test) Compile(ctx context.Context) error {
 		return fmt.Errorf("compiling main pipelines: %w", err)
 	}
 
+	var unresolved []config.UnresolvedReference
+
 	for i, sp := range cfg.Subpackages {
 		sm := sm.Subpackage(&sp)
-		if sp.If != "" {
-			sp.If, err = util.MutateAndQuoteStringFromMap(sm.Substitutions, sp.If)
-			if err != nil {
-				return fmt.Errorf("mutating subpackage if: %w", err)
-			}
+		if err := ignore.mutateSubpackageIf(sm, &sp); err != nil {
+			return err
 		}
 
 		// We want to evaluate this but not accumulate its deps.
@@ -79,6 +79,7 @@ func (t *Test) Compile(ctx context.Context) error {
 		if err := test.CompilePipelines(ctx, sm, sp.Test.Pipeline); err != nil {
 			return fmt.Errorf("compiling subpackage %q tests: %w", sp.Name, err)
 		}
+		unresolved = append(unresolved, test.Unresolved...)
 
 		// Append anything this subpackage test needs.
 		te.Packages = append(te.Packages, test.Needs...)
@@ -101,12 +102,13 @@ func (t *Test) Compile(ctx context.Context) error {
 		if err := test.CompilePipelines(ctx, sm, cfg.Test.Pipeline); err != nil {
 			return fmt.Errorf("compiling main pipelines: %w", err)
 		}
+		unresolved = append(unresolved, test.Unresolved...)
 
 		// Append anything the main package test needs.
 		te.Packages = append(te.Packages, test.Needs...)
 	}
 
-	return nil
+	return checkUnresolved(ctx, append(ignore.Unresolved, unresolved...), t.AllowUnresolved)
 }
 
 // Compile compiles all configuration, including tests, by loading any pipelines and substituting all variables.
@@ -125,14 +127,13 @@ func (b *Build) Compile(ctx context.Context) error {
 		return fmt.Errorf("compiling main pipelines: %w", err)
 	}
 
+	var unresolved []config.UnresolvedReference
+
 	for i, sp := range cfg.Subpackages {
 		sm := sm.Subpackage(&sp)
 
-		if sp.If != "" {
-			sp.If, err = util.MutateAndQuoteStringFromMap(sm.Substitutions, sp.If)
-			if err != nil {
-				return fmt.Errorf("mutating subpackage if: %w", err)
-			}
+		if err := c.mutateSubpackageIf(sm, &sp); err != nil {
+			return err
 		}
 
 		if err := c.CompilePipelines(ctx, sm, sp.Pipeline); err != nil {
@@ -149,6 +150,7 @@ func (b *Build) Compile(ctx context.Context) error {
 		if err := tc.CompilePipelines(ctx, sm, sp.Test.Pipeline); err != nil {
 			return fmt.Errorf("compiling subpackage %q tests: %w", sp.Name, err)
 		}
+		unresolved = append(unresolved, tc.Unresolved...)
 
 		te := &cfg.Subpackages[i].Test.Environment.Contents
 
@@ -170,6 +172,7 @@ func (b *Build) Compile(ctx context.Context) error {
 		if err := tc.CompilePipelines(ctx, sm, cfg.Test.Pipeline); err != nil {
 			return fmt.Errorf("compiling main pipelines: %w", err)
 		}
+		unresolved = append(unresolved, tc.Unresolved...)
 
 		te := &b.Configuration.Test.Environment.Contents
 		te.Packages = append(te.Packages, tc.Needs...)
@@ -178,16 +181,142 @@ func (b *Build) Compile(ctx context.Context) error {
 		te.Packages = append(te.Packages, b.Configuration.Package.Name)
 	}
 
+	if err := checkUnresolved(ctx, append(c.Unresolved, unresolved...), b.AllowUnresolved); err != nil {
+		return err
+	}
+
 	b.externalRefs = c.ExternalRefs
 
 	return nil
 }
 
+// checkUnresolved fails with all the references to variables that are not
+// defined, unless they are allowed, in which case they are warned about.
+func checkUnresolved(ctx context.Context, refs []config.UnresolvedReference, allow bool) error {
+	seen := map[string]bool{}
+	unique := []config.UnresolvedReference{}
+	for _, ref := range refs {
+		if s := ref.String(); !seen[s] {
+			seen[s] = true
+			unique = append(unique, ref)
+		}
+	}
+
+	if len(unique) == 0 {
+		return nil
+	}
+	if !allow {
+		return &config.UnresolvedError{References: unique}
+	}
+
+	log := clog.FromContext(ctx)
+	for _, ref := range unique {
+		log.Warnf("%s", ref)
+	}
+	return nil
+}
+
 type Compiled struct {
 	PipelineDirs []string
 
 	Needs        []string
 	ExternalRefs []purl.PackageURL
+
+	// References to variables that are not defined, which are left in place.
+	Unresolved []config.UnresolvedReference
+}
+
+// mutate substitutes the variables in a field of a pipeline, quoting their
+// values in conditions.  References to variables that are not defined are
+// left in place and recorded.
+func (c *Compiled) mutate(pipeline *config.Pipeline, field string, with map[string]string, s string) (string, error) {
+	mutate := util.MutateStringFromMap
+	if field == "if" {
+		mutate = util.MutateAndQuoteStringFromMap
+	}
+
+	out, err := mutate(with, s)
+	var uerr *util.UndefinedError
+	if !errors.As(err, &uerr) {
+		return out, err
+	}
+
+	c.unresolved(pipeline, field, uerr)
+	return out, nil
+}
+
+// unresolved records the references to variables that are not defined in a
+// field of a pipeline.
+func (c *Compiled) unresolved(pipeline *config.Pipeline, field string, uerr *util.UndefinedError) {
+	for _, v := range uerr.Variables {
+		ref := config.UnresolvedReference{
+			Name:  v.Name,
+			Text:  v.Text,
+			Field: fmt.Sprintf("%s of pipeline %q", field, identity(pipeline)),
+		}
+		if pos, ok := pipeline.ReferencePosition(field, v.Offset, v.Text); ok {
+			ref.Position = &pos
+		}
+		c.Unresolved = append(c.Unresolved, ref)
+	}
+}
+
+// unresolvedWith records the references to variables that are not defined in
+// the inputs of a pipeline.
+func (c *Compiled) unresolvedWith(pipeline *config.Pipeline, undefined undefinedWithError) {
+	keys := make([]string, 0, len(undefined))
+	for k := range undefined {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, nk := range keys {
+		k, ok := strings.CutPrefix(nk, "${{inputs.")
+		if !ok {
+			// The substitutions common to all pipelines are checked
+			// when they are created.
+			continue
+		}
+		k = strings.TrimSuffix(k, "}}")
+
+		field := "with." + k
+		if _, ok := pipeline.With[k]; !ok {
+			if _, ok := pipeline.With[nk]; ok {
+				// Inherited from the parent pipeline, which records it.
+				continue
+			}
+			field = fmt.Sprintf("default of input %s", k)
+		}
+		c.unresolved(pipeline, field, undefined[nk])
+	}
+}
+
+// mutateSubpackageIf substitutes the variables in the condition of a
+// subpackage.  References to variables that are not defined are left in place
+// and recorded.
+func (c *Compiled) mutateSubpackageIf(sm *SubstitutionMap, sp *config.Subpackage) error {
+	if sp.If == "" {
+		return nil
+	}
+
+	var err error
+	sp.If, err = util.MutateAndQuoteStringFromMap(sm.Substitutions, sp.If)
+	var uerr *util.UndefinedError
+	if !errors.As(err, &uerr) {
+		if err != nil {
+			return fmt.Errorf("mutating subpackage if: %w", err)
+		}
+		return nil
+	}
+
+	for _, v := range uerr.Variables {
+		c.Unresolved = append(c.Unresolved, config.UnresolvedReference{
+			Name:  v.Name,
+			Text:  v.Text,
+			Field: fmt.Sprintf("if of subpackage %q", sp.Name),
+		})
+	}
+	return nil
 }
 
 func (c *Compiled) CompilePipelines(ctx context.Context, sm *SubstitutionMap, pipelines []config.Pipeline) error {
@@ -205,51 +334,55 @@ func (c *Compiled) CompilePipelines(ctx context.Context, sm *SubstitutionMap, pi
 }
 
 func (c *Compiled) compilePipeline(ctx context.Context, sm *SubstitutionMap, pipeline *config.Pipeline) error {
-	log := clog.FromContext(ctx)
 	uses, with := pipeline.Uses, maps.Clone(pipeline.With)
+	retry, timeout, continueOnError := pipeline.Retry, pipeline.Timeout, pipeline.ContinueOnError
 
 	if uses != "" {
-		var data []byte
-		// Set this to fail up front in case there are no pipeline dirs specified
-		// and we can't find them.
-		err := fmt.Errorf("could not find 'uses' pipeline %q", uses)
-
-		for _, pd := range c.PipelineDirs {
-			log.Debugf("trying to load pipeline %q from %q", uses, pd)
-
-			data, err = os.ReadFile(filepath.Join(pd, uses+".yaml"))
-			if err == nil {
-				log.Infof("Found pipeline %s", string(data))
-				break
-			}
-		}
+		data, _, err := loadPipeline(ctx, c.PipelineDirs, uses)
 		if err != nil {
-			log.Debugf("trying to load pipeline %q from embedded fs pipelines/%q.yaml", uses, uses)
-			data, err = f.ReadFile("pipelines/" + uses + ".yaml")
-			if err != nil {
-				return fmt.Errorf("unable to load pipeline: %w", err)
-			}
+			return err
 		}
 
 		if err := yaml.Unmarshal(data, pipeline); err != nil {
 			return fmt.Errorf("unable to parse pipeline %q: %w", uses, err)
 		}
+
+		// The error handling of the step using the pipeline takes precedence.
+		if retry != nil {
+			pipeline.Retry = retry
+		}
+		if timeout != 0 {
+			pipeline.Timeout = timeout
+		}
+		if continueOnError {
+			pipeline.ContinueOnError = true
+		}
 	}
 
+	// References to step outputs are substituted when the pipeline runs.
+	sm.deferStepOutputs(pipeline, with)
+
 	validated, err := validateWith(with, pipeline.Inputs)
 	if err != nil {
 		return fmt.Errorf("unable to validate with: %w", err)
 	}
 
 	mutated, err := sm.MutateWith(validated)
-	if err != nil {
+	var undefined undefinedWithError
+	if errors.As(err, &undefined) {
+		c.unresolvedWith(pipeline, undefined)
+	} else if err != nil {
 		return fmt.Errorf("mutating with: %w", err)
 	}
 
+	if err := checkInputs(ctx, pipeline, mutated); err != nil {
+		return err
+	}
+
 	// allow input mutations on needs.packages
 	if pipeline.Needs != nil {
 		for i := range pipeline.Needs.Packages {
-			pipeline.Needs.Packages[i], err = util.MutateStringFromMap(mutated, pipeline.Needs.Packages[i])
+			pipeline.Needs.Packages[i], err = c.mutate(pipeline, "needs", mutated, pipeline.Needs.Packages[i])
 			if err != nil {
 				return fmt.Errorf("mutating needs: %w", err)
 			}
@@ -257,19 +390,19 @@ func (c *Compiled) compilePipeline(ctx context.Context, sm *SubstitutionMap, pip
 	}
 
 	if pipeline.WorkDir != "" {
-		pipeline.WorkDir, err = util.MutateStringFromMap(mutated, pipeline.WorkDir)
+		pipeline.WorkDir, err = c.mutate(pipeline, "working-directory", mutated, pipeline.WorkDir)
 		if err != nil {
 			return fmt.Errorf("mutating workdir: %w", err)
 		}
 	}
 
-	pipeline.Runs, err = util.MutateStringFromMap(mutated, pipeline.Runs)
+	pipeline.Runs, err = c.mutate(pipeline, "runs", mutated, pipeline.Runs)
 	if err != nil {
 		return fmt.Errorf("mutating runs: %w", err)
 	}
 
 	if pipeline.If != "" {
-		pipeline.If, err = util.MutateAndQuoteStringFromMap(mutated, pipeline.If)
+		pipeline.If, err = c.mutate(pipeline, "if", mutated, pipeline.If)
 		if err != nil {
 			return fmt.Errorf("mutating if: %w", err)
 		}
@@ -319,6 +452,47 @@ func (c *Compiled) compilePipeline(ctx context.Context, sm *SubstitutionMap, pip
 	return nil
 }
 
+// checkInputs validates the inputs declared by the pipeline and the values
+// they were given, and warns about the use of deprecated inputs.  Values that
+// are only known when the pipeline runs are not checked.
+func checkInputs(ctx context.Context, pipeline *config.Pipeline, mutated map[string]string) error {
+	log := clog.FromContext(ctx)
+
+	keys := make([]string, 0, len(pipeline.Inputs))
+	for k := range pipeline.Inputs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		input := pipeline.Inputs[k]
+		if err := input.Validate(); err != nil {
+			return fmt.Errorf("pipeline %q declares invalid input %q: %w", identity(pipeline), k, err)
+		}
+
+		if _, ok := pipeline.With[k]; ok && input.Deprecated != "" {
+			if pos, ok := pipeline.WithPosition(k); ok {
+				log.Warnf("%s: input %q of pipeline %q is deprecated: %s", pos, k, identity(pipeline), input.Deprecated)
+			} else {
+				log.Warnf("input %q of pipeline %q is deprecated: %s", k, identity(pipeline), input.Deprecated)
+			}
+		}
+
+		v := mutated[fmt.Sprintf("${{inputs.%s}}", k)]
+		if v == "" || strings.Contains(v, "${{") {
+			continue
+		}
+		if err := input.Check(v); err != nil {
+			if pos, ok := pipeline.WithPosition(k); ok {
+				return fmt.Errorf("%s: invalid value for input %q: %w", pos, k, err)
+			}
+			return fmt.Errorf("invalid value for input %q: %w", k, err)
+		}
+	}
+
+	return nil
+}
+
 func identity(p *config.Pipeline) string {
 	if p.Name != "" {
 		return p.Name
@@ -334,7 +508,10 @@ func (c *Compiled) gatherDeps(ctx context.Context, pipeline *config.Pipeline) er
 
 	id := identity(pipeline)
 
-	if pipeline.If != "" {
+	// Conditions on step outputs can only be evaluated when the pipeline
+	// runs, so the dependencies of such pipelines are always included, as
+	// are those of pipelines whose conditions were left unresolved.
+	if pipeline.If != "" && !strings.Contains(pipeline.If, "${{") {
 		if result, err := cond.Evaluate(pipeline.If); err != nil {
 			return fmt.Errorf("evaluating conditional %q: %w", pipeline.If, err)
 		} else if !result {
@@ -16,7 +16,10 @@ package build
 
 import (
 	"context"
+	"os"
+	"path/filepath"
 	"slices"
+	"strings"
 	"testing"
 
 	apko_types "chainguard.dev/apko/pkg/build/types"
@@ -115,3 +118,210 @@ func TestCompileTest(t *testing.T) {
 		t.Errorf("subpackage test packages: want %v, got %v", want, got)
 	}
 }
+
+func TestCompileDefersStepOutputs(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "say.yaml"), []byte(`
+inputs:
+  message:
+    required: true
+pipeline:
+  - runs: echo ${{inputs.message}}
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	build := &Build{
+		PipelineDirs: []string{dir},
+		Configuration: config.Configuration{
+			Package: config.Package{Name: "foo", Version: "1.0.0"},
+			Pipeline: []config.Pipeline{{
+				Name: "detect",
+				Runs: "echo version=1.2.3 >> $MELANGE_OUTPUT",
+			}, {
+				Uses: "say",
+				With: map[string]string{"message": "${{package.name}} ${{steps.detect.outputs.version}}"},
+				If:   "${{steps.detect.outputs.version}} != ''",
+			}},
+		},
+	}
+
+	if err := build.Compile(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	say := build.Configuration.Pipeline[1]
+	if got, want := say.If, "${{steps.detect.outputs.version}} != ''"; want != got {
+		t.Fatalf("if: want %q, got %q", want, got)
+	}
+	if got, want := say.Pipeline[0].Runs, "echo foo ${{steps.detect.outputs.version}}"; want != got {
+		t.Fatalf("runs: want %q, got %q", want, got)
+	}
+}
+
+func TestCompileChecksInputs(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name    string
+		with    string
+		wantErr string
+	}{{
+		name: "valid",
+		with: "strip-components: 0",
+	}, {
+		name: "substituted",
+		with: "strip-components: ${{vars.strip}}",
+	}, {
+		name:    "not an int",
+		with:    "strip-components: one",
+		wantErr: `line 10, column 25: invalid value for input "strip-components": expected an integer, got "one"`,
+	}, {
+		name:    "not a bool",
+		with:    "extract: yes",
+		wantErr: `line 10, column 16: invalid value for input "extract": expected true or false, got "yes"`,
+	}, {
+		name:    "not a checksum",
+		with:    "expected-sha256: deadbeef",
+		wantErr: `input "expected-sha256"`,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			fp := filepath.Join(t.TempDir(), "melange.yaml")
+			if err := os.WriteFile(fp, []byte(`
+package:
+  name: foo
+  version: 1.0.0
+
+pipeline:
+  - uses: fetch
+    with:
+      uri: https://example.com/foo-${{package.version}}.tar.gz
+      `+tc.with+`
+
+vars:
+  strip: 1
+`), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := config.ParseConfiguration(ctx, fp)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			build := &Build{Configuration: *cfg}
+			err = build.Compile(ctx)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("want error containing %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestCompileUnresolved(t *testing.T) {
+	ctx := context.Background()
+
+	fp := filepath.Join(t.TempDir(), "melange.yaml")
+	if err := os.WriteFile(fp, []byte(`
+package:
+  name: foo
+  version: 1.0.0
+
+pipeline:
+  - uses: fetch
+    with:
+      uri: https://example.com/foo-${{vars.mangled-verison}}.tar.gz
+  - name: install
+    runs: |
+      cd ${{vars.srcdir}}
+      make DESTDIR=${{targets.destdir}}
+
+vars:
+  mangled-version: 1_0_0
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := config.ParseConfiguration(ctx, fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	build := &Build{Configuration: *cfg}
+	err = build.Compile(ctx)
+	if err == nil {
+		t.Fatal("expected unresolved references to fail compilation")
+	}
+	for _, want := range []string{
+		"2 unresolved variable references",
+		"line 9, column 36: variable ${{vars.mangled-verison}} in with.uri of pipeline",
+		`line 12, column 10: variable ${{vars.srcdir}} in runs of pipeline "install" is not defined`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("want error containing %q, got %v", want, err)
+		}
+	}
+
+	cfg, err = config.ParseConfiguration(ctx, fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	build = &Build{Configuration: *cfg, AllowUnresolved: true}
+	if err := build.Compile(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := build.Configuration.Pipeline[1].Runs, "cd ${{vars.srcdir}}\nmake DESTDIR=/home/build/melange-out/foo\n"; got != want {
+		t.Errorf("want runs %q, got %q", want, got)
+	}
+}
+
+func TestCompileTestUnresolved(t *testing.T) {
+	ctx := context.Background()
+
+	fp := filepath.Join(t.TempDir(), "melange.yaml")
+	if err := os.WriteFile(fp, []byte(`
+package:
+  name: foo
+  version: 1.0.0
+
+test:
+  pipeline:
+    - runs: foo --version | grep ${{vars.foo-version}}
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := config.ParseConfiguration(ctx, fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	test := &Test{Package: "foo", Configuration: *cfg}
+	err = test.Compile(ctx)
+	if err == nil {
+		t.Fatal("expected unresolved references to fail compilation")
+	}
+	if want := "variable ${{vars.foo-version}} in runs of pipeline"; !strings.Contains(err.Error(), want) {
+		t.Errorf("want error containing %q, got %v", want, err)
+	}
+
+	cfg, err = config.ParseConfiguration(ctx, fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	test = &Test{Package: "foo", Configuration: *cfg, AllowUnresolved: true}
+	if err := test.Compile(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := test.Configuration.Test.Pipeline[0].Runs, "foo --version | grep ${{vars.foo-version}}"; got != want {
+		t.Errorf("want runs %q, got %q", want, got)
+	}
+}
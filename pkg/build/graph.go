@@ -0,0 +1,211 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+// dependencyName strips any version constraint from an apk dependency or
+// provides string, e.g. "foo>=1.2" becomes "foo" and "so:libfoo.so.1=1"
+// becomes "so:libfoo.so.1".  Conflicts ("!foo") return an empty string.
+func dependencyName(dep string) string {
+	if strings.HasPrefix(dep, "!") {
+		return ""
+	}
+
+	if i := strings.IndexAny(dep, "=<>~"); i >= 0 {
+		return dep[:i]
+	}
+
+	return dep
+}
+
+// clonePipelines returns a deep copy of the given pipelines so they can be
+// compiled without mutating the originals.
+func clonePipelines(pipelines []config.Pipeline) []config.Pipeline {
+	if pipelines == nil {
+		return nil
+	}
+
+	out := make([]config.Pipeline, len(pipelines))
+	for i, p := range pipelines {
+		p.With = maps.Clone(p.With)
+		p.Inputs = maps.Clone(p.Inputs)
+		p.Environment = maps.Clone(p.Environment)
+		if p.Needs != nil {
+			p.Needs = &config.Needs{Packages: slices.Clone(p.Needs.Packages)}
+		}
+		p.Pipeline = clonePipelines(p.Pipeline)
+		out[i] = p
+	}
+
+	return out
+}
+
+// Provided returns the names this build makes available to other builds:
+// the package and subpackage names as well as anything they provide.
+func (b *Build) Provided() []string {
+	cfg := b.Configuration
+
+	provided := []string{cfg.Package.Name}
+	for _, prov := range cfg.Package.Dependencies.Provides {
+		provided = append(provided, dependencyName(prov))
+	}
+
+	for _, sp := range cfg.Subpackages {
+		provided = append(provided, sp.Name)
+		for _, prov := range sp.Dependencies.Provides {
+			provided = append(provided, dependencyName(prov))
+		}
+	}
+
+	return provided
+}
+
+// Required returns the names this build needs from other builds: the runtime
+// dependencies of the package and its subpackages, the packages of the build
+// environment and the packages needed by the (compiled) pipelines.
+func (b *Build) Required(ctx context.Context) ([]string, error) {
+	cfg := b.Configuration
+
+	sm, err := NewSubstitutionMap(&cfg, b.Arch, b.BuildFlavor(), b.EnabledBuildOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	// Compile copies of the pipelines; BuildPackage compiles the real ones later.
+	c := &Compiled{
+		PipelineDirs: b.PipelineDirs,
+	}
+
+	if err := c.CompilePipelines(ctx, sm, clonePipelines(cfg.Pipeline)); err != nil {
+		return nil, fmt.Errorf("compiling main pipelines: %w", err)
+	}
+
+	for _, sp := range cfg.Subpackages {
+		sm := sm.Subpackage(&sp)
+		if err := c.CompilePipelines(ctx, sm, clonePipelines(sp.Pipeline)); err != nil {
+			return nil, fmt.Errorf("compiling subpackage %q: %w", sp.Name, err)
+		}
+	}
+
+	required := slices.Clone(cfg.Environment.Contents.Packages)
+	required = append(required, c.Needs...)
+	required = append(required, cfg.Package.Dependencies.Runtime...)
+	for _, sp := range cfg.Subpackages {
+		required = append(required, sp.Dependencies.Runtime...)
+	}
+
+	names := make([]string, 0, len(required))
+	for _, dep := range required {
+		if name := dependencyName(dep); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+// Layers sorts the given builds topologically, returning them grouped into
+// layers.  Every build only depends on builds in earlier layers, so the builds
+// within a single layer can run concurrently.  Builds are only considered
+// dependent on builds for the same architecture.  Within a layer, builds keep
+// the order in which they were passed in.
+func Layers(ctx context.Context, builds []*Build) ([][]*Build, error) {
+	// providers maps arch -> name -> indices of the builds providing name.
+	providers := map[string]map[string][]int{}
+	for i, b := range builds {
+		arch := b.Arch.ToAPK()
+		if providers[arch] == nil {
+			providers[arch] = map[string][]int{}
+		}
+		for _, name := range b.Provided() {
+			if !slices.Contains(providers[arch][name], i) {
+				providers[arch][name] = append(providers[arch][name], i)
+			}
+		}
+	}
+
+	// deps[i] holds the indices of the builds that build i depends on.
+	deps := make([]map[int]struct{}, len(builds))
+	for i, b := range builds {
+		required, err := b.Required(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("computing dependencies of %s: %w", b.Configuration.Name(), err)
+		}
+
+		deps[i] = map[int]struct{}{}
+		for _, name := range required {
+			for _, j := range providers[b.Arch.ToAPK()][name] {
+				// Packages commonly bootstrap from an earlier build of themselves.
+				if j != i {
+					deps[i][j] = struct{}{}
+				}
+			}
+		}
+	}
+
+	done := make([]bool, len(builds))
+	remaining := len(builds)
+	layers := [][]*Build{}
+
+	for remaining > 0 {
+		layer := []int{}
+		for i := range builds {
+			if done[i] {
+				continue
+			}
+
+			ready := true
+			for j := range deps[i] {
+				if !done[j] {
+					ready = false
+					break
+				}
+			}
+
+			if ready {
+				layer = append(layer, i)
+			}
+		}
+
+		if len(layer) == 0 {
+			cycle := []string{}
+			for i, b := range builds {
+				if !done[i] {
+					cycle = append(cycle, fmt.Sprintf("%s (%s)", b.Configuration.Name(), b.Arch.ToAPK()))
+				}
+			}
+			return nil, fmt.Errorf("dependency cycle detected between: %s", strings.Join(cycle, ", "))
+		}
+
+		bs := make([]*Build, 0, len(layer))
+		for _, i := range layer {
+			done[i] = true
+			bs = append(bs, builds[i])
+		}
+		remaining -= len(layer)
+		layers = append(layers, bs)
+	}
+
+	return layers, nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+func TestDependencyName(t *testing.T) {
+	for dep, want := range map[string]string{
+		"foo":                "foo",
+		"foo>=1.2":           "foo",
+		"foo~1.2":            "foo",
+		"so:libfoo.so.1=1.2": "so:libfoo.so.1",
+		"!foo":               "",
+	} {
+		if got := dependencyName(dep); got != want {
+			t.Errorf("dependencyName(%q): want %q, got %q", dep, want, got)
+		}
+	}
+}
+
+func TestLayers(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	arch := apko_types.ParseArchitecture("x86_64")
+
+	newBuild := func(cfg config.Configuration) *Build {
+		return &Build{Configuration: cfg, Arch: arch}
+	}
+
+	lib := newBuild(config.Configuration{
+		Package: config.Package{
+			Name: "libfoo",
+			Dependencies: config.Dependencies{
+				Provides: []string{"so:libfoo.so.1=1"},
+			},
+		},
+		Subpackages: []config.Subpackage{{Name: "libfoo-dev"}},
+	})
+	tool := newBuild(config.Configuration{
+		Package: config.Package{Name: "tool"},
+		// Depending on yourself must not create a cycle.
+		Environment: apko_types.ImageConfiguration{
+			Contents: apko_types.ImageContents{Packages: []string{"tool"}},
+		},
+	})
+	app := newBuild(config.Configuration{
+		Package: config.Package{
+			Name: "app",
+			Dependencies: config.Dependencies{
+				Runtime: []string{"so:libfoo.so.1"},
+			},
+		},
+		Pipeline: []config.Pipeline{{
+			Needs: &config.Needs{Packages: []string{"libfoo-dev"}},
+		}},
+	})
+	plugin := newBuild(config.Configuration{
+		Package: config.Package{Name: "plugin"},
+		Environment: apko_types.ImageConfiguration{
+			Contents: apko_types.ImageContents{Packages: []string{"app>=1.0", "tool"}},
+		},
+	})
+
+	layers, err := Layers(ctx, []*Build{plugin, app, tool, lib})
+	require.NoError(t, err)
+	require.Equal(t, [][]*Build{{tool, lib}, {app}, {plugin}}, layers)
+
+	// Pipelines are compiled on copies.
+	require.NotNil(t, app.Configuration.Pipeline[0].Needs)
+}
+
+func TestLayersCycle(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	arch := apko_types.ParseArchitecture("x86_64")
+
+	a := &Build{Arch: arch, Configuration: config.Configuration{
+		Package: config.Package{Name: "a", Dependencies: config.Dependencies{Runtime: []string{"b"}}},
+	}}
+	b := &Build{Arch: arch, Configuration: config.Configuration{
+		Package: config.Package{Name: "b", Dependencies: config.Dependencies{Runtime: []string{"a"}}},
+	}}
+
+	_, err := Layers(ctx, []*Build{a, b})
+	require.ErrorContains(t, err, "dependency cycle")
+}
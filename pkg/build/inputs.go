@@ -0,0 +1,316 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1" //nolint:gosec // apk control section checksums are sha1
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"chainguard.dev/apko/pkg/apk/apk"
+	"chainguard.dev/apko/pkg/apk/expandapk"
+	apkofs "chainguard.dev/apko/pkg/apk/fs"
+	apko_build "chainguard.dev/apko/pkg/build"
+	"github.com/chainguard-dev/clog"
+	purl "github.com/package-url/packageurl-go"
+	"go.opentelemetry.io/otel"
+	"sigs.k8s.io/release-utils/version"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/index"
+	"chainguard.dev/melange/pkg/pkginfo"
+)
+
+// buildInputs is everything that determines the output of a build.  It is
+// serialized to JSON and hashed to produce the input hash.
+type buildInputs struct {
+	MelangeVersion  string               `json:"melangeVersion"`
+	Arch            string               `json:"arch"`
+	SourceDateEpoch int64                `json:"sourceDateEpoch"`
+	Configuration   config.Configuration `json:"configuration"`
+	ExternalRefs    []purl.PackageURL    `json:"externalRefs,omitempty"`
+	ExtraPackages   []string             `json:"extraPackages,omitempty"`
+	Environment     []string             `json:"environment,omitempty"`
+	Sources         map[string]string    `json:"sources,omitempty"`
+}
+
+// ComputeInputHash computes a digest of the inputs of the build: the compiled
+// configuration (with all pipelines loaded and substituted), the resolved
+// build environment, fetched sources and git commits, the contents of the
+// source directory and the version of melange.  It must be called after
+// Compile.
+func (b *Build) ComputeInputHash(ctx context.Context) (string, error) {
+	ctx, span := otel.Tracer("melange").Start(ctx, "ComputeInputHash")
+	defer span.End()
+
+	cfg := b.Configuration
+
+	// The commit of the configuration repository changes with every unrelated
+	// commit, and the configuration itself is already part of the hash.
+	cfg.Package.Commit = ""
+	cfg.Subpackages = slices.Clone(cfg.Subpackages)
+	for i := range cfg.Subpackages {
+		cfg.Subpackages[i].Commit = ""
+	}
+
+	inputs := buildInputs{
+		MelangeVersion:  version.GetVersionInfo().GitVersion,
+		Arch:            b.Arch.ToAPK(),
+		SourceDateEpoch: b.SourceDateEpoch.Unix(),
+		Configuration:   cfg,
+		ExternalRefs:    b.externalRefs,
+		ExtraPackages:   b.ExtraPackages,
+	}
+
+	if !b.IsBuildLess() {
+		env, err := b.resolveEnvironment(ctx)
+		if err != nil {
+			return "", fmt.Errorf("resolving build environment: %w", err)
+		}
+		inputs.Environment = env
+		b.resolvedEnvironment = env
+	}
+
+	if !b.EmptyWorkspace {
+		sources, err := b.hashSources(ctx)
+		if err != nil {
+			return "", fmt.Errorf("hashing sources in %s: %w", b.SourceDir, err)
+		}
+		inputs.Sources = sources
+		b.sourceDigests = sources
+	}
+
+	data, err := json.Marshal(inputs)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256(data)), nil
+}
+
+// needsInputHash reports whether the build uses the input hash, or the build
+// environment and sources ComputeInputHash resolves.  Resolving the build
+// environment is costly, so it is skipped for builds that do not.
+func (b *Build) needsInputHash() bool {
+	if b.SkipIfUnchanged || b.ResumeFrom != "" {
+		return true
+	}
+	return (b.StepCacheDir != "" || b.KeepWorkspace) && b.Runner != nil && bindsWorkspace(b.Runner.Name())
+}
+
+// resolveEnvironment resolves the packages of the build environment without
+// installing them, returning each as name=version:checksum.
+func (b *Build) resolveEnvironment(ctx context.Context) ([]string, error) {
+	tmp, err := os.MkdirTemp(os.TempDir(), "apko-temp-*")
+	if err != nil {
+		return nil, fmt.Errorf("creating apko tempdir: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	opts := []apko_build.Option{
+		apko_build.WithImageConfiguration(b.Configuration.Environment),
+		apko_build.WithArch(b.Arch),
+		apko_build.WithExtraKeys(b.ExtraKeys),
+		apko_build.WithExtraBuildRepos(b.ExtraRepos),
+		apko_build.WithExtraPackages(b.ExtraPackages),
+		apko_build.WithCacheDir(b.ApkCacheDir, false),
+		apko_build.WithTempDir(tmp),
+	}
+	for domain, auth := range b.Auth {
+		opts = append(opts, apko_build.WithAuth(domain, auth.User, auth.Pass))
+	}
+
+	bc, err := apko_build.New(ctx, apkofs.NewMemFS(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create build context: %w", err)
+	}
+
+	pkgs, _, err := bc.BuildPackageList(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	env := make([]string, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		env = append(env, fmt.Sprintf("%s=%s:%s", pkg.Name, pkg.Version, pkg.ChecksumString()))
+	}
+	slices.Sort(env)
+
+	return env, nil
+}
+
+// hashSources returns the sha256 of every file that PopulateWorkspace would
+// copy into the workspace, keyed by its path relative to the source directory.
+func (b *Build) hashSources(ctx context.Context) (map[string]string, error) {
+	ignorePatterns, err := b.loadIgnoreRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := map[string]string{}
+	src := os.DirFS(b.SourceDir)
+
+	if err := fs.WalkDir(src, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		for _, pat := range ignorePatterns {
+			if pat.Match(path) {
+				return nil
+			}
+		}
+
+		f, err := src.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		sources[path] = hex.EncodeToString(h.Sum(nil))
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return sources, nil
+}
+
+// readInputHash reads the input hash recorded in the .PKGINFO of the given
+// apk.  It also returns the checksum of the control section, which is what
+// the APKINDEX records for the package.
+func readInputHash(r io.Reader) (inputHash string, checksum []byte, err error) {
+	split, err := expandapk.Split(r)
+	if err != nil {
+		return "", nil, fmt.Errorf("splitting apk: %w", err)
+	}
+	control := split[0]
+	if len(split) == 3 {
+		// signature section is present
+		control = split[1]
+	}
+
+	b, err := io.ReadAll(control)
+	if err != nil {
+		return "", nil, err
+	}
+
+	h := sha1.Sum(b) //nolint:gosec // apk control section checksums are sha1
+
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return "", nil, err
+	}
+
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			return "", nil, fmt.Errorf("did not see .PKGINFO in APK: %w", err)
+		}
+
+		if hdr.Name != ".PKGINFO" {
+			continue
+		}
+
+		info, err := pkginfo.Parse(tr)
+		if err != nil {
+			return "", nil, err
+		}
+
+		return info.Get("inputhash"), h[:], nil
+	}
+}
+
+// unchanged reports whether the APKINDEX in the output directory already
+// lists the package and all of its subpackages at the version being built,
+// and all of them were built from inputs with the given hash.
+func (b *Build) unchanged(ctx context.Context, inputHash string) (bool, error) {
+	log := clog.FromContext(ctx)
+
+	packageDir := filepath.Join(b.OutDir, b.Arch.ToAPK())
+
+	idx, err := index.New()
+	if err != nil {
+		return false, err
+	}
+	if err := idx.LoadIndex(ctx, filepath.Join(packageDir, "APKINDEX.tar.gz")); err != nil {
+		return false, err
+	}
+
+	pkgver := fmt.Sprintf("%s-r%d", b.Configuration.Package.Version, b.Configuration.Package.Epoch)
+
+	names := []string{b.Configuration.Package.Name}
+	for _, sp := range b.Configuration.Subpackages {
+		names = append(names, sp.Name)
+	}
+
+	for _, name := range names {
+		i := slices.IndexFunc(idx.Index.Packages, func(p *apk.Package) bool {
+			return p.Name == name && p.Version == pkgver
+		})
+		if i < 0 {
+			log.Infof("%s-%s is not in the index", name, pkgver)
+			return false, nil
+		}
+
+		f, err := os.Open(filepath.Join(packageDir, idx.Index.Packages[i].Filename()))
+		if errors.Is(err, os.ErrNotExist) {
+			log.Infof("%s-%s is in the index but missing from %s", name, pkgver, packageDir)
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+
+		got, checksum, err := readInputHash(f)
+		f.Close()
+		if err != nil {
+			return false, fmt.Errorf("reading %s: %w", f.Name(), err)
+		}
+
+		if !bytes.Equal(checksum, idx.Index.Packages[i].Checksum) {
+			log.Infof("%s does not match its index entry", f.Name())
+			return false, nil
+		}
+
+		if got != inputHash {
+			log.Infof("inputs of %s-%s changed", name, pkgver)
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+func TestComputeInputHash(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	src := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		path := filepath.Join(src, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+	write(".melangeignore", "ignored/*\n")
+	write("patches/fix.patch", "fix")
+
+	// A build-less package avoids resolving the build environment.
+	b := &Build{
+		Configuration: config.Configuration{
+			Package: config.Package{Name: "hello", Version: "1.0.0", Commit: "aaaa"},
+		},
+		SourceDir:       src,
+		WorkspaceIgnore: ".melangeignore",
+	}
+
+	hash := func() string {
+		t.Helper()
+		h, err := b.ComputeInputHash(ctx)
+		require.NoError(t, err)
+		return h
+	}
+
+	orig := hash()
+	require.Equal(t, orig, hash(), "hash is not stable")
+
+	// The commit of the configuration repository is not an input.
+	b.Configuration.Package.Commit = "bbbb"
+	require.Equal(t, orig, hash())
+
+	// Neither are ignored files.
+	write("ignored/notes.txt", "notes")
+	require.Equal(t, orig, hash())
+
+	write("patches/fix.patch", "another fix")
+	changed := hash()
+	require.NotEqual(t, orig, changed)
+
+	b.Configuration.Package.Epoch = 1
+	require.NotEqual(t, changed, hash())
+}
+
+func TestNeedsInputHash(t *testing.T) {
+	require.False(t, (&Build{}).needsInputHash())
+	require.True(t, (&Build{SkipIfUnchanged: true}).needsInputHash())
+	require.True(t, (&Build{ResumeFrom: "configure"}).needsInputHash())
+	// Without a runner binding the workspace, there is no step cache.
+	require.False(t, (&Build{StepCacheDir: t.TempDir()}).needsInputHash())
+}
@@ -21,7 +21,9 @@ import (
 
 	apko_types "chainguard.dev/apko/pkg/build/types"
 	"chainguard.dev/apko/pkg/options"
+	"chainguard.dev/melange/pkg/config"
 	"chainguard.dev/melange/pkg/container"
+	"github.com/dustin/go-humanize"
 )
 
 type Option func(*Build) error
@@ -115,6 +117,18 @@ func WithPipelineDir(pipelineDir string) Option {
 	}
 }
 
+// WithIncludeDir adds a directory in which to look for the files included by
+// the configuration that are not found relative to it. These are searched in
+// order, so the first one found is used.
+func WithIncludeDir(includeDir string) Option {
+	return func(b *Build) error {
+		if includeDir != "" {
+			b.IncludeDirs = append(b.IncludeDirs, includeDir)
+		}
+		return nil
+	}
+}
+
 // WithSourceDir sets the source directory to use.
 func WithSourceDir(sourceDir string) Option {
 	return func(b *Build) error {
@@ -178,6 +192,15 @@ func WithArch(arch apko_types.Architecture) Option {
 	}
 }
 
+// WithVariant sets the variant of the variants matrix of the configuration to
+// build.  By default, the first variant is built.
+func WithVariant(variant config.Variant) Option {
+	return func(b *Build) error {
+		b.Variant = variant
+		return nil
+	}
+}
+
 // WithExtraKeys adds a set of extra keys to the build context.
 func WithExtraKeys(extraKeys []string) Option {
 	return func(b *Build) error {
@@ -264,6 +287,83 @@ func WithEnabledBuildOptions(enabledBuildOptions []string) Option {
 	}
 }
 
+// WithAllowUnresolved indicates whether references to variables that are not
+// defined are allowed.  They are reported as warnings and left in place.
+func WithAllowUnresolved(allowUnresolved bool) Option {
+	return func(b *Build) error {
+		b.AllowUnresolved = allowUnresolved
+		return nil
+	}
+}
+
+// WithStrict indicates whether the configuration must conform to its schema.
+// If not, the problems are reported as warnings.
+func WithStrict(strict bool) Option {
+	return func(b *Build) error {
+		b.Strict = strict
+		return nil
+	}
+}
+
+// WithSkipIfUnchanged indicates whether to skip the build when the APKINDEX in
+// the output directory already lists packages built from the same inputs.
+func WithSkipIfUnchanged(skipIfUnchanged bool) Option {
+	return func(b *Build) error {
+		b.SkipIfUnchanged = skipIfUnchanged
+		return nil
+	}
+}
+
+// WithVerifyReproducible indicates whether to build the package a second time
+// and fail the build if the resulting packages differ.
+func WithVerifyReproducible(verifyReproducible bool) Option {
+	return func(b *Build) error {
+		b.VerifyReproducible = verifyReproducible
+		return nil
+	}
+}
+
+// WithStepCacheDir sets the directory in which workspace snapshots are cached
+// after each step of the main pipeline.  An empty directory disables the step
+// cache.
+func WithStepCacheDir(stepCacheDir string) Option {
+	return func(b *Build) error {
+		b.StepCacheDir = stepCacheDir
+		return nil
+	}
+}
+
+// WithStepCacheSize sets the size, e.g. "10GB", above which the least recently
+// used snapshots are evicted from the step cache.
+func WithStepCacheSize(size string) Option {
+	return func(b *Build) error {
+		n, err := humanize.ParseBytes(size)
+		if err != nil {
+			return fmt.Errorf("parsing step cache size %q: %w", size, err)
+		}
+		b.StepCacheSize = int64(n)
+		return nil
+	}
+}
+
+// WithKeepWorkspace indicates whether to keep the workspace and guest
+// directory of a failed build, along with the state needed to resume it.
+func WithKeepWorkspace(keepWorkspace bool) Option {
+	return func(b *Build) error {
+		b.KeepWorkspace = keepWorkspace
+		return nil
+	}
+}
+
+// WithResumeFrom sets the name of the main pipeline step from which to resume
+// a failed build kept with WithKeepWorkspace.
+func WithResumeFrom(step string) Option {
+	return func(b *Build) error {
+		b.ResumeFrom = step
+		return nil
+	}
+}
+
 // WithCreateBuildLog indicates whether to generate a package.log file containing the
 // list of packages that were built.  Some packages may have been skipped
 // during the build if , so it can be hard to know exactly which packages were built
@@ -0,0 +1,245 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/container"
+	"chainguard.dev/melange/pkg/util"
+)
+
+// Steps write their outputs as key=value lines to the file named by
+// $MELANGE_OUTPUT, below outputsDir in the workspace.
+const (
+	outputsEnv = "MELANGE_OUTPUT"
+	outputsDir = ".melange-outputs"
+)
+
+var (
+	// stepOutputRef matches ${{steps.<name>.outputs.<key>}}, with any filters.
+	stepOutputRef = regexp.MustCompile(`\$\{\{\s*(steps\.[a-zA-Z0-9.\-_]+\.outputs\.[a-zA-Z0-9\-_]+)\s*(?:\|[^}]*)?\}\}`)
+
+	outputKey = regexp.MustCompile(`^[a-zA-Z0-9\-_]+$`)
+)
+
+// hasStepOutputs reports whether s refers to the outputs of a step.
+func hasStepOutputs(s string) bool {
+	return stepOutputRef.MatchString(s)
+}
+
+// deferStepOutputs makes the substitution map leave references to step
+// outputs in the pipeline, and the with parameters passed to it, in place.
+// Their values are only known at run time, when they are substituted by the
+// pipelineRunner.
+func (sm *SubstitutionMap) deferStepOutputs(pipeline *config.Pipeline, with map[string]string) {
+	refs := []string{pipeline.Runs, pipeline.If, pipeline.WorkDir}
+	for _, v := range with {
+		refs = append(refs, v)
+	}
+	for _, v := range pipeline.With {
+		refs = append(refs, v)
+	}
+
+	for _, ref := range refs {
+		for _, m := range stepOutputRef.FindAllStringSubmatch(ref, -1) {
+			// Values looked up by bare key are never quoted, so the reference
+			// survives MutateAndQuoteStringFromMap unchanged.
+			sm.Substitutions[m[1]] = fmt.Sprintf("${{%s}}", m[1])
+		}
+	}
+
+	for i := range pipeline.Pipeline {
+		sm.deferStepOutputs(&pipeline.Pipeline[i], nil)
+	}
+}
+
+// collectsOutputs reports whether the outputs of steps can be read on the
+// host, which takes a runner that bind-mounts the workspace.
+func (r *pipelineRunner) collectsOutputs() bool {
+	return r.config.WorkspaceDir != "" && r.runner != nil && bindsWorkspace(r.runner.Name())
+}
+
+// outputsFile returns the path of the outputs file of a step in the guest and
+// on the host.  Only named steps have outputs, and only when the runner
+// collects them.
+func (r *pipelineRunner) outputsFile(pipeline *config.Pipeline) (guest, host string) {
+	if pipeline.Name == "" || !r.collectsOutputs() {
+		return "/dev/null", ""
+	}
+
+	name := strings.ReplaceAll(pipeline.Name, "/", "_")
+	return path.Join(container.DefaultWorkspaceDir, outputsDir, name),
+		filepath.Join(r.config.WorkspaceDir, outputsDir, name)
+}
+
+// prepareStep returns a copy of the pipeline with the outputs of earlier steps
+// substituted into its if condition.  It fails if the pipeline uses outputs
+// the runner does not collect.  The rest of the pipeline is substituted
+// by prepareRun, once the condition has been evaluated.
+func (r *pipelineRunner) prepareStep(pipeline *config.Pipeline) (*config.Pipeline, error) {
+	p := *pipeline
+
+	if !r.collectsOutputs() && (hasStepOutputs(p.If) || hasStepOutputs(p.Runs) || hasStepOutputs(p.WorkDir)) {
+		return nil, fmt.Errorf("step %q uses the outputs of other steps, which the %s runner cannot collect because it does not bind-mount the workspace", identity(pipeline), r.runner.Name())
+	}
+
+	if hasStepOutputs(p.If) {
+		var err error
+		if p.If, err = util.MutateAndQuoteStringFromMap(r.outputs, p.If); err != nil {
+			return nil, fmt.Errorf("substituting step outputs in if: %w", err)
+		}
+	}
+
+	return &p, nil
+}
+
+// prepareRun substitutes the outputs of earlier steps into the command and
+// working directory of the pipeline, points $MELANGE_OUTPUT at its outputs
+// file and clears any outputs left by an earlier run.
+func (r *pipelineRunner) prepareRun(p *config.Pipeline) error {
+	var err error
+	if hasStepOutputs(p.Runs) {
+		if p.Runs, err = util.MutateStringFromMap(r.outputs, p.Runs); err != nil {
+			return fmt.Errorf("substituting step outputs in runs: %w", err)
+		}
+	}
+	if hasStepOutputs(p.WorkDir) {
+		if p.WorkDir, err = util.MutateStringFromMap(r.outputs, p.WorkDir); err != nil {
+			return fmt.Errorf("substituting step outputs in working-directory: %w", err)
+		}
+	}
+
+	guest, host := r.outputsFile(p)
+	p.Environment = maps.Clone(p.Environment)
+	if p.Environment == nil {
+		p.Environment = map[string]string{}
+	}
+	p.Environment[outputsEnv] = guest
+
+	if host != "" {
+		if err := os.MkdirAll(filepath.Dir(host), 0o755); err != nil {
+			return err
+		}
+		if err := os.Remove(host); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readOutputs reads the outputs written by a step, making them available to
+// later steps.
+func (r *pipelineRunner) readOutputs(pipeline *config.Pipeline) error {
+	_, host := r.outputsFile(pipeline)
+	if host == "" {
+		return nil
+	}
+
+	f, err := os.Open(host)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	outputs, err := parseOutputs(f)
+	if err != nil {
+		return fmt.Errorf("reading outputs of step %q: %w", pipeline.Name, err)
+	}
+
+	if r.outputs == nil {
+		r.outputs = map[string]string{}
+	}
+	for k, v := range outputs {
+		r.outputs[fmt.Sprintf("${{steps.%s.outputs.%s}}", pipeline.Name, k)] = v
+	}
+
+	return nil
+}
+
+// loadOutputs reads the outputs of a step, and of its nested steps, that was
+// not run by this runner because its results were restored into the
+// workspace.
+func (r *pipelineRunner) loadOutputs(pipeline *config.Pipeline) error {
+	if err := r.readOutputs(pipeline); err != nil {
+		return err
+	}
+
+	for i := range pipeline.Pipeline {
+		if err := r.loadOutputs(&pipeline.Pipeline[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseOutputs parses key=value lines.  Multi-line values are written as
+// key<<DELIMITER, followed by the value and a line holding only DELIMITER.
+func parseOutputs(r io.Reader) (map[string]string, error) {
+	outputs := map[string]string{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		if k, delim, ok := strings.Cut(line, "<<"); ok && !strings.Contains(k, "=") {
+			lines := []string{}
+			closed := false
+			for scanner.Scan() {
+				if scanner.Text() == delim {
+					closed = true
+					break
+				}
+				lines = append(lines, scanner.Text())
+			}
+			if !closed {
+				return nil, fmt.Errorf("output %q is missing its closing delimiter %q", k, delim)
+			}
+			if !outputKey.MatchString(k) {
+				return nil, fmt.Errorf("invalid output name %q", k)
+			}
+			outputs[k] = strings.Join(lines, "\n")
+			continue
+		}
+
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid output line %q, expected key=value", line)
+		}
+		if !outputKey.MatchString(k) {
+			return nil, fmt.Errorf("invalid output name %q", k)
+		}
+		outputs[k] = v
+	}
+
+	return outputs, scanner.Err()
+}
@@ -180,7 +180,13 @@ replaces_priority = {{ .Dependencies.ReplacesPriority }}
 {{- if .Scriptlets}}{{ if .Scriptlets.Trigger.Paths }}
 triggers = {{ range $item := .Scriptlets.Trigger.Paths }}{{ $item }} {{ end }}
 {{- end }}{{ end }}
+{{- range $opt := .Build.AppliedBuildOptions }}
+buildoption = {{ $opt }}
+{{- end }}
 datahash = {{.DataHash}}
+{{- if .Build.InputHash }}
+inputhash = {{ .Build.InputHash }}
+{{- end }}
 `
 
 func (pc *PackageBuild) GenerateControlData(w io.Writer) error {
@@ -20,6 +20,7 @@ import (
 	"time"
 
 	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/pkginfo"
 
 	"github.com/stretchr/testify/require"
 )
@@ -119,6 +120,35 @@ url = https://chainguard.dev
 commit = deadbeef
 builddate = 12345678
 datahash = baadf00d
+`,
+	}, {
+		name: "input hash",
+		pb: &PackageBuild{
+			Build: &Build{
+				SourceDateEpoch: time.Unix(0, 0),
+				InputHash:       "c0ffee",
+			},
+			Origin:        pkg,
+			PackageName:   "glibc",
+			Arch:          "aarch64",
+			InstalledSize: 666,
+			OriginName:    "bigbang",
+			Description:   "I'm a unit test",
+			URL:           "https://chainguard.dev",
+			Commit:        "deadbeef",
+			DataHash:      "baadf00d",
+		},
+		want: `# Generated by melange
+pkgname = glibc
+pkgver = 1.2.3-r4
+arch = aarch64
+size = 666
+origin = bigbang
+pkgdesc = I'm a unit test
+url = https://chainguard.dev
+commit = deadbeef
+datahash = baadf00d
+inputhash = c0ffee
 `,
 	}}
 
@@ -136,3 +166,22 @@ datahash = baadf00d
 		})
 	}
 }
+
+func TestGenerateControlData_buildOptions(t *testing.T) {
+	pb := &PackageBuild{
+		Build: &Build{
+			SourceDateEpoch:     time.Unix(0, 0),
+			AppliedBuildOptions: []string{"fips", "debug"},
+		},
+		Origin:      &config.Package{Name: "glibc", Version: "1.2.3", Epoch: 4},
+		PackageName: "glibc",
+		DataHash:    "baadf00d",
+	}
+
+	buf := bytes.NewBuffer(nil)
+	require.NoError(t, pb.GenerateControlData(buf))
+
+	info, err := pkginfo.Parse(buf)
+	require.NoError(t, err)
+	require.Equal(t, []string{"fips", "debug"}, info["buildoption"])
+}
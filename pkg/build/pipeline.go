@@ -17,16 +17,22 @@ package build
 import (
 	"context"
 	"embed"
+	"errors"
 	"fmt"
 	"maps"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/chainguard-dev/clog"
 	purl "github.com/package-url/packageurl-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 
 	apko_types "chainguard.dev/apko/pkg/build/types"
 	"chainguard.dev/melange/pkg/cond"
@@ -49,17 +55,44 @@ func (sm *SubstitutionMap) MutateWith(with map[string]string) (map[string]string
 	}
 
 	// do the actual mutations
+	undefined := undefinedWithError{}
 	for k, v := range nw {
 		nval, err := util.MutateStringFromMap(nw, v)
-		if err != nil {
+		var uerr *util.UndefinedError
+		if errors.As(err, &uerr) {
+			undefined[k] = uerr
+		} else if err != nil {
 			return nil, err
 		}
 		nw[k] = nval
 	}
 
+	if len(undefined) > 0 {
+		return nw, undefined
+	}
+
 	return nw, nil
 }
 
+// undefinedWithError reports the values of a mutated with map that refer to
+// variables that are not defined, by their key.  The map is mutated with
+// those variables left in place.
+type undefinedWithError map[string]*util.UndefinedError
+
+func (e undefinedWithError) Error() string {
+	keys := make([]string, 0, len(e))
+	for k := range e {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	msgs := make([]string, len(keys))
+	for i, k := range keys {
+		msgs[i] = fmt.Sprintf("%s: %v", k, e[k])
+	}
+	return strings.Join(msgs, "\n")
+}
+
 type SubstitutionMap struct {
 	Substitutions map[string]string
 }
@@ -79,7 +112,7 @@ func NewSubstitutionMap(cfg *config.Configuration, arch apko_types.Architecture,
 		config.SubstitutionPackageName:        pkg.Name,
 		config.SubstitutionPackageVersion:     pkg.Version,
 		config.SubstitutionPackageEpoch:       strconv.FormatUint(pkg.Epoch, 10),
-		config.SubstitutionPackageFullVersion: fmt.Sprintf("%s-r%s", config.SubstitutionPackageVersion, config.SubstitutionPackageEpoch),
+		config.SubstitutionPackageFullVersion: fmt.Sprintf("%s-r%d", pkg.Version, pkg.Epoch),
 		config.SubstitutionTargetsDestdir:     fmt.Sprintf("/home/build/melange-out/%s", pkg.Name),
 		config.SubstitutionTargetsContextdir:  fmt.Sprintf("/home/build/melange-out/%s", pkg.Name),
 	}
@@ -177,15 +210,37 @@ type pipelineRunner struct {
 	interactive bool
 	config      *container.Config
 	runner      container.Runner
+
+	// steps that failed with continue-on-error set
+	softFailures []SoftFailure
+
+	// outputs of the steps run so far, keyed by ${{steps.<name>.outputs.<key>}}
+	outputs map[string]string
+}
+
+// SoftFailure is a pipeline step that failed without failing the build,
+// because it is marked continue-on-error.
+type SoftFailure struct {
+	Step string
+	Err  error
 }
 
 func (r *pipelineRunner) runPipeline(ctx context.Context, pipeline *config.Pipeline) (bool, error) {
 	log := clog.FromContext(ctx)
 
+	pipeline, err := r.prepareStep(pipeline)
+	if err != nil {
+		return false, err
+	}
+
 	if result, err := shouldRun(pipeline.If); !result {
 		return result, err
 	}
 
+	if err := r.prepareRun(pipeline); err != nil {
+		return false, fmt.Errorf("preparing step %q: %w", identity(pipeline), err)
+	}
+
 	debugOption := ' '
 	if r.debug {
 		debugOption = 'x'
@@ -206,22 +261,82 @@ func (r *pipelineRunner) runPipeline(ctx context.Context, pipeline *config.Pipel
 		defer stop()
 	}
 
-	if id := identity(pipeline); id != "???" {
+	id := identity(pipeline)
+	if id != "???" {
 		log.Infof("running step %q", id)
 	}
 
+	ctx, span := otel.Tracer("melange").Start(ctx, "runPipeline")
+	defer span.End()
+	span.SetAttributes(attribute.String("step", id))
+
+	attempts := 1
+	if pipeline.Retry != nil {
+		attempts = pipeline.Retry.Attempts
+	}
+
 	command := buildEvalRunCommand(ctx, pipeline, debugOption, sysPath, workdir, pipeline.Runs, r.interactive)
+
+	for attempt := 1; ; attempt++ {
+		actx, cancel := ctx, context.CancelFunc(func() {})
+		if to := pipeline.Timeout; to > 0 {
+			actx, cancel = context.WithTimeoutCause(ctx, to,
+				fmt.Errorf("step %q exceeded its timeout of %s", id, to))
+		}
+
+		err := r.runAttempt(actx, pipeline, command, workdir, attempt == attempts)
+		if err != nil && ctx.Err() == nil && actx.Err() != nil {
+			err = context.Cause(actx)
+		}
+		cancel()
+
+		if err == nil || attempt >= attempts || !shouldRetry(ctx, pipeline.Retry, err) {
+			span.SetAttributes(attribute.Int("attempts", attempt))
+
+			if err != nil && pipeline.ContinueOnError && ctx.Err() == nil {
+				log.Warnf("step %q failed, continuing because it is marked continue-on-error: %v", id, err)
+				span.SetAttributes(attribute.Bool("soft-failure", true))
+				r.softFailures = append(r.softFailures, SoftFailure{Step: id, Err: err})
+				return true, nil
+			}
+
+			return err == nil, err
+		}
+
+		delay := retryDelay(pipeline.Retry, attempt)
+		log.Warnf("step %q failed on attempt %d of %d: %v", id, attempt, attempts, err)
+		log.Infof("retrying step %q in %s (attempt %d of %d)", id, delay, attempt+1, attempts)
+
+		select {
+		case <-ctx.Done():
+			return false, context.Cause(ctx)
+		case <-time.After(delay):
+		}
+	}
+}
+
+// runAttempt runs the command of a pipeline followed by its nested pipelines.
+// The interactive debugger is only offered on the last attempt, so that
+// earlier failures are retried without intervention.
+func (r *pipelineRunner) runAttempt(ctx context.Context, pipeline *config.Pipeline, command []string, workdir string, last bool) error {
 	if err := r.runner.Run(ctx, r.config, command...); err != nil {
+		if !last {
+			return err
+		}
 		if err := r.maybeDebug(ctx, pipeline.Runs, command, workdir, err); err != nil {
-			return false, err
+			return err
 		}
 	}
 
+	if err := r.readOutputs(pipeline); err != nil {
+		return err
+	}
+
 	steps := 0
 
 	for _, p := range pipeline.Pipeline {
 		if ran, err := r.runPipeline(ctx, &p); err != nil {
-			return false, fmt.Errorf("unable to run pipeline: %w", err)
+			return fmt.Errorf("unable to run pipeline: %w", err)
 		} else if ran {
 			steps++
 		}
@@ -229,11 +344,32 @@ func (r *pipelineRunner) runPipeline(ctx context.Context, pipeline *config.Pipel
 
 	if assert := pipeline.Assertions; assert != nil {
 		if want := assert.RequiredSteps; want != steps {
-			return false, fmt.Errorf("pipeline did not run the required %d steps, only %d", want, steps)
+			return fmt.Errorf("pipeline did not run the required %d steps, only %d", want, steps)
 		}
 	}
 
-	return true, nil
+	return nil
+}
+
+// shouldRetry reports whether a failed attempt at running a pipeline should be
+// retried under the given policy.
+func shouldRetry(ctx context.Context, retry *config.PipelineRetry, err error) bool {
+	if retry == nil || ctx.Err() != nil {
+		return false
+	}
+
+	if len(retry.ExitCodes) == 0 {
+		return true
+	}
+
+	code, ok := container.ExitCode(err)
+	return ok && slices.Contains(retry.ExitCodes, code)
+}
+
+// retryDelay returns how long to wait after the given failed attempt: the
+// backoff of the policy, doubled for each attempt after the first.
+func retryDelay(retry *config.PipelineRetry, attempt int) time.Duration {
+	return retry.Backoff << (attempt - 1)
 }
 
 func (r *pipelineRunner) maybeDebug(ctx context.Context, fragment string, cmd []string, workdir string, runErr error) error {
@@ -287,6 +423,53 @@ func (r *pipelineRunner) runPipelines(ctx context.Context, pipelines []config.Pi
 	return nil
 }
 
+// runMainPipeline runs the main pipeline of the build.  It resumes from the
+// step named by ResumeFrom, or goes through the step cache if one is
+// configured, and records the failing step in the workspace if it is kept.
+func (b *Build) runMainPipeline(ctx context.Context, pr *pipelineRunner) error {
+	log := clog.FromContext(ctx)
+
+	pipelines := b.Configuration.Pipeline
+
+	var err error
+	switch {
+	case b.ResumeFrom != "":
+		if !bindsWorkspace(b.Runner.Name()) {
+			return fmt.Errorf("resuming a build is not supported with the %s runner, which does not bind-mount the workspace", b.Runner.Name())
+		}
+		start, rerr := b.resumeIndex()
+		if rerr != nil {
+			return fmt.Errorf("unable to resume from step %q: %w", b.ResumeFrom, rerr)
+		}
+		log.Infof("resuming from step %q, skipping %d completed steps", b.ResumeFrom, start)
+		err = pr.runSteps(ctx, pipelines, start)
+
+	case b.StepCacheDir != "" && bindsWorkspace(b.Runner.Name()):
+		base, berr := b.stepCacheBase()
+		if berr != nil {
+			return fmt.Errorf("computing step cache key: %w", berr)
+		}
+		cache := &stepCache{dir: b.StepCacheDir, maxSize: b.StepCacheSize}
+		err = pr.runCachedPipelines(ctx, cache, base, pipelines)
+
+	default:
+		if b.StepCacheDir != "" {
+			log.Warnf("step cache is not supported with the %s runner, which does not bind-mount the workspace", b.Runner.Name())
+		}
+		err = pr.runSteps(ctx, pipelines, 0)
+	}
+
+	var failure *stepFailure
+	if b.KeepWorkspace && bindsWorkspace(b.Runner.Name()) && errors.As(err, &failure) {
+		b.workspaceKept = true
+		if serr := b.saveResumeState(ctx, failure.index); serr != nil {
+			log.Warnf("unable to save resume state: %v", serr)
+		}
+	}
+
+	return err
+}
+
 func shouldRun(ifs string) (bool, error) {
 	if ifs == "" {
 		return true, nil
@@ -16,11 +16,15 @@ package build
 
 import (
 	"context"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/container"
 	"chainguard.dev/melange/pkg/util"
 	"gopkg.in/yaml.v3"
 
@@ -106,6 +110,18 @@ func Test_MutateWith(t *testing.T) {
 	}
 }
 
+func Test_substitutionPackageFullVersion(t *testing.T) {
+	cfg := config.Configuration{
+		Package: config.Package{
+			Version: "1.2.3",
+			Epoch:   3,
+		},
+	}
+	sm, err := NewSubstitutionMap(&cfg, "", "", nil)
+	require.NoError(t, err)
+	require.Equal(t, "1.2.3-r3", sm.Substitutions[config.SubstitutionPackageFullVersion])
+}
+
 func Test_substitutionNeedPackages(t *testing.T) {
 	ctx := slogtest.TestContextWithLogger(t)
 	pkg := config.Package{
@@ -176,3 +192,227 @@ func TestAllPipelines(t *testing.T) {
 		})
 	}
 }
+
+// fakeRunner exits the commands it runs with the given exit codes in turn,
+// succeeding once they run out.
+type fakeRunner struct {
+	name  string
+	exits []int
+	runs  [][]string
+
+	// Commands whose script contains block run until they are cancelled.
+	block string
+
+	// hook is called with the script of each command before it exits.
+	hook func(script string)
+}
+
+func (f *fakeRunner) Close() error {
+	return nil
+}
+
+func (f *fakeRunner) Name() string {
+	if f.name != "" {
+		return f.name
+	}
+	return "fake"
+}
+
+func (f *fakeRunner) TestUsability(context.Context) bool {
+	return true
+}
+
+func (f *fakeRunner) OCIImageLoader() container.Loader {
+	return nil
+}
+
+func (f *fakeRunner) TempDir() string {
+	return ""
+}
+
+func (f *fakeRunner) StartPod(context.Context, *container.Config) error {
+	return nil
+}
+
+func (f *fakeRunner) TerminatePod(context.Context, *container.Config) error {
+	return nil
+}
+
+func (f *fakeRunner) WorkspaceTar(context.Context, *container.Config) (io.ReadCloser, error) {
+	return nil, nil
+}
+
+func (f *fakeRunner) Run(ctx context.Context, _ *container.Config, cmd ...string) error {
+	f.runs = append(f.runs, cmd)
+	if f.hook != nil {
+		f.hook(cmd[len(cmd)-1])
+	}
+	if f.block != "" && strings.Contains(cmd[len(cmd)-1], f.block) {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if n := len(f.runs); n <= len(f.exits) && f.exits[n-1] != 0 {
+		return &container.ExitError{Code: f.exits[n-1]}
+	}
+	return nil
+}
+
+func TestRunPipelineRetry(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	for _, tc := range []struct {
+		name     string
+		pipeline config.Pipeline
+		exits    []int
+		wantRuns int
+		wantErr  bool
+	}{{
+		name:     "no retry",
+		pipeline: config.Pipeline{Runs: "make"},
+		exits:    []int{1},
+		wantRuns: 1,
+		wantErr:  true,
+	}, {
+		name:     "succeeds on last attempt",
+		pipeline: config.Pipeline{Runs: "make", Retry: &config.PipelineRetry{Attempts: 3}},
+		exits:    []int{1, 1},
+		wantRuns: 3,
+	}, {
+		name:     "attempts exhausted",
+		pipeline: config.Pipeline{Runs: "make", Retry: &config.PipelineRetry{Attempts: 2}},
+		exits:    []int{1, 1},
+		wantRuns: 2,
+		wantErr:  true,
+	}, {
+		name:     "retried exit code",
+		pipeline: config.Pipeline{Runs: "make", Retry: &config.PipelineRetry{Attempts: 2, ExitCodes: []int{75}}},
+		exits:    []int{75},
+		wantRuns: 2,
+	}, {
+		name:     "other exit code",
+		pipeline: config.Pipeline{Runs: "make", Retry: &config.PipelineRetry{Attempts: 2, ExitCodes: []int{75}}},
+		exits:    []int{1},
+		wantRuns: 1,
+		wantErr:  true,
+	}, {
+		name: "nested pipeline is retried with its parent",
+		pipeline: config.Pipeline{
+			Runs:     "./configure",
+			Retry:    &config.PipelineRetry{Attempts: 2},
+			Pipeline: []config.Pipeline{{Runs: "make"}},
+		},
+		exits:    []int{0, 1},
+		wantRuns: 4,
+	}, {
+		name:     "skipped by if",
+		pipeline: config.Pipeline{If: "'a' == 'b'", Runs: "make", Retry: &config.PipelineRetry{Attempts: 2}},
+		wantRuns: 0,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			runner := &fakeRunner{exits: tc.exits}
+			pr := &pipelineRunner{config: &container.Config{}, runner: runner}
+
+			_, err := pr.runPipeline(ctx, &tc.pipeline)
+			if tc.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Len(t, runner.runs, tc.wantRuns)
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	retry := &config.PipelineRetry{Attempts: 4, Backoff: time.Second}
+	require.Equal(t, time.Second, retryDelay(retry, 1))
+	require.Equal(t, 2*time.Second, retryDelay(retry, 2))
+	require.Equal(t, 4*time.Second, retryDelay(retry, 3))
+}
+
+func TestRunPipelineTimeout(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	runner := &fakeRunner{block: "sleep"}
+	pr := &pipelineRunner{config: &container.Config{}, runner: runner}
+
+	_, err := pr.runPipeline(ctx, &config.Pipeline{
+		Name: "outer",
+		Pipeline: []config.Pipeline{{
+			Name:    "slow",
+			Runs:    "sleep 3600",
+			Timeout: 10 * time.Millisecond,
+			Retry:   &config.PipelineRetry{Attempts: 2},
+		}},
+	})
+	require.ErrorContains(t, err, `step "slow" exceeded its timeout of 10ms`)
+	// The outer step's command, then both attempts at the inner one.
+	require.Len(t, runner.runs, 3)
+}
+
+func TestRunPipelineContinueOnError(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	runner := &fakeRunner{exits: []int{2}}
+	pr := &pipelineRunner{config: &container.Config{}, runner: runner}
+
+	ran, err := pr.runPipeline(ctx, &config.Pipeline{Name: "lint", Runs: "make lint", ContinueOnError: true})
+	require.NoError(t, err)
+	require.True(t, ran)
+	require.Len(t, pr.softFailures, 1)
+	require.Equal(t, "lint", pr.softFailures[0].Step)
+	code, ok := container.ExitCode(pr.softFailures[0].Err)
+	require.True(t, ok)
+	require.Equal(t, 2, code)
+}
+
+func TestRunPipelineStepOutputs(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	ws := t.TempDir()
+
+	runner := &fakeRunner{name: "bubblewrap", hook: func(script string) {
+		if strings.Contains(script, "detect-version") {
+			require.Contains(t, script, "export MELANGE_OUTPUT='/home/build/.melange-outputs/detect'")
+			require.NoError(t, os.WriteFile(filepath.Join(ws, ".melange-outputs", "detect"),
+				[]byte("version=1.2.3\nnotes<<EOF\nfirst\nsecond\nEOF\n"), 0o644))
+		}
+	}}
+	pr := &pipelineRunner{config: &container.Config{WorkspaceDir: ws}, runner: runner}
+
+	require.NoError(t, pr.runPipelines(ctx, []config.Pipeline{{
+		Name: "detect",
+		Runs: "detect-version",
+	}, {
+		Name: "use",
+		If:   "${{steps.detect.outputs.version}} == '1.2.3'",
+		Runs: "echo ${{steps.detect.outputs.version}}",
+	}, {
+		Name: "skipped",
+		If:   "${{steps.detect.outputs.version}} == '2.0.0'",
+		Runs: "echo skipped",
+	}}))
+
+	require.Len(t, runner.runs, 2)
+	require.Contains(t, runner.runs[1][2], "echo 1.2.3")
+	require.Equal(t, "first\nsecond", pr.outputs["${{steps.detect.outputs.notes}}"])
+
+	_, err := pr.runPipeline(ctx, &config.Pipeline{Runs: "echo ${{steps.detect.outputs.missing}}"})
+	require.ErrorContains(t, err, "steps.detect.outputs.missing")
+
+	// Runners that do not bind-mount the workspace cannot collect outputs.
+	pr = &pipelineRunner{config: &container.Config{WorkspaceDir: ws}, runner: &fakeRunner{name: "qemu"}}
+	_, err = pr.runPipeline(ctx, &config.Pipeline{Name: "use", Runs: "echo ${{steps.detect.outputs.version}}"})
+	require.ErrorContains(t, err, `step "use" uses the outputs of other steps, which the qemu runner cannot collect`)
+}
+
+func TestParseOutputs(t *testing.T) {
+	got, err := parseOutputs(strings.NewReader("a=1\n\nb=x=y\nc<<END\nline 1\nline 2\nEND\n"))
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"a": "1", "b": "x=y", "c": "line 1\nline 2"}, got)
+
+	_, err = parseOutputs(strings.NewReader("not an output\n"))
+	require.Error(t, err)
+
+	_, err = parseOutputs(strings.NewReader("c<<END\nunterminated\n"))
+	require.Error(t, err)
+}
@@ -0,0 +1,152 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+	"go.opentelemetry.io/otel"
+
+	"chainguard.dev/melange/pkg/apkdiff"
+)
+
+// ErrNotReproducible is returned when rebuilding a package produces different
+// output.
+var ErrNotReproducible = errors.New("package is not reproducible")
+
+// CheckReproducible builds the package a second time, from scratch and with a
+// separate output, workspace and guest directory, and compares the packages
+// with the ones produced by BuildPackage.  It must be called after
+// BuildPackage.
+func (b *Build) CheckReproducible(ctx context.Context) (*apkdiff.Report, error) {
+	log := clog.FromContext(ctx)
+	ctx, span := otel.Tracer("melange").Start(ctx, "CheckReproducible")
+	defer span.End()
+
+	tmp, err := os.MkdirTemp(b.Runner.TempDir(), "melange-rebuild-*")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create rebuild directory: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	opts := append(slices.Clone(b.opts),
+		WithArch(b.Arch),
+		WithOutDir(filepath.Join(tmp, "packages")),
+		WithWorkspaceDir(filepath.Join(tmp, "workspace")),
+		WithGuestDir(filepath.Join(tmp, "guest")),
+		// Anything added to the build after New, e.g. repositories of
+		// packages built earlier in a multi-package build.
+		WithExtraRepos(b.ExtraRepos),
+		WithExtraKeys(b.ExtraKeys),
+		WithGenerateIndex(false),
+		WithSkipIfUnchanged(false),
+		WithVerifyReproducible(false),
+		// Restoring snapshots would hide differences in the pipeline.
+		WithStepCacheDir(""),
+		WithKeepWorkspace(false),
+		WithResumeFrom(""),
+	)
+
+	rb, err := New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("setting up rebuild: %w", err)
+	}
+	// rb shares its runner with b, so it is not closed here; its directories
+	// are all below tmp.
+
+	log.Infof("rebuilding %s to verify it is reproducible", b.Configuration.Name())
+	if err := rb.BuildPackage(ctx); err != nil {
+		return nil, fmt.Errorf("rebuilding package: %w", err)
+	}
+
+	oldDir := filepath.Join(b.OutDir, b.Arch.ToAPK())
+	newDir := filepath.Join(rb.OutDir, rb.Arch.ToAPK())
+
+	report := &apkdiff.Report{
+		Old:         oldDir,
+		New:         newDir,
+		Differences: []apkdiff.Difference{},
+	}
+
+	names := []string{b.Configuration.Package.Name}
+	for _, sp := range b.Configuration.Subpackages {
+		names = append(names, sp.Name)
+	}
+
+	for _, name := range names {
+		file := fmt.Sprintf("%s-%s-r%d.apk", name, b.Configuration.Package.Version, b.Configuration.Package.Epoch)
+
+		if _, err := os.Stat(filepath.Join(newDir, file)); errors.Is(err, os.ErrNotExist) {
+			report.Differences = append(report.Differences, apkdiff.Difference{
+				Package: name,
+				Kind:    apkdiff.KindPackage,
+				Path:    file,
+				Old:     file,
+			})
+			continue
+		}
+
+		r, err := apkdiff.ComparePackages(ctx, filepath.Join(oldDir, file), filepath.Join(newDir, file))
+		if err != nil {
+			return nil, fmt.Errorf("comparing %s: %w", file, err)
+		}
+		report.Differences = append(report.Differences, r.Differences...)
+	}
+
+	return report, nil
+}
+
+// verifyReproducible runs CheckReproducible and reports any differences,
+// writing the full report next to the packages.
+func (b *Build) verifyReproducible(ctx context.Context) error {
+	log := clog.FromContext(ctx)
+
+	report, err := b.CheckReproducible(ctx)
+	if err != nil {
+		return err
+	}
+
+	if report.Equal() {
+		log.Infof("%s is reproducible", b.Configuration.Name())
+		return nil
+	}
+
+	var sb strings.Builder
+	if err := report.WriteText(&sb); err != nil {
+		return err
+	}
+	log.Error(sb.String())
+
+	path := filepath.Join(b.OutDir, b.Arch.ToAPK(),
+		fmt.Sprintf("%s-%s-r%d.reproducibility.json", b.Configuration.Package.Name, b.Configuration.Package.Version, b.Configuration.Package.Epoch))
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("writing reproducibility report: %w", err)
+	}
+
+	return fmt.Errorf("%w: %d differences, see %s", ErrNotReproducible, len(report.Differences), path)
+}
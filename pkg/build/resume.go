@@ -0,0 +1,165 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/chainguard-dev/clog"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+// resumeStateFile is written to the root of the workspace when a step of the
+// main pipeline fails and the workspace is kept.
+const resumeStateFile = ".melange-resume.json"
+
+// resumeState records what a failed build had done, so that a later build
+// resuming from the same workspace can check that it continues the same
+// build.
+type resumeState struct {
+	Package     string            `json:"package"`
+	Arch        string            `json:"arch"`
+	Environment []string          `json:"environment,omitempty"`
+	Steps       []config.Pipeline `json:"steps"`
+	Failed      int               `json:"failed"`
+}
+
+// stepFailure is returned when a top-level step of the main pipeline fails.
+type stepFailure struct {
+	index int
+	err   error
+}
+
+func (e *stepFailure) Error() string { return e.err.Error() }
+func (e *stepFailure) Unwrap() error { return e.err }
+
+// runSteps runs the given pipelines from index start onwards.  The earlier
+// steps must have been run in the same workspace.
+func (r *pipelineRunner) runSteps(ctx context.Context, pipelines []config.Pipeline, start int) error {
+	// The workspace holds the outputs of the steps that are skipped.
+	for i := 0; i < start; i++ {
+		if err := r.loadOutputs(&pipelines[i]); err != nil {
+			return err
+		}
+	}
+
+	for i := start; i < len(pipelines); i++ {
+		if _, err := r.runPipeline(ctx, &pipelines[i]); err != nil {
+			return &stepFailure{index: i, err: fmt.Errorf("unable to run pipeline: %w", err)}
+		}
+	}
+
+	return nil
+}
+
+// saveResumeState records the compiled main pipeline and the index of the
+// step that failed in the workspace.
+func (b *Build) saveResumeState(ctx context.Context, failed int) error {
+	log := clog.FromContext(ctx)
+
+	data, err := json.MarshalIndent(resumeState{
+		Package:     b.Configuration.Package.Name,
+		Arch:        b.Arch.ToAPK(),
+		Environment: b.resolvedEnvironment,
+		Steps:       b.Configuration.Pipeline,
+		Failed:      failed,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(filepath.Join(b.WorkspaceDir, resumeStateFile), data, 0o644); err != nil {
+		return err
+	}
+
+	log.Errorf("step %d (%q) failed, keeping workspace %s and guest dir %s", failed+1, identity(&b.Configuration.Pipeline[failed]), b.WorkspaceDir, b.GuestDir)
+	log.Errorf("to continue the build, rerun it with the same --workspace-dir and --resume-from=%q", identity(&b.Configuration.Pipeline[failed]))
+
+	return nil
+}
+
+// resumeIndex validates the state left in the workspace by a failed build and
+// returns the index of the step named by ResumeFrom.  Steps before it are
+// skipped, so they must not have changed since the failed build.
+func (b *Build) resumeIndex() (int, error) {
+	path := filepath.Join(b.WorkspaceDir, resumeStateFile)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("no resume state in %s, was the failed build run with --keep-workspace and the same --workspace-dir?", b.WorkspaceDir)
+	} else if err != nil {
+		return 0, err
+	}
+
+	var state resumeState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return 0, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	if state.Failed < 0 || state.Failed >= len(state.Steps) {
+		return 0, fmt.Errorf("invalid failing step %d in %s", state.Failed, path)
+	}
+
+	if state.Package != b.Configuration.Package.Name || state.Arch != b.Arch.ToAPK() {
+		return 0, fmt.Errorf("workspace %s holds a failed build of %s for %s, not %s for %s",
+			b.WorkspaceDir, state.Package, state.Arch, b.Configuration.Package.Name, b.Arch.ToAPK())
+	}
+
+	if !slices.Equal(state.Environment, b.resolvedEnvironment) {
+		return 0, fmt.Errorf("the build environment changed since the failed build")
+	}
+
+	index := -1
+	for i := range b.Configuration.Pipeline {
+		if identity(&b.Configuration.Pipeline[i]) != b.ResumeFrom {
+			continue
+		}
+		if index != -1 {
+			return 0, fmt.Errorf("step name %q is ambiguous, it is used by steps %d and %d", b.ResumeFrom, index+1, i+1)
+		}
+		index = i
+	}
+	if index == -1 {
+		return 0, fmt.Errorf("no step named %q in the main pipeline", b.ResumeFrom)
+	}
+
+	if index > state.Failed {
+		return 0, fmt.Errorf("cannot resume from step %d (%q), the failed build stopped at step %d (%q)",
+			index+1, b.ResumeFrom, state.Failed+1, identity(&state.Steps[state.Failed]))
+	}
+
+	for i := 0; i < index; i++ {
+		want, err := json.Marshal(state.Steps[i])
+		if err != nil {
+			return 0, err
+		}
+		got, err := json.Marshal(b.Configuration.Pipeline[i])
+		if err != nil {
+			return 0, err
+		}
+		if !bytes.Equal(want, got) {
+			return 0, fmt.Errorf("step %d (%q) changed since the failed build, resume from it or an earlier step", i+1, identity(&b.Configuration.Pipeline[i]))
+		}
+	}
+
+	return index, nil
+}
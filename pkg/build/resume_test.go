@@ -0,0 +1,159 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+func TestResumeIndex(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	steps := func() []config.Pipeline {
+		return []config.Pipeline{
+			{Name: "fetch", Uses: "fetch", With: map[string]string{"uri": "https://example.com/foo.tar.gz"}},
+			{Name: "configure", Runs: "./configure"},
+			{Name: "build", Runs: "make"},
+			{Name: "install", Runs: "make install"},
+		}
+	}
+
+	failed := &Build{
+		Arch:         apko_types.ParseArchitecture("x86_64"),
+		WorkspaceDir: t.TempDir(),
+		Configuration: config.Configuration{
+			Package:  config.Package{Name: "foo"},
+			Pipeline: steps(),
+		},
+		resolvedEnvironment: []string{"busybox=1.36.1-r0:Q1abc"},
+	}
+	require.NoError(t, failed.saveResumeState(ctx, 2))
+
+	for _, tc := range []struct {
+		name    string
+		from    string
+		modify  func(b *Build)
+		want    int
+		wantErr string
+	}{{
+		name: "failing step",
+		from: "build",
+		want: 2,
+	}, {
+		name: "earlier step",
+		from: "configure",
+		want: 1,
+	}, {
+		name: "failing step changed",
+		from: "build",
+		modify: func(b *Build) {
+			b.Configuration.Pipeline[2].Runs = "make -j1"
+		},
+		want: 2,
+	}, {
+		name:    "later step",
+		from:    "install",
+		wantErr: `the failed build stopped at step 3 ("build")`,
+	}, {
+		name:    "unknown step",
+		from:    "test",
+		wantErr: `no step named "test"`,
+	}, {
+		name: "skipped step changed",
+		from: "build",
+		modify: func(b *Build) {
+			b.Configuration.Pipeline[1].Runs = "./configure --prefix=/usr"
+		},
+		wantErr: `step 2 ("configure") changed`,
+	}, {
+		name: "ambiguous step",
+		from: "build",
+		modify: func(b *Build) {
+			b.Configuration.Pipeline[3].Name = "build"
+		},
+		wantErr: "ambiguous",
+	}, {
+		name: "environment changed",
+		from: "build",
+		modify: func(b *Build) {
+			b.resolvedEnvironment = []string{"busybox=1.36.1-r1:Q1def"}
+		},
+		wantErr: "build environment changed",
+	}, {
+		name: "other package",
+		from: "build",
+		modify: func(b *Build) {
+			b.Configuration.Package.Name = "bar"
+		},
+		wantErr: "holds a failed build of foo",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &Build{
+				Arch:         failed.Arch,
+				WorkspaceDir: failed.WorkspaceDir,
+				ResumeFrom:   tc.from,
+				Configuration: config.Configuration{
+					Package:  config.Package{Name: "foo"},
+					Pipeline: steps(),
+				},
+				resolvedEnvironment: []string{"busybox=1.36.1-r0:Q1abc"},
+			}
+			if tc.modify != nil {
+				tc.modify(b)
+			}
+
+			got, err := b.resumeIndex()
+			if tc.wantErr != "" {
+				require.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+
+	b := &Build{WorkspaceDir: t.TempDir(), ResumeFrom: "build"}
+	_, err := b.resumeIndex()
+	require.ErrorContains(t, err, "no resume state")
+}
+
+func TestCloseKeepWorkspace(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	for _, failed := range []bool{false, true} {
+		b := &Build{
+			Remove:        true,
+			KeepWorkspace: true,
+			WorkspaceDir:  t.TempDir(),
+			GuestDir:      t.TempDir(),
+			workspaceKept: failed,
+		}
+		require.NoError(t, b.Close(ctx))
+
+		if failed {
+			require.DirExists(t, b.WorkspaceDir)
+			require.DirExists(t, b.GuestDir)
+		} else {
+			require.NoDirExists(t, b.WorkspaceDir)
+			require.NoDirExists(t, b.GuestDir)
+		}
+	}
+}
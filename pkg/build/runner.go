@@ -19,3 +19,14 @@ func GetAllRunners() []Runner {
 		runnerKubernetes,
 	}
 }
+
+// bindsWorkspace reports whether the runner bind-mounts the workspace into
+// the guest, so changes made by pipeline steps are visible on the host as
+// soon as each step completes.
+func bindsWorkspace(name string) bool {
+	switch Runner(name) {
+	case runnerBubblewrap, runnerDocker:
+		return true
+	}
+	return false
+}
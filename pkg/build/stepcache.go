@@ -0,0 +1,441 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/dustin/go-humanize"
+	"go.opentelemetry.io/otel"
+	"sigs.k8s.io/release-utils/version"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+// stepCache is a content-addressed store of workspace snapshots, one per
+// top-level step of the main pipeline.  The key of a step covers the step
+// itself and the keys of all earlier steps, so a snapshot is only reused when
+// everything that led up to it is unchanged.
+type stepCache struct {
+	dir     string
+	maxSize int64
+}
+
+const stepCacheExt = ".tar.gz"
+
+func (c *stepCache) path(key string) string {
+	return filepath.Join(c.dir, key+stepCacheExt)
+}
+
+func (c *stepCache) has(key string) bool {
+	_, err := os.Stat(c.path(key))
+	return err == nil
+}
+
+// stepKey returns the cache key of a step following the step with key prev.
+func stepKey(prev string, step *config.Pipeline) (string, error) {
+	data, err := json.Marshal(step)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write([]byte(prev))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// stepCacheBase returns the key that the first step builds on: everything
+// that determines the state of the guest and workspace before the main
+// pipeline runs.  The resolved environment stands in for the digest of the
+// guest image, which is not stable across runners.  It must be called after
+// ComputeInputHash.
+func (b *Build) stepCacheBase() (string, error) {
+	data, err := json.Marshal(struct {
+		MelangeVersion  string            `json:"melangeVersion"`
+		Arch            string            `json:"arch"`
+		SourceDateEpoch int64             `json:"sourceDateEpoch"`
+		Environment     []string          `json:"environment"`
+		Variables       map[string]string `json:"variables,omitempty"`
+		Sources         map[string]string `json:"sources,omitempty"`
+	}{
+		MelangeVersion:  version.GetVersionInfo().GitVersion,
+		Arch:            b.Arch.ToAPK(),
+		SourceDateEpoch: b.SourceDateEpoch.Unix(),
+		Environment:     b.resolvedEnvironment,
+		Variables:       b.Configuration.Environment.Environment,
+		Sources:         b.sourceDigests,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256(data)), nil
+}
+
+// save snapshots the workspace under the given key and evicts old snapshots
+// if the cache grew too large.
+func (c *stepCache) save(ctx context.Context, key, workspaceDir string) error {
+	ctx, span := otel.Tracer("melange").Start(ctx, "stepCache.save")
+	defer span.End()
+
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(c.dir, "snapshot-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	zw := gzip.NewWriter(tmp)
+	if err := writeTree(zw, workspaceDir); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), c.path(key)); err != nil {
+		return err
+	}
+
+	return c.evict(ctx)
+}
+
+// restore replaces the contents of the workspace with the snapshot stored
+// under the given key.  The workspace directory itself is kept, as it may be
+// mounted into a running guest.
+func (c *stepCache) restore(ctx context.Context, key, workspaceDir string) error {
+	_, span := otel.Tracer("melange").Start(ctx, "stepCache.restore")
+	defer span.End()
+
+	f, err := os.Open(c.path(key))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Mark the snapshot as recently used, eviction removes the oldest first.
+	now := time.Now()
+	if err := os.Chtimes(f.Name(), now, now); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(workspaceDir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(workspaceDir, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	return readTree(zr, workspaceDir)
+}
+
+// evict removes the least recently used snapshots until the cache is no
+// larger than its maximum size.
+func (c *stepCache) evict(ctx context.Context) error {
+	log := clog.FromContext(ctx)
+
+	if c.maxSize <= 0 {
+		return nil
+	}
+
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+
+	snapshots := []fs.FileInfo{}
+	total := int64(0)
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), stepCacheExt) {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			return err
+		}
+		snapshots = append(snapshots, fi)
+		total += fi.Size()
+	}
+
+	slices.SortFunc(snapshots, func(a, b fs.FileInfo) int {
+		return a.ModTime().Compare(b.ModTime())
+	})
+
+	for _, fi := range snapshots {
+		if total <= c.maxSize {
+			break
+		}
+
+		log.Infof("evicting %s (%s) from step cache", fi.Name(), humanize.Bytes(uint64(fi.Size())))
+		if err := os.Remove(filepath.Join(c.dir, fi.Name())); err != nil {
+			return err
+		}
+		total -= fi.Size()
+	}
+
+	return nil
+}
+
+// writeTree writes the contents of dir to w as a tar stream.  Files that are
+// linked more than once are written once, and as hard links after that.  It
+// fails for entries that readTree cannot restore: devices, fifos and sockets,
+// and, unless running as root, entries owned by another user or group.
+func writeTree(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+
+	type inode struct{ dev, ino uint64 }
+	links := map[inode]string{}
+	uid, gid := os.Getuid(), os.Getgid()
+
+	if err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if mode := fi.Mode(); !mode.IsRegular() && !mode.IsDir() && mode&fs.ModeSymlink == 0 {
+			return fmt.Errorf("cannot snapshot %s: unsupported file type %s", rel, mode.Type())
+		}
+
+		link := ""
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+
+		if uid != 0 && (hdr.Uid != uid || hdr.Gid != gid) {
+			return fmt.Errorf("cannot snapshot %s: owned by %d:%d, not %d:%d", rel, hdr.Uid, hdr.Gid, uid, gid)
+		}
+
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && fi.Mode().IsRegular() && st.Nlink > 1 {
+			key := inode{uint64(st.Dev), st.Ino} // Dev is not a uint64 on every platform
+			if target, ok := links[key]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = target
+				hdr.Size = 0
+				return tw.WriteHeader(hdr)
+			}
+			links[key] = rel
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// readTree extracts the tar stream r, as written by writeTree, into dir.
+func readTree(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+
+	// Directory modes and times are applied once their contents exist.
+	type dirInfo struct {
+		path    string
+		mode    fs.FileMode
+		modTime time.Time
+	}
+	dirs := []dirInfo{}
+
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if !filepath.IsLocal(hdr.Name) {
+			return fmt.Errorf("invalid path in snapshot: %s", hdr.Name)
+		}
+		path := filepath.Join(dir, hdr.Name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0o755); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirInfo{path, hdr.FileInfo().Mode().Perm(), hdr.ModTime})
+
+		case tar.TypeReg:
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, hdr.FileInfo().Mode().Perm())
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+			if err := os.Chtimes(path, hdr.ModTime, hdr.ModTime); err != nil {
+				return err
+			}
+
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, path); err != nil {
+				return err
+			}
+
+		case tar.TypeLink:
+			if !filepath.IsLocal(hdr.Linkname) {
+				return fmt.Errorf("invalid link target in snapshot: %s", hdr.Linkname)
+			}
+			if err := os.Link(filepath.Join(dir, hdr.Linkname), path); err != nil {
+				return err
+			}
+			continue
+
+		default:
+			return fmt.Errorf("unexpected tar type %d for %s in snapshot", hdr.Typeflag, hdr.Name)
+		}
+
+		if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, dirs[i].mode); err != nil {
+			return err
+		}
+		if err := os.Chtimes(dirs[i].path, dirs[i].modTime, dirs[i].modTime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runCachedPipelines runs the given pipelines like runPipelines, but restores
+// the workspace from the latest cached snapshot and only runs the steps after
+// it.  A snapshot of the workspace is saved after each step that ran.
+func (r *pipelineRunner) runCachedPipelines(ctx context.Context, cache *stepCache, base string, pipelines []config.Pipeline) error {
+	log := clog.FromContext(ctx)
+
+	keys := make([]string, len(pipelines))
+	prev := base
+	for i := range pipelines {
+		key, err := stepKey(prev, &pipelines[i])
+		if err != nil {
+			return fmt.Errorf("computing step cache key: %w", err)
+		}
+		keys[i], prev = key, key
+	}
+
+	start := 0
+	for i := len(keys) - 1; i >= 0; i-- {
+		if cache.has(keys[i]) {
+			start = i + 1
+			break
+		}
+	}
+
+	if start > 0 {
+		log.Infof("restoring workspace from step cache, skipping %d of %d steps", start, len(pipelines))
+		if err := cache.restore(ctx, keys[start-1], r.config.WorkspaceDir); err != nil {
+			return fmt.Errorf("restoring step cache snapshot %s: %w", keys[start-1], err)
+		}
+
+		// The snapshot holds the outputs of the steps that are skipped.
+		for i := 0; i < start; i++ {
+			if err := r.loadOutputs(&pipelines[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i := start; i < len(pipelines); i++ {
+		if _, err := r.runPipeline(ctx, &pipelines[i]); err != nil {
+			return &stepFailure{index: i, err: fmt.Errorf("unable to run pipeline: %w", err)}
+		}
+
+		if err := cache.save(ctx, keys[i], r.config.WorkspaceDir); err != nil {
+			log.Warnf("unable to save step cache snapshot: %v", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+func TestStepKey(t *testing.T) {
+	fetch := &config.Pipeline{Uses: "fetch", With: map[string]string{"uri": "https://example.com/foo.tar.gz"}}
+	compile := &config.Pipeline{Runs: "make"}
+
+	k1, err := stepKey("base", fetch)
+	require.NoError(t, err)
+	k2, err := stepKey(k1, compile)
+	require.NoError(t, err)
+
+	// The key of a step depends on every step before it.
+	other, err := stepKey("other", fetch)
+	require.NoError(t, err)
+	require.NotEqual(t, k1, other)
+	k2other, err := stepKey(other, compile)
+	require.NoError(t, err)
+	require.NotEqual(t, k2, k2other)
+
+	again, err := stepKey(k1, &config.Pipeline{Runs: "make"})
+	require.NoError(t, err)
+	require.Equal(t, k2, again)
+}
+
+func TestStepCache(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	cache := &stepCache{dir: t.TempDir()}
+	ws := t.TempDir()
+
+	require.NoError(t, os.MkdirAll(filepath.Join(ws, "src", "bin"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(ws, "src", "bin", "tool"), []byte("#!/bin/sh\n"), 0o755))
+	require.NoError(t, os.Symlink("bin/tool", filepath.Join(ws, "src", "tool")))
+	require.NoError(t, os.Link(filepath.Join(ws, "src", "bin", "tool"), filepath.Join(ws, "src", "hardlink")))
+
+	require.False(t, cache.has("one"))
+	require.NoError(t, cache.save(ctx, "one", ws))
+	require.True(t, cache.has("one"))
+
+	// Changes made by later steps are discarded on restore.
+	require.NoError(t, os.WriteFile(filepath.Join(ws, "src", "bin", "tool"), []byte("changed"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(ws, "extra"), []byte("extra"), 0o644))
+
+	require.NoError(t, cache.restore(ctx, "one", ws))
+
+	data, err := os.ReadFile(filepath.Join(ws, "src", "bin", "tool"))
+	require.NoError(t, err)
+	require.Equal(t, "#!/bin/sh\n", string(data))
+	fi, err := os.Stat(filepath.Join(ws, "src", "bin", "tool"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o755), fi.Mode().Perm())
+	link, err := os.Readlink(filepath.Join(ws, "src", "tool"))
+	require.NoError(t, err)
+	require.Equal(t, "bin/tool", link)
+	hardlink, err := os.Stat(filepath.Join(ws, "src", "hardlink"))
+	require.NoError(t, err)
+	require.True(t, os.SameFile(fi, hardlink))
+	require.NoFileExists(t, filepath.Join(ws, "extra"))
+}
+
+func TestStepCacheUnsupported(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	cache := &stepCache{dir: t.TempDir()}
+	ws := t.TempDir()
+	require.NoError(t, syscall.Mkfifo(filepath.Join(ws, "fifo"), 0o644))
+
+	require.ErrorContains(t, cache.save(ctx, "one", ws), "unsupported file type")
+	require.False(t, cache.has("one"))
+}
+
+func TestStepCacheEvict(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	cache := &stepCache{dir: t.TempDir()}
+	ws := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(ws, "file"), []byte("content"), 0o644))
+
+	old := time.Now().Add(-time.Hour)
+	for i, key := range []string{"a", "b", "c"} {
+		require.NoError(t, cache.save(ctx, key, ws))
+		mtime := old.Add(time.Duration(i) * time.Minute)
+		require.NoError(t, os.Chtimes(cache.path(key), mtime, mtime))
+	}
+
+	// Restoring a snapshot marks it as recently used.
+	require.NoError(t, cache.restore(ctx, "a", ws))
+
+	fi, err := os.Stat(cache.path("a"))
+	require.NoError(t, err)
+	cache.maxSize = 2 * fi.Size()
+	require.NoError(t, cache.evict(ctx))
+
+	require.True(t, cache.has("a"))
+	require.False(t, cache.has("b"))
+	require.True(t, cache.has("c"))
+}
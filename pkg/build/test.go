@@ -64,6 +64,8 @@ type Test struct {
 	Debug             bool
 	DebugRunner       bool
 	Interactive       bool
+	Strict            bool
+	AllowUnresolved   bool
 	Auth              map[string]options.Auth
 }
 
@@ -106,6 +108,9 @@ func NewTest(ctx context.Context, opts ...TestOption) (*Test, error) {
 
 	parsedCfg, err := config.ParseConfiguration(ctx, t.ConfigFile,
 		config.WithEnvFileForParsing(t.EnvFile),
+		config.WithArch(t.Arch),
+		config.WithStrict(t.Strict),
+		config.WithAllowUnresolved(t.AllowUnresolved),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load configuration: %w", err)
@@ -351,6 +356,11 @@ func (t *Test) TestPackage(ctx context.Context) error {
 
 	// Filter out any subpackages with false If conditions.
 	t.Configuration.Subpackages = slices.DeleteFunc(t.Configuration.Subpackages, func(sp config.Subpackage) bool {
+		if sp.Disabled {
+			log.Infof("skipping subpackage %s because it is disabled", sp.Name)
+			return true
+		}
+
 		result, err := shouldRun(sp.If)
 		if err != nil {
 			// This shouldn't give an error because we evaluate it in Compile.
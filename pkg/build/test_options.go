@@ -187,6 +187,24 @@ func WithTestEnvFile(envFile string) TestOption {
 	}
 }
 
+// WithTestStrict indicates whether the configuration must conform to its
+// schema.  If not, the problems are reported as warnings.
+func WithTestStrict(strict bool) TestOption {
+	return func(t *Test) error {
+		t.Strict = strict
+		return nil
+	}
+}
+
+// WithTestAllowUnresolved indicates whether references to variables that are
+// not defined are allowed.  They are reported as warnings and left in place.
+func WithTestAllowUnresolved(allowUnresolved bool) TestOption {
+	return func(t *Test) error {
+		t.AllowUnresolved = allowUnresolved
+		return nil
+	}
+}
+
 func WithTestAuth(domain, user, pass string) TestOption {
 	return func(t *Test) error {
 		if t.Auth == nil {
@@ -18,18 +18,23 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	apko_types "chainguard.dev/apko/pkg/build/types"
 	"chainguard.dev/melange/pkg/build"
+	"chainguard.dev/melange/pkg/config"
 	"chainguard.dev/melange/pkg/container"
 	"chainguard.dev/melange/pkg/container/dagger"
 	"chainguard.dev/melange/pkg/container/docker"
+	"chainguard.dev/melange/pkg/index"
 	"chainguard.dev/melange/pkg/linter"
 	"github.com/chainguard-dev/clog"
 	"github.com/spf13/cobra"
@@ -45,6 +50,7 @@ func Build() *cobra.Command {
 	var buildDate string
 	var workspaceDir string
 	var pipelineDir string
+	var includeDirs []string
 	var sourceDir string
 	var cacheDir string
 	var cacheSource string
@@ -64,6 +70,9 @@ func Build() *cobra.Command {
 	var varsFile string
 	var purlNamespace string
 	var buildOption []string
+	var variantSelectors []string
+	var allowUnresolved bool
+	var strict bool
 	var createBuildLog bool
 	var debug bool
 	var debugRunner bool
@@ -75,14 +84,20 @@ func Build() *cobra.Command {
 	var extraPackages []string
 	var libc string
 	var lintRequire, lintWarn []string
+	var jobs int
+	var skipIfUnchanged bool
+	var verifyReproducible bool
+	var stepCacheDir, stepCacheSize string
+	var keepWorkspace bool
+	var resumeFrom string
 
 	var traceFile string
 
 	cmd := &cobra.Command{
 		Use:     "build",
 		Short:   "Build a package from a YAML configuration file",
-		Long:    `Build a package from a YAML configuration file.`,
-		Example: `  melange build [config.yaml]`,
+		Long:    `Build a package from a YAML configuration file. When given several configuration files or a directory of them, the packages are built in dependency order.`,
+		Example: `  melange build [config.yaml | config-dir | config.yaml...]`,
 		Args:    cobra.MinimumNArgs(0),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := cmd.Context()
@@ -142,6 +157,8 @@ func Build() *cobra.Command {
 				build.WithVarsFile(varsFile),
 				build.WithNamespace(purlNamespace),
 				build.WithEnabledBuildOptions(buildOption),
+				build.WithAllowUnresolved(allowUnresolved),
+				build.WithStrict(strict),
 				build.WithCreateBuildLog(createBuildLog),
 				build.WithDebug(debug),
 				build.WithDebugRunner(debugRunner),
@@ -154,18 +171,16 @@ func Build() *cobra.Command {
 				build.WithMemory(memory),
 				build.WithTimeout(timeout),
 				build.WithLibcFlavorOverride(libc),
+				build.WithSkipIfUnchanged(skipIfUnchanged),
+				build.WithVerifyReproducible(verifyReproducible),
+				build.WithStepCacheDir(stepCacheDir),
+				build.WithStepCacheSize(stepCacheSize),
+				build.WithKeepWorkspace(keepWorkspace),
+				build.WithResumeFrom(resumeFrom),
 			}
 
-			if len(args) > 0 {
-				options = append(options, build.WithConfig(args[0]))
-
-				if sourceDir == "" {
-					sourceDir = filepath.Dir(args[0])
-				}
-			}
-
-			if sourceDir != "" {
-				options = append(options, build.WithSourceDir(sourceDir))
+			for _, dir := range includeDirs {
+				options = append(options, build.WithIncludeDir(dir))
 			}
 
 			if auth, ok := os.LookupEnv("HTTP_AUTH"); !ok {
@@ -179,6 +194,82 @@ func Build() *cobra.Command {
 				options = append(options, build.WithAuth(domain, user, pass))
 			}
 
+			configs, multi, err := configFiles(args)
+			if err != nil {
+				return err
+			}
+
+			selector, err := config.ParseVariantSelector(variantSelectors)
+			if err != nil {
+				return err
+			}
+
+			// Each variant of a configuration is built like a configuration
+			// of its own.
+			type buildTarget struct {
+				name, configFile string
+				variant          config.Variant
+			}
+			targets := []buildTarget{}
+			for _, configFile := range configs {
+				variants, err := configVariants(ctx, configFile, selector, includeDirs)
+				if err != nil {
+					return err
+				}
+				if len(variants) == 0 && len(selector) > 0 && !multi {
+					return fmt.Errorf("%s has no variants to select with --variant", configFile)
+				}
+
+				name := strings.TrimSuffix(filepath.Base(configFile), filepath.Ext(configFile))
+				if variants == nil {
+					targets = append(targets, buildTarget{name: name, configFile: configFile})
+				}
+				for _, v := range variants {
+					targets = append(targets, buildTarget{name: filepath.Join(name, variantDir(v)), configFile: configFile, variant: v})
+				}
+			}
+
+			if multi || len(targets) > 1 {
+				if resumeFrom != "" {
+					return fmt.Errorf("--resume-from can only be used when building a single configuration")
+				}
+
+				perConfig := make([][]build.Option, 0, len(targets))
+				for _, target := range targets {
+					opts := []build.Option{build.WithConfig(target.configFile), build.WithVariant(target.variant)}
+
+					if sourceDir != "" {
+						opts = append(opts, build.WithSourceDir(sourceDir))
+					} else {
+						opts = append(opts, build.WithSourceDir(filepath.Dir(target.configFile)))
+					}
+
+					// Concurrent builds must not share a workspace or guest.
+					if workspaceDir != "" {
+						opts = append(opts, build.WithWorkspaceDir(filepath.Join(workspaceDir, target.name)))
+					}
+					if guestDir != "" {
+						opts = append(opts, build.WithGuestDir(filepath.Join(guestDir, target.name)))
+					}
+
+					perConfig = append(perConfig, append(slices.Clone(options), opts...))
+				}
+
+				return BuildManyCmd(ctx, archs, jobs, perConfig)
+			}
+
+			if len(targets) > 0 {
+				options = append(options, build.WithConfig(targets[0].configFile), build.WithVariant(targets[0].variant))
+
+				if sourceDir == "" {
+					sourceDir = filepath.Dir(targets[0].configFile)
+				}
+			}
+
+			if sourceDir != "" {
+				options = append(options, build.WithSourceDir(sourceDir))
+			}
+
 			return BuildCmd(ctx, archs, options...)
 		},
 	}
@@ -186,6 +277,7 @@ func Build() *cobra.Command {
 	cmd.Flags().StringVar(&buildDate, "build-date", "", "date used for the timestamps of the files inside the image")
 	cmd.Flags().StringVar(&workspaceDir, "workspace-dir", "", "directory used for the workspace at /home/build")
 	cmd.Flags().StringVar(&pipelineDir, "pipeline-dir", "", "directory used to extend defined built-in pipelines")
+	cmd.Flags().StringSliceVar(&includeDirs, "include-dir", []string{}, "directories searched for files included by the configuration that are not found relative to it")
 	cmd.Flags().StringVar(&sourceDir, "source-dir", "", "directory used for included sources")
 	cmd.Flags().StringVar(&cacheDir, "cache-dir", "./melange-cache/", "directory used for cached inputs")
 	cmd.Flags().StringVar(&cacheSource, "cache-source", "", "directory or bucket used for preloading the cache")
@@ -204,6 +296,9 @@ func Build() *cobra.Command {
 	cmd.Flags().StringSliceVar(&archstrs, "arch", nil, "architectures to build for (e.g., x86_64,ppc64le,arm64) -- default is all, unless specified in config")
 	cmd.Flags().StringVar(&libc, "override-host-triplet-libc-substitution-flavor", "gnu", "override the flavor of libc for ${{host.triplet.*}} substitutions (e.g. gnu,musl) -- default is gnu")
 	cmd.Flags().StringSliceVar(&buildOption, "build-option", []string{}, "build options to enable")
+	cmd.Flags().StringSliceVar(&variantSelectors, "variant", []string{}, "variable=value pairs selecting the variants of the configuration to build -- default is all")
+	cmd.Flags().BoolVar(&allowUnresolved, "allow-unresolved", false, "allow references to variables that are not defined, leaving them in place with a warning")
+	cmd.Flags().BoolVar(&strict, "strict", inCI(), "require the configuration to conform to its schema, rather than warning about the problems -- default is true when $CI is true")
 	cmd.Flags().StringVar(&runner, "runner", "", fmt.Sprintf("which runner to use to enable running commands, default is based on your platform. Options are %q", build.GetAllRunners()))
 	cmd.Flags().StringSliceVarP(&extraKeys, "keyring-append", "k", []string{}, "path to extra keys to include in the build environment keyring")
 	cmd.Flags().StringSliceVarP(&extraRepos, "repository-append", "r", []string{}, "path to extra repositories to include in the build environment")
@@ -219,6 +314,13 @@ func Build() *cobra.Command {
 	cmd.Flags().StringVar(&traceFile, "trace", "", "where to write trace output")
 	cmd.Flags().StringSliceVar(&lintRequire, "lint-require", linter.DefaultRequiredLinters(), "linters that must pass")
 	cmd.Flags().StringSliceVar(&lintWarn, "lint-warn", linter.DefaultWarnLinters(), "linters that will generate warnings")
+	cmd.Flags().IntVarP(&jobs, "jobs", "j", 1, "maximum number of packages to build concurrently when building multiple configurations")
+	cmd.Flags().BoolVar(&skipIfUnchanged, "skip-if-unchanged", false, "skip the build if the packages in the output directory were built from identical inputs")
+	cmd.Flags().BoolVar(&verifyReproducible, "verify-reproducible", false, "build the package twice and fail if the resulting packages differ")
+	cmd.Flags().StringVar(&stepCacheDir, "step-cache-dir", "", "directory for caching workspace snapshots after each pipeline step (disabled if empty)")
+	cmd.Flags().BoolVar(&keepWorkspace, "keep-workspace", false, "keep the workspace and guest directory of a failed build so it can be resumed with --resume-from")
+	cmd.Flags().StringVar(&resumeFrom, "resume-from", "", "name of the main pipeline step to resume a failed build kept with --keep-workspace from")
+	cmd.Flags().StringVar(&stepCacheSize, "step-cache-size", "10GB", "maximum size of the step cache, the least recently used snapshots are evicted above it")
 
 	_ = cmd.Flags().Bool("fail-on-lint-warning", false, "DEPRECATED: DO NOT USE")
 	_ = cmd.Flags().MarkDeprecated("fail-on-lint-warning", "use --lint-require and --lint-warn instead")
@@ -317,3 +419,251 @@ func BuildCmd(ctx context.Context, archs []apko_types.Architecture, baseOpts ...
 	}
 	return errg.Wait()
 }
+
+// configFiles expands the given arguments into a list of configuration files.
+// Directories are expanded to the YAML files they contain.  It reports
+// whether more than one package was requested, which selects the
+// multi-package build mode.
+func configFiles(args []string) ([]string, bool, error) {
+	configs := []string{}
+	multi := len(args) > 1
+
+	for _, arg := range args {
+		fi, err := os.Stat(arg)
+		if err != nil || !fi.IsDir() {
+			configs = append(configs, arg)
+			continue
+		}
+
+		multi = true
+
+		entries, err := os.ReadDir(arg)
+		if err != nil {
+			return nil, false, fmt.Errorf("reading configuration directory %s: %w", arg, err)
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			if ext := filepath.Ext(entry.Name()); ext == ".yaml" || ext == ".yml" {
+				configs = append(configs, filepath.Join(arg, entry.Name()))
+			}
+		}
+	}
+
+	return configs, multi, nil
+}
+
+// inCI reports whether melange is running in CI, where configurations are
+// checked strictly by default.
+func inCI() bool {
+	ci, _ := strconv.ParseBool(os.Getenv("CI"))
+	return ci
+}
+
+// configVariants returns the variants of the configuration file that match
+// selector, or nil if the configuration has no variants.  It fails if two of
+// them build packages of the same name.
+func configVariants(ctx context.Context, configFile string, selector config.Variant, includeDirs []string) ([]config.Variant, error) {
+	// Warnings about the configuration are reported when it is built.
+	ctx = clog.WithLogger(ctx, clog.New(slog.NewTextHandler(io.Discard, nil)))
+	cfg, err := config.ParseConfiguration(ctx, configFile,
+		config.WithIncludeDirs(includeDirs),
+		config.WithAllowUnresolved(true),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("listing variants of %s: %w", configFile, err)
+	}
+
+	matrix := cfg.VariantMatrix()
+	if matrix == nil {
+		return nil, nil
+	}
+
+	variants := slices.DeleteFunc(matrix, func(v config.Variant) bool {
+		return !v.Matches(selector)
+	})
+	if len(variants) == 0 {
+		return nil, fmt.Errorf("no variant of %s matches %s", configFile, selector)
+	}
+
+	// Packages are written to the output directory by name, so variants
+	// building packages of the same name would overwrite each other.
+	builtBy := map[string]config.Variant{}
+	for _, v := range variants {
+		vcfg, err := config.ParseConfiguration(ctx, configFile,
+			config.WithIncludeDirs(includeDirs),
+			config.WithAllowUnresolved(true),
+			config.WithVariant(v),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("parsing variant %s of %s: %w", v, configFile, err)
+		}
+
+		names := []string{vcfg.Package.Name}
+		for _, sp := range vcfg.Subpackages {
+			names = append(names, sp.Name)
+		}
+		for _, name := range names {
+			if other, ok := builtBy[name]; ok {
+				return nil, fmt.Errorf("variants %s and %s of %s both build package %s, refer to the variables of the variants matrix in the package names", other, v, configFile, name)
+			}
+			builtBy[name] = v
+		}
+	}
+
+	return variants, nil
+}
+
+// variantDir returns the name of the directory, e.g. of the workspace, used
+// for building a variant.
+func variantDir(v config.Variant) string {
+	return strings.NewReplacer("=", "-", ",", "_", "/", "_").Replace(v.String())
+}
+
+// BuildManyCmd builds several packages, one per set of options, in dependency
+// order.  Packages are built layer by layer into a shared output repository:
+// the packages of a layer only depend on packages from earlier layers and are
+// built concurrently, up to jobs at a time.  The repository index is
+// regenerated after every layer and later layers use the repository to
+// resolve packages built by earlier layers.
+func BuildManyCmd(ctx context.Context, archs []apko_types.Architecture, jobs int, perConfig [][]build.Option) error {
+	log := clog.FromContext(ctx)
+	ctx, span := otel.Tracer("melange").Start(ctx, "BuildManyCmd")
+	defer span.End()
+
+	if len(archs) == 0 {
+		archs = apko_types.AllArchs
+	}
+
+	// As in BuildCmd, set up all the build contexts before running any of them.
+	bcs := []*build.Build{}
+	generateIndex := false
+	for _, opts := range perConfig {
+		for _, arch := range archs {
+			bc, err := build.New(ctx, append(slices.Clone(opts), build.WithArch(arch))...)
+			if errors.Is(err, build.ErrSkipThisArch) {
+				log.Warnf("skipping arch %s", arch)
+				continue
+			} else if err != nil {
+				return err
+			}
+			defer bc.Close(ctx)
+
+			// The index is regenerated once per layer instead of by every build.
+			generateIndex = generateIndex || bc.GenerateIndex
+			bc.GenerateIndex = false
+
+			bcs = append(bcs, bc)
+		}
+	}
+
+	if len(bcs) == 0 {
+		log.Warn("target-architecture and --arch do not overlap, nothing to build")
+		return nil
+	}
+
+	layers, err := build.Layers(ctx, bcs)
+	if err != nil {
+		return err
+	}
+
+	for i, layer := range layers {
+		names := make([]string, 0, len(layer))
+		for _, bc := range layer {
+			names = append(names, fmt.Sprintf("%s/%s", bc.Arch.ToAPK(), bc.Configuration.Name()))
+		}
+		log.Infof("building layer %d/%d: %s", i+1, len(layers), strings.Join(names, " "))
+
+		var errg errgroup.Group
+		errg.SetLimit(max(jobs, 1))
+
+		if bcs[0].Interactive {
+			// Concurrent interactive debugging will break your terminal.
+			errg.SetLimit(1)
+		}
+
+		for _, bc := range layer {
+			bc := bc
+
+			// Packages from earlier layers are available from the shared repository.
+			if i > 0 {
+				repo, err := filepath.Abs(bc.OutDir)
+				if err != nil {
+					return err
+				}
+				bc.ExtraRepos = append(bc.ExtraRepos, repo)
+				if bc.SigningKey != "" {
+					bc.ExtraKeys = append(bc.ExtraKeys, bc.SigningKey+".pub")
+				}
+			}
+
+			errg.Go(func() error {
+				log := clog.New(slog.Default().Handler()).With("arch", bc.Arch.ToAPK(), "package", bc.Configuration.Name())
+				lctx := clog.WithLogger(ctx, log)
+
+				if err := bc.BuildPackage(lctx); err != nil {
+					if !bc.Remove {
+						log.Error("ERROR: failed to build package. the build environment has been preserved:")
+						bc.SummarizePaths(lctx)
+					}
+
+					return fmt.Errorf("failed to build package %s: %w", bc.Configuration.Name(), err)
+				}
+				return nil
+			})
+		}
+		if err := errg.Wait(); err != nil {
+			return err
+		}
+
+		// Only the last layer can skip the index when it was not requested.
+		if i == len(layers)-1 && !generateIndex {
+			continue
+		}
+
+		if err := generateLayerIndexes(ctx, layer); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// generateLayerIndexes regenerates the APKINDEX of every repository that
+// received packages from the given builds.
+func generateLayerIndexes(ctx context.Context, layer []*build.Build) error {
+	log := clog.FromContext(ctx)
+
+	seen := map[string]bool{}
+	for _, bc := range layer {
+		packageDir := filepath.Join(bc.OutDir, bc.Arch.ToAPK())
+		if seen[packageDir] {
+			continue
+		}
+		seen[packageDir] = true
+
+		log.Infof("generating apk index from packages in %s", packageDir)
+
+		idx, err := index.New(
+			index.WithPackageDir(packageDir),
+			index.WithSigningKey(bc.SigningKey),
+			index.WithMergeIndexFileFlag(true),
+			index.WithIndexFile(filepath.Join(packageDir, "APKINDEX.tar.gz")),
+		)
+		if err != nil {
+			return fmt.Errorf("unable to create index: %w", err)
+		}
+
+		if err := idx.GenerateIndex(ctx); err != nil {
+			return fmt.Errorf("unable to generate index: %w", err)
+		}
+
+		if err := idx.WriteJSONIndex(filepath.Join(packageDir, "APKINDEX.json")); err != nil {
+			return fmt.Errorf("unable to generate JSON index: %w", err)
+		}
+	}
+
+	return nil
+}
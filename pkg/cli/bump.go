@@ -15,6 +15,8 @@
 package cli
 
 import (
+	"os"
+
 	"github.com/spf13/cobra"
 
 	"chainguard.dev/melange/pkg/renovate"
@@ -23,6 +25,7 @@ import (
 
 func Bump() *cobra.Command {
 	var expectedCommit string
+	var gitMirrors map[string]string
 	cmd := &cobra.Command{
 		Use:     "bump",
 		Short:   "Update a Melange YAML file to reflect a new package version",
@@ -36,13 +39,19 @@ func Bump() *cobra.Command {
 				return err
 			}
 
-			bumpRenovator := bump.New(ctx,
+			opts := []bump.Option{
 				bump.WithTargetVersion(args[1]),
 				bump.WithExpectedCommit(expectedCommit),
-			)
+				bump.WithSummary(os.Stdout),
+			}
+			for repository, path := range gitMirrors {
+				opts = append(opts, bump.WithGitMirror(repository, path))
+			}
+			bumpRenovator := bump.New(ctx, opts...)
 			return rc.Renovate(cmd.Context(), bumpRenovator)
 		},
 	}
-	cmd.Flags().StringVar(&expectedCommit, "expected-commit", "", "optional flag to update the expected-commit value of a git-checkout pipeline")
+	cmd.Flags().StringVar(&expectedCommit, "expected-commit", "", "optional flag to set the expected-commit value of a git-checkout pipeline, rather than resolving it from the tag")
+	cmd.Flags().StringToStringVar(&gitMirrors, "git-mirror", nil, "local mirrors of git repositories to resolve tags in, as repository=path")
 	return cmd
 }
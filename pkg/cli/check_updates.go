@@ -0,0 +1,108 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/google/go-github/v54/github"
+	"github.com/spf13/cobra"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/renovate"
+	"chainguard.dev/melange/pkg/renovate/bump"
+	"chainguard.dev/melange/pkg/update"
+)
+
+func CheckUpdates() *cobra.Command {
+	var doBump bool
+	cmd := &cobra.Command{
+		Use:   "check-updates",
+		Short: "Check the upstream sources of Melange YAML files for new versions",
+		Long: `Check the upstream sources configured in the update block of Melange YAML
+files for new versions, and report the packages that are out of date.
+
+To prevent rate limiting, you can set the GITHUB_TOKEN env variable to a
+github token.`,
+		Example: `  melange check-updates config.yaml
+  melange check-updates --bump *.yaml`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			gh := github.NewClient(nil)
+			if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+				gh = github.NewTokenClient(ctx, token)
+			}
+			checker, err := update.New(update.WithGitHub(update.NewGitHubClient(gh)))
+			if err != nil {
+				return err
+			}
+			return CheckUpdatesCmd(ctx, checker, doBump, os.Stdout, args...)
+		},
+	}
+	cmd.Flags().BoolVar(&doBump, "bump", false, "bump the configurations that are out of date to the latest version")
+	return cmd
+}
+
+// CheckUpdatesCmd writes the packages of the configuration files that are out
+// of date to w, and with doBump, bumps them to the latest version.
+func CheckUpdatesCmd(ctx context.Context, checker *update.Checker, doBump bool, w io.Writer, configFiles ...string) error {
+	log := clog.FromContext(ctx)
+
+	errs := []error{}
+	for _, configFile := range configFiles {
+		cfg, err := config.ParseConfiguration(ctx, configFile)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("parsing %s: %w", configFile, err))
+			continue
+		}
+
+		result, err := checker.Check(ctx, cfg)
+		if errors.Is(err, update.ErrNotMonitored) {
+			log.Infof("skipping %s: %v", configFile, err)
+			continue
+		} else if err != nil {
+			errs = append(errs, fmt.Errorf("checking %s: %w", configFile, err))
+			continue
+		}
+
+		if !result.UpdateAvailable {
+			log.Infof("%s %s is up to date", result.Package, result.Current)
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%s: %s -> %s\n", result.Package, result.Current, result.Latest); err != nil {
+			return err
+		}
+
+		if !doBump {
+			continue
+		}
+		rc, err := renovate.New(renovate.WithConfig(configFile))
+		if err != nil {
+			return err
+		}
+		if err := rc.Renovate(ctx, bump.New(ctx, bump.WithTargetVersion(result.Latest), bump.WithSummary(w))); err != nil {
+			errs = append(errs, fmt.Errorf("bumping %s: %w", configFile, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -53,13 +53,18 @@ func New() *cobra.Command {
 
 	cmd.AddCommand(Build())
 	cmd.AddCommand(Bump())
+	cmd.AddCommand(CheckUpdates())
 	cmd.AddCommand(Completion())
 	cmd.AddCommand(Compile())
 	cmd.AddCommand(Convert())
+	cmd.AddCommand(DiffPackages())
+	cmd.AddCommand(Fmt())
 	cmd.AddCommand(Index())
 	cmd.AddCommand(Keygen())
 	cmd.AddCommand(Lint())
+	cmd.AddCommand(LintConfig())
 	cmd.AddCommand(PackageVersion())
+	cmd.AddCommand(Pipelines())
 	cmd.AddCommand(Query())
 	cmd.AddCommand(Scan())
 	cmd.AddCommand(Sign())
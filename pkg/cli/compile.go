@@ -25,6 +25,7 @@ import (
 
 	apko_types "chainguard.dev/apko/pkg/build/types"
 	"chainguard.dev/melange/pkg/build"
+	"chainguard.dev/melange/pkg/config"
 	"github.com/spf13/cobra"
 	"go.opentelemetry.io/otel"
 )
@@ -33,6 +34,7 @@ func Compile() *cobra.Command {
 	var buildDate string
 	var workspaceDir string
 	var pipelineDir string
+	var includeDirs []string
 	var sourceDir string
 	var cacheDir string
 	var cacheSource string
@@ -52,6 +54,9 @@ func Compile() *cobra.Command {
 	var varsFile string
 	var purlNamespace string
 	var buildOption []string
+	var variantSelectors []string
+	var allowUnresolved bool
+	var strict bool
 	var logPolicy []string
 	var createBuildLog bool
 	var debug bool
@@ -100,6 +105,8 @@ func Compile() *cobra.Command {
 				build.WithVarsFile(varsFile),
 				build.WithNamespace(purlNamespace),
 				build.WithEnabledBuildOptions(buildOption),
+				build.WithAllowUnresolved(allowUnresolved),
+				build.WithStrict(strict),
 				build.WithCreateBuildLog(createBuildLog),
 				build.WithDebug(debug),
 				build.WithDebugRunner(debugRunner),
@@ -110,6 +117,10 @@ func Compile() *cobra.Command {
 				build.WithTimeout(timeout),
 			}
 
+			for _, dir := range includeDirs {
+				options = append(options, build.WithIncludeDir(dir))
+			}
+
 			if len(args) > 0 {
 				options = append(options, build.WithConfig(args[0]))
 
@@ -118,6 +129,27 @@ func Compile() *cobra.Command {
 				}
 			}
 
+			if len(variantSelectors) > 0 {
+				if len(args) == 0 {
+					return fmt.Errorf("--variant requires a configuration file")
+				}
+				selector, err := config.ParseVariantSelector(variantSelectors)
+				if err != nil {
+					return err
+				}
+				variants, err := configVariants(ctx, args[0], selector, includeDirs)
+				if err != nil {
+					return err
+				}
+				if variants == nil {
+					return fmt.Errorf("%s has no variants to select with --variant", args[0])
+				}
+				if len(variants) != 1 {
+					return fmt.Errorf("--variant must select a single variant of %s, %d match", args[0], len(variants))
+				}
+				options = append(options, build.WithVariant(variants[0]))
+			}
+
 			if sourceDir != "" {
 				options = append(options, build.WithSourceDir(sourceDir))
 			}
@@ -145,6 +177,7 @@ func Compile() *cobra.Command {
 	cmd.Flags().StringVar(&buildDate, "build-date", "", "date used for the timestamps of the files inside the image")
 	cmd.Flags().StringVar(&workspaceDir, "workspace-dir", "", "directory used for the workspace at /home/build")
 	cmd.Flags().StringVar(&pipelineDir, "pipeline-dir", "", "directory used to extend defined built-in pipelines")
+	cmd.Flags().StringSliceVar(&includeDirs, "include-dir", []string{}, "directories searched for files included by the configuration that are not found relative to it")
 	cmd.Flags().StringVar(&sourceDir, "source-dir", "", "directory used for included sources")
 	cmd.Flags().StringVar(&cacheDir, "cache-dir", "./melange-cache/", "directory used for cached inputs")
 	cmd.Flags().StringVar(&cacheSource, "cache-source", "", "directory or bucket used for preloading the cache")
@@ -161,6 +194,9 @@ func Compile() *cobra.Command {
 	cmd.Flags().StringVar(&overlayBinSh, "overlay-binsh", "", "use specified file as /bin/sh overlay in build environment")
 	cmd.Flags().StringVar(&purlNamespace, "namespace", "unknown", "namespace to use in package URLs in SBOM (eg wolfi, alpine)")
 	cmd.Flags().StringSliceVar(&buildOption, "build-option", []string{}, "build options to enable")
+	cmd.Flags().StringSliceVar(&variantSelectors, "variant", []string{}, "variable=value pairs selecting the variant of the configuration to compile -- default is the first")
+	cmd.Flags().BoolVar(&allowUnresolved, "allow-unresolved", false, "allow references to variables that are not defined, leaving them in place with a warning")
+	cmd.Flags().BoolVar(&strict, "strict", inCI(), "require the configuration to conform to its schema, rather than warning about the problems -- default is true when $CI is true")
 	cmd.Flags().StringSliceVar(&logPolicy, "log-policy", []string{"builtin:stderr"}, "logging policy to use")
 	cmd.Flags().StringVar(&runner, "runner", "", fmt.Sprintf("which runner to use to enable running commands, default is based on your platform. Options are %q", build.GetAllRunners()))
 	cmd.Flags().StringSliceVarP(&extraKeys, "keyring-append", "k", []string{}, "path to extra keys to include in the build environment keyring")
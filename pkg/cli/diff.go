@@ -0,0 +1,88 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel"
+
+	"chainguard.dev/melange/pkg/apkdiff"
+)
+
+func DiffPackages() *cobra.Command {
+	var format string
+
+	cmd := &cobra.Command{
+		Use:     "diff",
+		Short:   "Compare two APKs or two package repositories",
+		Long:    `Compare two APK files, or two directories of APK files such as package repositories, and report added, removed and changed files, .PKGINFO fields and SBOM packages.`,
+		Example: `  melange diff [old.apk new.apk | old-dir new-dir]`,
+		Args:    cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return DiffPackagesCmd(cmd.Context(), args[0], args[1], format, os.Stdout)
+		},
+	}
+
+	cmd.Flags().StringVar(&format, "format", "text", "output format, one of text or json")
+
+	return cmd
+}
+
+// DiffPackagesCmd compares two apks or two directories of apks and writes
+// the report to w.
+func DiffPackagesCmd(ctx context.Context, oldPath, newPath, format string, w io.Writer) error {
+	ctx, span := otel.Tracer("melange").Start(ctx, "DiffPackagesCmd")
+	defer span.End()
+
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown format %q, expected text or json", format)
+	}
+
+	oldInfo, err := os.Stat(oldPath)
+	if err != nil {
+		return err
+	}
+	newInfo, err := os.Stat(newPath)
+	if err != nil {
+		return err
+	}
+
+	var report *apkdiff.Report
+	switch {
+	case oldInfo.IsDir() && newInfo.IsDir():
+		report, err = apkdiff.CompareDirs(ctx, oldPath, newPath)
+	case !oldInfo.IsDir() && !newInfo.IsDir():
+		report, err = apkdiff.ComparePackages(ctx, oldPath, newPath)
+	default:
+		return fmt.Errorf("%s and %s must both be APK files or both be directories", oldPath, newPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	return report.WriteText(w)
+}
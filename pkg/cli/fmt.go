@@ -0,0 +1,87 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/spf13/cobra"
+
+	"chainguard.dev/melange/pkg/renovate"
+)
+
+func Fmt() *cobra.Command {
+	var check bool
+	cmd := &cobra.Command{
+		Use:   "fmt",
+		Short: "Format Melange YAML files",
+		Long: `Format Melange YAML files in canonical form, with the keys in the order of
+the fields of the configuration, keeping comments.`,
+		Example: `  melange fmt config.yaml
+  melange fmt --check *.yaml`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return FmtCmd(cmd.Context(), check, args...)
+		},
+	}
+	cmd.Flags().BoolVar(&check, "check", false, "report the files that are not formatted, rather than formatting them, and fail if there are any")
+	return cmd
+}
+
+// FmtCmd formats the configuration files, or with check, reports those that
+// are not formatted.
+func FmtCmd(ctx context.Context, check bool, configFiles ...string) error {
+	log := clog.FromContext(ctx)
+
+	unformatted := []string{}
+	for _, configFile := range configFiles {
+		src, err := os.ReadFile(configFile)
+		if err != nil {
+			return err
+		}
+
+		var buf bytes.Buffer
+		if err := renovate.Format(&buf, src); err != nil {
+			return fmt.Errorf("formatting %s: %w", configFile, err)
+		}
+		if bytes.Equal(src, buf.Bytes()) {
+			continue
+		}
+
+		if check {
+			log.Warnf("%s is not formatted", configFile)
+			unformatted = append(unformatted, configFile)
+			continue
+		}
+
+		info, err := os.Stat(configFile)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(configFile, buf.Bytes(), info.Mode()); err != nil {
+			return err
+		}
+		log.Infof("formatted %s", configFile)
+	}
+
+	if len(unformatted) > 0 {
+		return fmt.Errorf("%d of %d files are not formatted, run melange fmt to format them", len(unformatted), len(configFiles))
+	}
+	return nil
+}
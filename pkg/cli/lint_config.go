@@ -0,0 +1,92 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/configlint"
+)
+
+func LintConfig() *cobra.Command {
+	var format string
+	cmd := &cobra.Command{
+		Use:   "lint-config",
+		Short: "Check Melange YAML files for hygiene problems",
+		Long: `Check Melange YAML files for hygiene problems, such as sources fetched without
+checksums.  A rule can be disabled for a configuration by listing it in
+package.checks.disabled.
+
+The rules are: ` + strings.Join(configlint.Rules(), ", ") + `.`,
+		Example: `  melange lint-config config.yaml
+  melange lint-config --format sarif *.yaml > lint.sarif`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return LintConfigCmd(cmd.Context(), format, os.Stdout, args...)
+		},
+	}
+	cmd.Flags().StringVar(&format, "format", "text", "output format, text or sarif")
+	return cmd
+}
+
+// LintConfigCmd writes the findings of the rules for the configuration files
+// to w in format, and fails if there are any.
+func LintConfigCmd(ctx context.Context, format string, w io.Writer, configFiles ...string) error {
+	if format != "text" && format != "sarif" {
+		return fmt.Errorf("unknown format %q, expected text or sarif", format)
+	}
+
+	findings := map[string][]configlint.Finding{}
+	total := 0
+	for _, configFile := range configFiles {
+		cfg, err := config.ParseConfiguration(ctx, configFile, config.WithAllowUnresolved(true))
+		if err != nil {
+			return fmt.Errorf("parsing %s: %w", configFile, err)
+		}
+		findings[configFile] = configlint.Lint(cfg)
+		total += len(findings[configFile])
+	}
+
+	switch format {
+	case "sarif":
+		if err := configlint.WriteSARIF(w, findings); err != nil {
+			return err
+		}
+	default:
+		for _, configFile := range configFiles {
+			for _, f := range findings[configFile] {
+				sep := ":"
+				if f.Position == nil {
+					sep = ": "
+				}
+				if _, err := fmt.Fprintf(w, "%s%s%s\n", configFile, sep, f); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if total > 0 {
+		return fmt.Errorf("%d problems found", total)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel"
+
+	"chainguard.dev/melange/pkg/build"
+)
+
+func Pipelines() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "pipelines",
+		Short: "List and describe the pipelines steps can use",
+		Long: `List and describe the reusable pipelines that steps can refer to with uses.
+
+Pipelines are looked up in the pipeline directories, in the order they are
+given, then in ` + BuiltinPipelineDir + `, and finally among the pipelines
+built into melange.  The first pipeline found with a name is used.`,
+	}
+
+	cmd.AddCommand(PipelinesList())
+	cmd.AddCommand(PipelinesDescribe())
+
+	return cmd
+}
+
+func PipelinesList() *cobra.Command {
+	var pipelineDirs []string
+	var format string
+
+	cmd := &cobra.Command{
+		Use:     "list",
+		Short:   "List the pipelines steps can use",
+		Example: `  melange pipelines list --pipeline-dir ./pipelines`,
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return PipelinesListCmd(cmd.Context(), append(pipelineDirs, BuiltinPipelineDir), format, os.Stdout)
+		},
+	}
+
+	cmd.Flags().StringSliceVar(&pipelineDirs, "pipeline-dir", []string{}, "directories used to extend defined built-in pipelines")
+	cmd.Flags().StringVar(&format, "format", "text", "output format, one of text or json")
+
+	return cmd
+}
+
+func PipelinesDescribe() *cobra.Command {
+	var pipelineDirs []string
+	var format string
+
+	cmd := &cobra.Command{
+		Use:     "describe",
+		Short:   "Describe a pipeline and the inputs it takes",
+		Example: `  melange pipelines describe go/build`,
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return PipelinesDescribeCmd(cmd.Context(), append(pipelineDirs, BuiltinPipelineDir), args[0], format, os.Stdout)
+		},
+	}
+
+	cmd.Flags().StringSliceVar(&pipelineDirs, "pipeline-dir", []string{}, "directories used to extend defined built-in pipelines")
+	cmd.Flags().StringVar(&format, "format", "text", "output format, one of text or json")
+
+	return cmd
+}
+
+// PipelinesListCmd writes the pipelines found in pipelineDirs and among the
+// built-in pipelines to w.
+func PipelinesListCmd(ctx context.Context, pipelineDirs []string, format string, w io.Writer) error {
+	ctx, span := otel.Tracer("melange").Start(ctx, "PipelinesListCmd")
+	defer span.End()
+
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown format %q, expected text or json", format)
+	}
+
+	infos, err := build.ListPipelines(ctx, pipelineDirs)
+	if err != nil {
+		return err
+	}
+
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(infos)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSOURCE\tDESCRIPTION")
+	for _, info := range infos {
+		source := info.Source
+		if len(info.Shadows) > 0 {
+			source += fmt.Sprintf(" (shadows %s)", strings.Join(info.Shadows, ", "))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", info.Name, source, info.Description)
+	}
+	return tw.Flush()
+}
+
+// PipelinesDescribeCmd writes the pipeline that steps using name would use,
+// and the inputs it takes, to w.
+func PipelinesDescribeCmd(ctx context.Context, pipelineDirs []string, name, format string, w io.Writer) error {
+	ctx, span := otel.Tracer("melange").Start(ctx, "PipelinesDescribeCmd")
+	defer span.End()
+
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown format %q, expected text or json", format)
+	}
+
+	info, err := build.DescribePipeline(ctx, pipelineDirs, name)
+	if err != nil {
+		return err
+	}
+
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(info)
+	}
+
+	fmt.Fprintf(w, "Name:        %s\n", info.Name)
+	if info.Description != "" {
+		fmt.Fprintf(w, "Description: %s\n", info.Description)
+	}
+	fmt.Fprintf(w, "Source:      %s\n", info.Source)
+	if len(info.Shadows) > 0 {
+		fmt.Fprintf(w, "Shadows:     %s\n", strings.Join(info.Shadows, ", "))
+	}
+	if len(info.Needs) > 0 {
+		fmt.Fprintf(w, "Needs:       %s\n", strings.Join(info.Needs, ", "))
+	}
+
+	if len(info.Inputs) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(info.Inputs))
+	for k := range info.Inputs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "\nInputs:")
+	for _, k := range names {
+		input := info.Inputs[k]
+
+		typ := input.Type
+		if typ == "" {
+			typ = "string"
+		}
+		attrs := []string{typ}
+		if input.Required {
+			attrs = append(attrs, "required")
+		}
+		if input.Default != "" {
+			attrs = append(attrs, fmt.Sprintf("default: %q", input.Default))
+		}
+		if len(input.Values) > 0 {
+			attrs = append(attrs, "values: "+strings.Join(input.Values, ", "))
+		}
+		if input.Pattern != "" {
+			attrs = append(attrs, "pattern: "+input.Pattern)
+		}
+		if input.Deprecated != "" {
+			attrs = append(attrs, "deprecated")
+		}
+		fmt.Fprintf(w, "  %s (%s)\n", k, strings.Join(attrs, ", "))
+
+		for _, line := range strings.Split(strings.TrimSpace(input.Description), "\n") {
+			if line != "" {
+				fmt.Fprintf(w, "      %s\n", strings.TrimRight(line, " "))
+			}
+		}
+		if input.Deprecated != "" {
+			fmt.Fprintf(w, "      Deprecated: %s\n", input.Deprecated)
+		}
+	}
+
+	return nil
+}
@@ -15,7 +15,6 @@
 package cli
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"fmt"
@@ -31,6 +30,7 @@ import (
 	"chainguard.dev/apko/pkg/apk/expandapk"
 	"chainguard.dev/melange/pkg/build"
 	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/pkginfo"
 	"chainguard.dev/melange/pkg/sca"
 	"github.com/chainguard-dev/clog"
 	"github.com/spf13/cobra"
@@ -128,19 +128,19 @@ func scanCmd(ctx context.Context, file string, sc *scanConfig) error {
 		if err != nil {
 			return err
 		}
-		info, err := parsePkgInfo(bytes.NewReader(b))
+		info, err := pkginfo.Parse(bytes.NewReader(b))
 		if err != nil {
 			return fmt.Errorf("parsing .PKGINFO: %w", err)
 		}
 
-		pkg.Commit = info.commit
+		pkg.Commit = info.Get("commit")
 
-		installedSize, err := strconv.ParseInt(info.size, 10, 64)
+		installedSize, err := strconv.ParseInt(info.Get("size"), 10, 64)
 		if err != nil {
 			return err
 		}
 
-		dir, err := os.MkdirTemp("", info.pkgname)
+		dir, err := os.MkdirTemp("", info.Get("pkgname"))
 		if err != nil {
 			return fmt.Errorf("mkdirtemp: %w", err)
 		}
@@ -150,6 +150,7 @@ func scanCmd(ctx context.Context, file string, sc *scanConfig) error {
 			WorkspaceDir:    dir,
 			SourceDateEpoch: time.Unix(0, 0),
 			Configuration:   *cfg,
+			InputHash:       info.Get("inputhash"),
 		}
 
 		pb := build.PackageBuild{
@@ -164,21 +165,21 @@ func scanCmd(ctx context.Context, file string, sc *scanConfig) error {
 			URL:           pkg.URL,
 			Commit:        pkg.Commit,
 			InstalledSize: installedSize,
-			DataHash:      info.datahash,
-			Arch:          info.arch,
+			DataHash:      info.Get("datahash"),
+			Arch:          info.Get("arch"),
 		}
 
-		if info.builddate != "" {
-			sec, err := strconv.ParseInt(info.builddate, 10, 64)
+		if info.Get("builddate") != "" {
+			sec, err := strconv.ParseInt(info.Get("builddate"), 10, 64)
 			if err != nil {
-				return fmt.Errorf("parsing %q as timestamp: %w", info.builddate, err)
+				return fmt.Errorf("parsing %q as timestamp: %w", info.Get("builddate"), err)
 			}
 			pb.Build.SourceDateEpoch = time.Unix(sec, 0)
 		}
 
 		subpkgs := map[string]build.PackageBuild{}
 		controls := map[string][]byte{}
-		infos := map[string]*pkginfo{}
+		infos := map[string]pkginfo.PkgInfo{}
 
 		for _, subpkg := range cfg.Subpackages {
 			u := fmt.Sprintf("%s/%s/%s-%s-r%d.apk", sc.repo, arch, subpkg.Name, pkg.Version, pkg.Epoch)
@@ -219,7 +220,7 @@ func scanCmd(ctx context.Context, file string, sc *scanConfig) error {
 			if err != nil {
 				return err
 			}
-			info, err := parsePkgInfo(bytes.NewReader(b))
+			info, err := pkginfo.Parse(bytes.NewReader(b))
 			if err != nil {
 				return fmt.Errorf("parsing .PKGINFO: %w", err)
 			}
@@ -227,9 +228,9 @@ func scanCmd(ctx context.Context, file string, sc *scanConfig) error {
 			infos[subpkg.Name] = info
 			controls[subpkg.Name] = b
 
-			subpkg.Commit = info.commit
+			subpkg.Commit = info.Get("commit")
 
-			installedSize, err := strconv.ParseInt(info.size, 10, 64)
+			installedSize, err := strconv.ParseInt(info.Get("size"), 10, 64)
 			if err != nil {
 				return err
 			}
@@ -246,16 +247,16 @@ func scanCmd(ctx context.Context, file string, sc *scanConfig) error {
 				URL:           subpkg.URL,
 				Commit:        subpkg.Commit,
 				InstalledSize: installedSize,
-				DataHash:      info.datahash,
-				Arch:          info.arch,
+				DataHash:      info.Get("datahash"),
+				Arch:          info.Get("arch"),
 			}
 
 			subpkgs[subpkg.Name] = pb
 
-			if info.builddate != "" {
-				sec, err := strconv.ParseInt(info.builddate, 10, 64)
+			if info.Get("builddate") != "" {
+				sec, err := strconv.ParseInt(info.Get("builddate"), 10, 64)
 				if err != nil {
-					return fmt.Errorf("parsing %q as timestamp: %w", info.builddate, err)
+					return fmt.Errorf("parsing %q as timestamp: %w", info.Get("builddate"), err)
 				}
 				pb.Build.SourceDateEpoch = time.Unix(sec, 0)
 			}
@@ -286,7 +287,7 @@ func scanCmd(ctx context.Context, file string, sc *scanConfig) error {
 
 			if sc.diff {
 				b := controls[subpkg.Name]
-				old := fmt.Sprintf("%s-%s.apk", info.pkgname, info.pkgver)
+				old := fmt.Sprintf("%s-%s.apk", info.Get("pkgname"), info.Get("pkgver"))
 
 				diff := Diff(old, b, file, generated, sc.comments)
 				if diff != nil {
@@ -315,7 +316,7 @@ func scanCmd(ctx context.Context, file string, sc *scanConfig) error {
 		generated := buf.Bytes()
 
 		if sc.diff {
-			old := fmt.Sprintf("%s-%s.apk", info.pkgname, info.pkgver)
+			old := fmt.Sprintf("%s-%s.apk", info.Get("pkgname"), info.Get("pkgver"))
 			diff := Diff(old, b, file, generated, sc.comments)
 			if diff != nil {
 				sawDiff = true
@@ -333,69 +334,6 @@ func scanCmd(ctx context.Context, file string, sc *scanConfig) error {
 	return nil
 }
 
-type pkginfo struct {
-	pkgname   string
-	pkgver    string
-	size      string
-	arch      string
-	origin    string
-	pkgdesc   string
-	url       string
-	commit    string
-	builddate string
-	license   string
-	triggers  string
-	datahash  string
-}
-
-// TODO: import "gopkg.in/ini.v1"
-func parsePkgInfo(in io.Reader) (*pkginfo, error) {
-	scanner := bufio.NewScanner(in)
-
-	pkg := pkginfo{}
-
-	for scanner.Scan() {
-		line := scanner.Text()
-
-		before, after, ok := strings.Cut(line, "=")
-		if !ok {
-			continue
-		}
-
-		before = strings.TrimSpace(before)
-		after = strings.TrimSpace(after)
-
-		switch before {
-		case "pkgname":
-			pkg.pkgname = after
-		case "pkgver":
-			pkg.pkgver = after
-		case "arch":
-			pkg.arch = after
-		case "size":
-			pkg.size = after
-		case "origin":
-			pkg.origin = after
-		case "pkgdesc":
-			pkg.pkgdesc = after
-		case "url":
-			pkg.url = after
-		case "commit":
-			pkg.commit = after
-		case "builddate":
-			pkg.builddate = after
-		case "license":
-			pkg.license = after
-		case "triggers":
-			pkg.triggers = after
-		case "datahash":
-			pkg.datahash = after
-		}
-	}
-
-	return &pkg, scanner.Err()
-}
-
 // Based on pkg/build/sca_interface but swapping out dirfs for tarfs
 type scaImpl struct {
 	pb   *build.PackageBuild
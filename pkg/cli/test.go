@@ -46,6 +46,8 @@ func Test() *cobra.Command {
 	var debug bool
 	var debugRunner bool
 	var interactive bool
+	var strict bool
+	var allowUnresolved bool
 	var runner string
 	var extraTestPackages []string
 
@@ -78,6 +80,8 @@ func Test() *cobra.Command {
 				build.WithTestDebug(debug),
 				build.WithTestDebugRunner(debugRunner),
 				build.WithTestInteractive(interactive),
+				build.WithTestStrict(strict),
+				build.WithTestAllowUnresolved(allowUnresolved),
 			}
 
 			if len(args) > 0 {
@@ -127,6 +131,8 @@ func Test() *cobra.Command {
 	cmd.Flags().BoolVar(&debug, "debug", false, "enables debug logging of test pipelines (sets -x for steps)")
 	cmd.Flags().BoolVar(&debugRunner, "debug-runner", false, "when enabled, the builder pod will persist after the build succeeds or fails")
 	cmd.Flags().BoolVarP(&interactive, "interactive", "i", false, "when enabled, attaches stdin with a tty to the pod on failure")
+	cmd.Flags().BoolVar(&strict, "strict", inCI(), "require the configuration to conform to its schema, rather than warning about the problems -- default is true when $CI is true")
+	cmd.Flags().BoolVar(&allowUnresolved, "allow-unresolved", false, "allow references to variables that are not defined, leaving them in place with a warning")
 	cmd.Flags().StringSliceVarP(&extraRepos, "repository-append", "r", []string{}, "path to extra repositories to include in the build environment")
 	cmd.Flags().StringSliceVar(&extraTestPackages, "test-package-append", []string{}, "extra packages to install for each of the test environments")
 
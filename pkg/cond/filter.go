@@ -0,0 +1,94 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cond
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A Filter transforms the value of a variable, e.g. | replace(".", "_").
+type Filter struct {
+	Name string
+	Args []string
+}
+
+type filter struct {
+	// The number of arguments the filter takes
+	args  int
+	apply func(value string, args []string) (string, error)
+}
+
+var filters = map[string]filter{
+	"major": {apply: versionComponent(0)},
+	"minor": {apply: versionComponent(1)},
+	"patch": {apply: versionComponent(2)},
+	"lower": {apply: func(value string, _ []string) (string, error) {
+		return strings.ToLower(value), nil
+	}},
+	"upper": {apply: func(value string, _ []string) (string, error) {
+		return strings.ToUpper(value), nil
+	}},
+	"replace": {args: 2, apply: func(value string, args []string) (string, error) {
+		return strings.ReplaceAll(value, args[0], args[1]), nil
+	}},
+	"trimprefix": {args: 1, apply: func(value string, args []string) (string, error) {
+		return strings.TrimPrefix(value, args[0]), nil
+	}},
+	"trimsuffix": {args: 1, apply: func(value string, args []string) (string, error) {
+		return strings.TrimSuffix(value, args[0]), nil
+	}},
+	"sha256": {apply: func(value string, _ []string) (string, error) {
+		sum := sha256.Sum256([]byte(value))
+		return hex.EncodeToString(sum[:]), nil
+	}},
+	"sha512": {apply: func(value string, _ []string) (string, error) {
+		sum := sha512.Sum512([]byte(value))
+		return hex.EncodeToString(sum[:]), nil
+	}},
+}
+
+func filterNames() []string {
+	names := make([]string, 0, len(filters))
+	for name := range filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// versionComponent returns a filter that extracts the leading digits of the
+// i-th dot separated component of a version, e.g. 3 from 1.2.3_rc1.
+func versionComponent(i int) func(string, []string) (string, error) {
+	return func(value string, _ []string) (string, error) {
+		parts := strings.Split(strings.TrimPrefix(value, "v"), ".")
+		if i >= len(parts) {
+			return "", fmt.Errorf("version %q has fewer than %d components", value, i+1)
+		}
+
+		n := strings.IndexFunc(parts[i], func(r rune) bool { return r < '0' || r > '9' })
+		if n < 0 {
+			n = len(parts[i])
+		}
+		if n == 0 {
+			return "", fmt.Errorf("component %d of version %q is not a number", i+1, value)
+		}
+		return parts[i][:n], nil
+	}
+}
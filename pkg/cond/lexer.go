@@ -0,0 +1,181 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cond
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Error is an error in an expression.
+type Error struct {
+	// The column of the expression the error is at, starting from 1
+	Column int
+	Msg    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("column %d: %s", e.Column, e.Msg)
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenString
+	tokenVariable
+	tokenIdent
+	tokenOp
+)
+
+type token struct {
+	kind tokenKind
+	// The operator, identifier, variable name or unquoted string
+	text string
+	// The offset of the token in the expression
+	pos int
+	// The variable, with its filters
+	v *Variable
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of expression"
+	case tokenString:
+		return strconv.Quote(t.text)
+	case tokenVariable:
+		return t.v.Text
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+// Longer operators come first, so they are preferred to their prefixes.
+var operators = []string{"&&", "||", "==", "!=", "=~", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ","}
+
+func isVariableChar(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_'
+}
+
+func isIdentChar(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_'
+}
+
+// column returns the column of the offset pos in input.
+func column(input string, pos int) int {
+	return utf8.RuneCountInString(input[:pos]) + 1
+}
+
+// lex splits an expression into tokens, ending with a tokenEOF.
+func lex(input string) ([]token, error) {
+	var tokens []token
+
+	errorf := func(pos int, format string, args ...any) error {
+		return &Error{Column: column(input, pos), Msg: fmt.Sprintf(format, args...)}
+	}
+
+	pos := 0
+	for {
+		for pos < len(input) {
+			r, size := utf8.DecodeRuneInString(input[pos:])
+			if !unicode.IsSpace(r) {
+				break
+			}
+			pos += size
+		}
+		if pos == len(input) {
+			return append(tokens, token{kind: tokenEOF, pos: pos}), nil
+		}
+
+		rest := input[pos:]
+		switch {
+		case rest[0] == '\'' || rest[0] == '"':
+			s, n, err := lexString(rest)
+			if err != nil {
+				return nil, errorf(pos, "%v", err)
+			}
+			tokens = append(tokens, token{kind: tokenString, text: s, pos: pos})
+			pos += n
+
+		case strings.HasPrefix(rest, "${{"):
+			v, n, err := parseVariable(rest)
+			if err != nil {
+				return nil, errorf(pos, "%v", err)
+			}
+			v.Offset = pos
+			tokens = append(tokens, token{kind: tokenVariable, text: v.Name, pos: pos, v: v})
+			pos += n
+
+		case isIdentChar(rune(rest[0])):
+			n := strings.IndexFunc(rest, func(r rune) bool { return !isIdentChar(r) })
+			if n < 0 {
+				n = len(rest)
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: rest[:n], pos: pos})
+			pos += n
+
+		default:
+			op := ""
+			for _, o := range operators {
+				if strings.HasPrefix(rest, o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				r, _ := utf8.DecodeRuneInString(rest)
+				return nil, errorf(pos, "unexpected character %q", r)
+			}
+			tokens = append(tokens, token{kind: tokenOp, text: op, pos: pos})
+			pos += len(op)
+		}
+	}
+}
+
+// lexString reads the quoted string at the start of s, returning its value
+// and length.  Double quoted strings use Go's escape sequences, as produced
+// by strconv.Quote.  In single quoted strings, a backslash escapes the
+// following character.
+func lexString(s string) (string, int, error) {
+	quote := s[0]
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case quote:
+			if quote == '"' {
+				v, err := strconv.Unquote(s[:i+1])
+				if err != nil {
+					return "", 0, fmt.Errorf("invalid string %s", s[:i+1])
+				}
+				return v, i + 1, nil
+			}
+
+			var b strings.Builder
+			for j := 1; j < i; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+				b.WriteByte(s[j])
+			}
+			return b.String(), i + 1, nil
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
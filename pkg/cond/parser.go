@@ -16,104 +16,408 @@ package cond
 
 import (
 	"fmt"
+	"regexp"
+	"slices"
+	"strings"
 
-	"github.com/ijt/goparsify"
+	"chainguard.dev/apko/pkg/apk/apk"
 )
 
-func combineOp(n *goparsify.Result) {
-	switch n.Child[1].Token {
-	case "&&":
-		n.Result = n.Child[0].Result == true && n.Child[2].Result == true
-	case "||":
-		n.Result = n.Child[0].Result == true || n.Child[2].Result == true
-	default:
-		panic(fmt.Errorf("unrecognized op"))
+// A VariableLookupFunction designates how variables should be
+// resolved when evaluating expressions.
+type VariableLookupFunction func(key string) (string, error)
+
+// NullLookup returns an empty value for any requested variable and
+// does not return an error.  This is the default variable lookup
+// function used by Evaluate.
+func NullLookup(key string) (string, error) {
+	return "", nil
+}
+
+// functions are the functions expressions can call, by name.  They all take
+// two strings.
+var functions = map[string]func(s, t string) bool{
+	"startsWith": strings.HasPrefix,
+	"endsWith":   strings.HasSuffix,
+	"contains":   strings.Contains,
+}
+
+var comparisons = []string{"==", "!=", "=~", "<", "<=", ">", ">="}
+
+// evaluator holds what is needed to evaluate a parsed expression.
+type evaluator struct {
+	input  string
+	lookup VariableLookupFunction
+}
+
+func (e *evaluator) errorf(t token, format string, args ...any) error {
+	return &Error{Column: column(e.input, t.pos), Msg: fmt.Sprintf(format, args...)}
+}
+
+type expr interface {
+	eval(e *evaluator) (bool, error)
+}
+
+// operand is a string or a variable.
+type operand token
+
+func (o operand) value(e *evaluator) (string, error) {
+	if o.kind != tokenVariable {
+		return o.text, nil
+	}
+	v, err := e.lookup(o.text)
+	if err != nil {
+		return "", e.errorf(token(o), "looking up %s: %v", token(o), err)
+	}
+	if v, err = o.v.Apply(v); err != nil {
+		return "", e.errorf(token(o), "%v", err)
 	}
+	return v, nil
 }
 
-func collapseOp(n *goparsify.Result) {
-	n.Result = true
-	for _, child := range n.Child {
-		if child.Result != true {
-			n.Result = false
-			return
-		}
+type orExpr struct {
+	l, r expr
+}
+
+func (x *orExpr) eval(e *evaluator) (bool, error) {
+	l, err := x.l.eval(e)
+	if err != nil || l {
+		return l, err
+	}
+	return x.r.eval(e)
+}
+
+type andExpr struct {
+	l, r expr
+}
+
+func (x *andExpr) eval(e *evaluator) (bool, error) {
+	l, err := x.l.eval(e)
+	if err != nil || !l {
+		return false, err
 	}
+	return x.r.eval(e)
+}
+
+type notExpr struct {
+	x expr
+}
+
+func (x *notExpr) eval(e *evaluator) (bool, error) {
+	v, err := x.x.eval(e)
+	return !v, err
+}
+
+type compareExpr struct {
+	op   token
+	l, r operand
 }
 
-func comparisonOp(n *goparsify.Result) {
-	switch n.Child[1].Token {
+func (x *compareExpr) eval(e *evaluator) (bool, error) {
+	l, err := x.l.value(e)
+	if err != nil {
+		return false, err
+	}
+	r, err := x.r.value(e)
+	if err != nil {
+		return false, err
+	}
+
+	switch x.op.text {
 	case "==":
-		n.Result = n.Child[0].Token == n.Child[2].Token
+		return l == r, nil
 	case "!=":
-		n.Result = n.Child[0].Token != n.Child[2].Token
+		return l != r, nil
+	case "=~":
+		re, err := regexp.Compile(r)
+		if err != nil {
+			return false, e.errorf(token(x.r), "invalid regular expression: %v", err)
+		}
+		return re.MatchString(l), nil
+	}
+
+	lv, err := apk.ParseVersion(l)
+	if err != nil {
+		return false, e.errorf(token(x.l), "invalid version %q", l)
+	}
+	rv, err := apk.ParseVersion(r)
+	if err != nil {
+		return false, e.errorf(token(x.r), "invalid version %q", r)
+	}
+	c := apk.CompareVersions(lv, rv)
+
+	switch x.op.text {
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	case ">=":
+		return c >= 0, nil
 	default:
-		panic(fmt.Errorf("unrecognized op"))
+		return false, e.errorf(x.op, "unrecognized operator %q", x.op.text)
 	}
 }
 
-// A VariableLookupFunction designates how variables should be
-// resolved when evaluating expressions.
-type VariableLookupFunction func(key string) (string, error)
+type inExpr struct {
+	l    operand
+	list []operand
+}
 
-// NullLookup returns an empty value for any requested variable and
-// does not return an error.  This is the default variable lookup
-// function used by Evaluate.
-func NullLookup(key string) (string, error) {
-	return "", nil
+func (x *inExpr) eval(e *evaluator) (bool, error) {
+	l, err := x.l.value(e)
+	if err != nil {
+		return false, err
+	}
+	for _, o := range x.list {
+		v, err := o.value(e)
+		if err != nil {
+			return false, err
+		}
+		if v == l {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
-// Evaluate evaluates an input expression.
-// Expressions are groups of string values combined with equal or unequal
-// comparators.  The order of comparison operations can be designated using
-// groups enclosed inside parenthesis.
-// An optional VariableLookupFunction can be provided to provide variable
-// lookups.
-func Evaluate(inputExpr string, lookupFns ...VariableLookupFunction) (bool, error) {
-	lookupFn := NullLookup
+type callExpr struct {
+	fn   token
+	args []operand
+}
 
-	if len(lookupFns) > 0 {
-		lookupFn = lookupFns[0]
+func (x *callExpr) eval(e *evaluator) (bool, error) {
+	s, err := x.args[0].value(e)
+	if err != nil {
+		return false, err
+	}
+	t, err := x.args[1].value(e)
+	if err != nil {
+		return false, err
+	}
+	return functions[x.fn.text](s, t), nil
+}
+
+// parser is a recursive descent parser of expressions.  In order of
+// increasing precedence, expressions are made of:
+//
+//	a || b
+//	a && b
+//	!a
+//	(a), fn(x, y), x op y, x in [y, z]
+type parser struct {
+	input  string
+	tokens []token
+}
+
+func (p *parser) peek() token {
+	return p.tokens[0]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[0]
+	if t.kind != tokenEOF {
+		p.tokens = p.tokens[1:]
+	}
+	return t
+}
+
+func (p *parser) isOp(op string) bool {
+	t := p.peek()
+	return t.kind == tokenOp && t.text == op
+}
+
+func (p *parser) errorf(t token, format string, args ...any) error {
+	return &Error{Column: column(p.input, t.pos), Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) expect(op string) error {
+	if t := p.next(); t.kind != tokenOp || t.text != op {
+		return p.errorf(t, "expected %q, got %s", op, t)
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (expr, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		p.next()
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = &orExpr{l, r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseAnd() (expr, error) {
+	l, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		p.next()
+		r, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l = &andExpr{l, r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseNot() (expr, error) {
+	if p.isOp("!") {
+		p.next()
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notExpr{x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (expr, error) {
+	if p.isOp("(") {
+		p.next()
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return x, nil
+	}
+
+	if t := p.peek(); t.kind == tokenIdent {
+		return p.parseCall()
 	}
 
-	equal := goparsify.Exact("==")
-	unequal := goparsify.Exact("!=")
-	comps := goparsify.Any(equal, unequal)
+	l, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
 
-	variableName := goparsify.Chars("a-zA-Z0-9.\\-_")
-	variable := goparsify.Seq("${{", variableName, "}}").Map(func(n *goparsify.Result) {
-		if resolved, err := lookupFn(n.Child[1].Token); err == nil {
-			n.Token = resolved
-			n.Result = resolved
+	op := p.next()
+	switch {
+	case op.kind == tokenOp && slices.Contains(comparisons, op.text):
+		r, err := p.parseOperand()
+		if err != nil {
+			return nil, err
 		}
-	})
+		return &compareExpr{op: op, l: l, r: r}, nil
+
+	case op.kind == tokenIdent && op.text == "in":
+		list, err := p.parseList("[", "]")
+		if err != nil {
+			return nil, err
+		}
+		return &inExpr{l: l, list: list}, nil
+
+	default:
+		return nil, p.errorf(op, "expected a comparison operator or in, got %s", op)
+	}
+}
+
+func (p *parser) parseCall() (expr, error) {
+	fn := p.next()
+	if _, ok := functions[fn.text]; !ok {
+		return nil, p.errorf(fn, "unknown function %q", fn.text)
+	}
 
-	value := goparsify.Any(goparsify.StringLit("'\""), variable)
-	expr := goparsify.Seq(value, comps, value).Map(comparisonOp)
+	args, err := p.parseList("(", ")")
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 2 {
+		return nil, p.errorf(fn, "%s takes 2 arguments, got %d", fn.text, len(args))
+	}
+
+	return &callExpr{fn: fn, args: args}, nil
+}
+
+// parseList parses a comma separated list of operands between open and close.
+func (p *parser) parseList(open, close string) ([]operand, error) {
+	if err := p.expect(open); err != nil {
+		return nil, err
+	}
+
+	var list []operand
+	if p.isOp(close) {
+		p.next()
+		return list, nil
+	}
+	for {
+		o, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, o)
 
-	and := goparsify.Exact("&&")
-	or := goparsify.Exact("||")
-	chain := goparsify.Any(and, or)
-	combinedExpr := goparsify.Seq(expr, chain, expr).Map(combineOp)
+		if p.isOp(",") {
+			p.next()
+			continue
+		}
+		if err := p.expect(close); err != nil {
+			return nil, err
+		}
+		return list, nil
+	}
+}
 
-	exprChain := goparsify.Some(goparsify.Any(combinedExpr, expr), chain).Map(collapseOp)
+func (p *parser) parseOperand() (operand, error) {
+	t := p.next()
+	if t.kind != tokenString && t.kind != tokenVariable {
+		return operand{}, p.errorf(t, "expected a string or variable, got %s", t)
+	}
+	return operand(t), nil
+}
 
-	group := goparsify.Seq("(", goparsify.Cut(), exprChain, ")").Map(func(n *goparsify.Result) {
-		n.Result = n.Child[2].Result
-	})
-	groupOrExpr := goparsify.Any(group, exprChain)
-	combinedGroup := goparsify.Seq(groupOrExpr, chain, groupOrExpr).Map(combineOp)
+// Evaluate evaluates an input expression.
+//
+// Expressions compare strings, written in single or double quotes, and
+// ${{variables}}, which can have filters applied to them as in Subst:
+//
+//   - a == b and a != b compare strings,
+//   - a =~ b matches a against the regular expression b,
+//   - a < b, a <= b, a > b and a >= b compare APK versions,
+//   - a in [b, c] checks whether a is one of the listed values.
+//
+// The functions startsWith(s, prefix), endsWith(s, suffix) and
+// contains(s, substr) test strings.  Conditions can be negated with !,
+// combined with && and ||, and grouped inside parenthesis.  && takes
+// precedence over ||.
+//
+// An optional VariableLookupFunction can be provided to provide variable
+// lookups.  Errors in the expression are reported as an *Error, which holds
+// the column of the expression they are at.
+func Evaluate(inputExpr string, lookupFns ...VariableLookupFunction) (bool, error) {
+	lookupFn := NullLookup
 
-	groupChain := goparsify.Some(goparsify.Any(combinedGroup, groupOrExpr), chain).Map(collapseOp)
+	if len(lookupFns) > 0 {
+		lookupFn = lookupFns[0]
+	}
 
-	result, _, err := goparsify.Run(groupChain, inputExpr, goparsify.UnicodeWhitespace)
+	tokens, err := lex(inputExpr)
 	if err != nil {
 		return false, err
 	}
 
-	if rbool, ok := result.(bool); ok {
-		return rbool, nil
+	p := &parser{input: inputExpr, tokens: tokens}
+	x, err := p.parseOr()
+	if err != nil {
+		return false, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return false, p.errorf(t, "unexpected %s", t)
 	}
 
-	return false, fmt.Errorf("got non-boolean result from parser")
+	return x.eval(&evaluator{input: inputExpr, lookup: lookupFn})
 }
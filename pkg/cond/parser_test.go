@@ -85,3 +85,82 @@ func TestVariableLookupWhitespace(t *testing.T) {
 	require.NoErrorf(t, err, "got error: %v", err)
 	require.Equal(t, true, result, "${{ foo.bar }} definitely equals baz")
 }
+
+func TestExprOperators(t *testing.T) {
+	lookup := func(key string) (string, error) {
+		switch key {
+		case "build.arch":
+			return "aarch64", nil
+		case "package.version":
+			return "1.10.2", nil
+		}
+		return "", fmt.Errorf("unknown key %s", key)
+	}
+
+	for _, tc := range []struct {
+		expr string
+		want bool
+	}{
+		{expr: "!('foo' == 'bar')", want: true},
+		{expr: "!!('foo' == 'bar')", want: false},
+		{expr: "'foo' == 'foo' || 'a' == 'b' && 'c' == 'd'", want: true},
+		{expr: "('foo' == 'foo' || 'a' == 'b') && 'c' == 'd'", want: false},
+		{expr: "${{build.arch}} =~ '^(aarch64|arm.*)$'", want: true},
+		{expr: "${{build.arch}} =~ '^x86'", want: false},
+		{expr: "${{build.arch}} in ['x86_64', 'aarch64']", want: true},
+		{expr: "${{build.arch}} in ['x86_64']", want: false},
+		{expr: "${{build.arch}} in []", want: false},
+		{expr: "!(${{build.arch}} in ['x86_64'])", want: true},
+		{expr: "${{package.version}} >= '1.9'", want: true},
+		{expr: "${{package.version}} < '1.9'", want: false},
+		{expr: "${{package.version}} > '1.10.2_rc1'", want: true},
+		{expr: "${{package.version}} <= '1.10.2'", want: true},
+		{expr: "'1.10.2-r1' > ${{package.version}}", want: true},
+		{expr: "startsWith(${{build.arch}}, 'aarch')", want: true},
+		{expr: "endsWith(${{build.arch}}, '64') && !contains(${{build.arch}}, 'x86')", want: true},
+		{expr: `"it's" == 'it\'s'`, want: true},
+		{expr: `"tab\there" == 'tab	here'`, want: true},
+	} {
+		t.Run(tc.expr, func(t *testing.T) {
+			result, err := Evaluate(tc.expr, lookup)
+			require.NoError(t, err)
+			require.Equal(t, tc.want, result)
+		})
+	}
+}
+
+func TestExprErrors(t *testing.T) {
+	for _, tc := range []struct {
+		expr    string
+		wantErr string
+	}{
+		{expr: "'foo' == ", wantErr: "column 10: expected a string or variable, got end of expression"},
+		{expr: "'foo' = 'bar'", wantErr: `column 7: unexpected character '='`},
+		{expr: "'foo' == 'bar')", wantErr: `column 15: unexpected ")"`},
+		{expr: "('foo' == 'bar'", wantErr: `column 16: expected ")", got end of expression`},
+		{expr: "'foo' 'bar'", wantErr: `column 7: expected a comparison operator or in, got "bar"`},
+		{expr: "'foo == 'bar'", wantErr: "column 13: unterminated string"},
+		{expr: "hasPrefix('foo', 'f')", wantErr: `column 1: unknown function "hasPrefix"`},
+		{expr: "startsWith('foo')", wantErr: "column 1: startsWith takes 2 arguments, got 1"},
+		{expr: "'foo' =~ '('", wantErr: "column 10: invalid regular expression"},
+		{expr: "'1.0' < 'latest'", wantErr: `column 9: invalid version "latest"`},
+		{expr: "${{foo.bar}} == 'baz' && ${{nope}} == ''", wantErr: "column 26: looking up ${{nope}}"},
+	} {
+		t.Run(tc.expr, func(t *testing.T) {
+			_, err := Evaluate(tc.expr, placeholderLookup)
+			require.ErrorContains(t, err, tc.wantErr)
+
+			var cerr *Error
+			require.ErrorAs(t, err, &cerr)
+		})
+	}
+}
+
+func TestExprFilters(t *testing.T) {
+	result, err := Evaluate("${{foo.bar | upper}} == 'BAZ' && ${{ foo.bar | replace('z', 'r') }} in ['bar']", placeholderLookup)
+	require.NoError(t, err)
+	require.True(t, result)
+
+	_, err = Evaluate("${{foo.bar | major}} == '1'", placeholderLookup)
+	require.ErrorContains(t, err, "column 1:")
+}
@@ -18,54 +18,189 @@ import (
 	"errors"
 	"fmt"
 	"strings"
-
-	"github.com/ijt/goparsify"
+	"unicode"
+	"unicode/utf8"
 )
 
-func Subst(inputExpr string, lookupFns ...VariableLookupFunction) (string, error) {
-	lookupFn := NullLookup
+// A Variable is a ${{}} expression: the name of a variable, followed by the
+// filters to apply to its value, e.g. ${{package.version | major}}.
+type Variable struct {
+	// The expression as written, including ${{ and }}
+	Text    string
+	Name    string
+	Filters []Filter
+	// The offset of the expression in the string it was found in
+	Offset int
+}
 
-	if len(lookupFns) > 0 {
-		lookupFn = lookupFns[0]
+// Apply returns value with the filters of the variable applied to it.
+func (v *Variable) Apply(value string) (string, error) {
+	for _, f := range v.Filters {
+		var err error
+		if value, err = filters[f.Name].apply(value, f.Args); err != nil {
+			return "", fmt.Errorf("%s: filter %s: %w", v.Text, f.Name, err)
+		}
 	}
+	return value, nil
+}
 
-	whiteSpace := goparsify.Many(goparsify.Exact(" "))
-	variableName := goparsify.Chars("a-zA-Z0-9.\\-_")
-	errs := []error{}
-	variable := goparsify.Seq("${{", whiteSpace, variableName, whiteSpace, "}}").Map(func(n *goparsify.Result) {
-		if resolved, err := lookupFn(n.Child[2].Token); err == nil {
-			n.Token = resolved
-			n.Result = resolved
-		} else {
-			errs = append(errs, err)
-			n.Token = ""
-			n.Result = ""
+// parseVariable parses the ${{}} expression at the start of s, returning it
+// and its length.
+func parseVariable(s string) (*Variable, int, error) {
+	pos := 3
+
+	skipSpace := func() {
+		for pos < len(s) {
+			r, size := utf8.DecodeRuneInString(s[pos:])
+			if !unicode.IsSpace(r) {
+				return
+			}
+			pos += size
 		}
-	})
+	}
+	read := func(valid func(rune) bool) string {
+		start := pos
+		for pos < len(s) && valid(rune(s[pos])) {
+			pos++
+		}
+		return s[start:pos]
+	}
+	unexpected := func() error {
+		if pos == len(s) {
+			return errors.New("unterminated variable")
+		}
+		r, _ := utf8.DecodeRuneInString(s[pos:])
+		return fmt.Errorf("unexpected %q in variable", r)
+	}
+
+	v := &Variable{}
+
+	skipSpace()
+	if v.Name = read(isVariableChar); v.Name == "" {
+		return nil, 0, unexpected()
+	}
 
-	text := goparsify.Until("${{")
-	node := goparsify.Any(text, variable)
+	for {
+		skipSpace()
+		if strings.HasPrefix(s[pos:], "}}") {
+			pos += 2
+			v.Text = s[:pos]
+			return v, pos, nil
+		}
+		if pos == len(s) || s[pos] != '|' {
+			return nil, 0, unexpected()
+		}
+		pos++
 
-	document := goparsify.Many(node).Map(func(n *goparsify.Result) {
-		tokens := []string{}
-		for _, tok := range n.Child {
-			tokens = append(tokens, tok.Token)
+		skipSpace()
+		f := Filter{Name: read(isIdentChar)}
+		if f.Name == "" {
+			return nil, 0, unexpected()
 		}
-		n.Result = strings.Join(tokens, "")
-	})
+		skipSpace()
+
+		if pos < len(s) && s[pos] == '(' {
+			pos++
+			for {
+				skipSpace()
+				if pos < len(s) && s[pos] == ')' && len(f.Args) == 0 {
+					pos++
+					break
+				}
+
+				switch {
+				case pos < len(s) && (s[pos] == '\'' || s[pos] == '"'):
+					arg, n, err := lexString(s[pos:])
+					if err != nil {
+						return nil, 0, err
+					}
+					f.Args = append(f.Args, arg)
+					pos += n
+				default:
+					arg := read(func(r rune) bool { return r == '-' || r >= '0' && r <= '9' })
+					if arg == "" {
+						return nil, 0, unexpected()
+					}
+					f.Args = append(f.Args, arg)
+				}
 
-	result, _, err := goparsify.Run(document, inputExpr, goparsify.NoWhitespace)
-	if err != nil {
-		return "", fmt.Errorf("parser error: %w", err)
+				skipSpace()
+				if pos < len(s) && s[pos] == ',' {
+					pos++
+					continue
+				}
+				if pos < len(s) && s[pos] == ')' {
+					pos++
+					break
+				}
+				return nil, 0, unexpected()
+			}
+		}
+
+		filter, ok := filters[f.Name]
+		if !ok {
+			return nil, 0, fmt.Errorf("unknown filter %q, expected one of %s", f.Name, strings.Join(filterNames(), ", "))
+		}
+		if len(f.Args) != filter.args {
+			return nil, 0, fmt.Errorf("filter %s takes %d arguments, got %d", f.Name, filter.args, len(f.Args))
+		}
+		v.Filters = append(v.Filters, f)
+	}
+}
+
+// Expand replaces each ${{}} expression in inputExpr with the result of
+// calling expand with it.  All the errors returned by expand are reported.
+func Expand(inputExpr string, expand func(v *Variable) (string, error)) (string, error) {
+	var b strings.Builder
+	errs := []error{}
+
+	rest := inputExpr
+	for {
+		i := strings.Index(rest, "${{")
+		if i < 0 {
+			b.WriteString(rest)
+			break
+		}
+		b.WriteString(rest[:i])
+		rest = rest[i:]
+
+		v, n, err := parseVariable(rest)
+		if err != nil {
+			return "", fmt.Errorf("parser error: column %d: %w", column(inputExpr, len(inputExpr)-len(rest)), err)
+		}
+		v.Offset = len(inputExpr) - len(rest)
+		rest = rest[n:]
+
+		s, err := expand(v)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		b.WriteString(s)
 	}
 
 	if err := errors.Join(errs...); err != nil {
 		return "", err
 	}
 
-	if rstr, ok := result.(string); ok {
-		return rstr, nil
+	return b.String(), nil
+}
+
+// Subst replaces each ${{}} expression in inputExpr with the value of its
+// variable, as returned by the VariableLookupFunction, with its filters
+// applied.
+func Subst(inputExpr string, lookupFns ...VariableLookupFunction) (string, error) {
+	lookupFn := NullLookup
+
+	if len(lookupFns) > 0 {
+		lookupFn = lookupFns[0]
 	}
 
-	return "", fmt.Errorf("got non-string result from parser")
+	return Expand(inputExpr, func(v *Variable) (string, error) {
+		value, err := lookupFn(v.Name)
+		if err != nil {
+			return "", err
+		}
+		return v.Apply(value)
+	})
 }
@@ -15,6 +15,7 @@
 package cond
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -99,3 +100,53 @@ fi`
 
 	require.NoErrorf(t, err, "got error: %v", err)
 }
+
+func TestSubstFilters(t *testing.T) {
+	lookup := func(key string) (string, error) {
+		switch key {
+		case "package.version":
+			return "v1.22.3_rc1", nil
+		case "package.name":
+			return "Py3-Foo", nil
+		}
+		return "", fmt.Errorf("unknown key %s", key)
+	}
+
+	for _, tc := range []struct {
+		doc  string
+		want string
+	}{
+		{doc: "${{package.version | major}}", want: "1"},
+		{doc: "${{ package.version | minor }}", want: "22"},
+		{doc: "${{package.version|patch}}", want: "3"},
+		{doc: "${{package.version | trimprefix('v') | replace('.', '_')}}", want: "1_22_3_rc1"},
+		{doc: `${{package.version | trimsuffix("_rc1")}}`, want: "v1.22.3"},
+		{doc: "${{package.name | lower}}-${{package.name | upper}}", want: "py3-foo-PY3-FOO"},
+		{doc: "${{package.name | sha256}}", want: "10a19763f6d5bc7d13d337d5e5b5157403045efd13251886b7597ce9cbf33c5b"},
+		{doc: "${{package.name | replace('}}', '')}}", want: "Py3-Foo"},
+	} {
+		t.Run(tc.doc, func(t *testing.T) {
+			result, err := Subst(tc.doc, lookup)
+			require.NoError(t, err)
+			require.Equal(t, tc.want, result)
+		})
+	}
+}
+
+func TestSubstFilterErrors(t *testing.T) {
+	for _, tc := range []struct {
+		doc     string
+		wantErr string
+	}{
+		{doc: "${{foo.bar | reverse}}", wantErr: `unknown filter "reverse", expected one of lower, major,`},
+		{doc: "${{foo.bar | replace('a')}}", wantErr: "filter replace takes 2 arguments, got 1"},
+		{doc: "${{foo.bar | patch}}", wantErr: `version "baz" has fewer than 3 components`},
+		{doc: "x ${{foo.bar | }}", wantErr: "column 3: unexpected '}' in variable"},
+		{doc: "${{foo.bar | lower", wantErr: "unterminated variable"},
+	} {
+		t.Run(tc.doc, func(t *testing.T) {
+			_, err := Subst(tc.doc, placeholderLookup)
+			require.ErrorContains(t, err, tc.wantErr)
+		})
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+)
+
+// ArchOverride describes the changes to a package build for an architecture.
+type ArchOverride struct {
+	// Optional: Variables to set, taking precedence over those of the
+	// configuration
+	Vars map[string]string `json:"vars,omitempty" yaml:"vars,omitempty"`
+	// Optional: Packages to add to or remove from the build environment
+	Environment EnvironmentOption `json:"environment,omitempty" yaml:"environment,omitempty"`
+	// Optional: Dependencies replacing those of the package. Only the lists
+	// and priorities given are replaced.
+	Dependencies Dependencies `json:"dependencies,omitempty" yaml:"dependencies,omitempty"`
+	// Optional: Checks to disable in addition to those of the package
+	Checks Checks `json:"checks,omitempty" yaml:"checks,omitempty"`
+}
+
+// archOverrideKeys returns the architectures of the overrides in the
+// configuration, sorted.
+func (cfg Configuration) archOverrideKeys() []string {
+	keys := make([]string, 0, len(cfg.ArchOverrides))
+	for k := range cfg.ArchOverrides {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// applyArchOverrides applies the overrides for arch to the configuration.
+// Overrides may be keyed by any name of the architecture, e.g. both x86_64
+// and amd64.
+func (cfg *Configuration) applyArchOverrides(arch apko_types.Architecture) {
+	for _, k := range cfg.archOverrideKeys() {
+		if apko_types.ParseArchitecture(k).ToAPK() != arch.ToAPK() {
+			continue
+		}
+		cfg.applyOverride(cfg.ArchOverrides[k])
+	}
+}
+
+// applyOverride applies the changes of o to the configuration.
+func (cfg *Configuration) applyOverride(o ArchOverride) {
+	if len(o.Vars) > 0 && cfg.Vars == nil {
+		cfg.Vars = make(map[string]string, len(o.Vars))
+	}
+	for k, v := range o.Vars {
+		cfg.Vars[k] = v
+	}
+
+	lo := o.Environment.Contents.Packages
+	packages := cfg.Environment.Contents.Packages
+	packages = slices.DeleteFunc(packages, func(pkg string) bool {
+		return slices.Contains(lo.Remove, pkg)
+	})
+	cfg.Environment.Contents.Packages = append(packages, lo.Add...)
+
+	deps := &cfg.Package.Dependencies
+	if o.Dependencies.Runtime != nil {
+		deps.Runtime = o.Dependencies.Runtime
+	}
+	if o.Dependencies.Provides != nil {
+		deps.Provides = o.Dependencies.Provides
+	}
+	if o.Dependencies.Replaces != nil {
+		deps.Replaces = o.Dependencies.Replaces
+	}
+	if o.Dependencies.ProviderPriority != "" {
+		deps.ProviderPriority = o.Dependencies.ProviderPriority
+	}
+	if o.Dependencies.ReplacesPriority != "" {
+		deps.ReplacesPriority = o.Dependencies.ReplacesPriority
+	}
+
+	for _, check := range o.Checks.Disabled {
+		if !slices.Contains(cfg.Package.Checks.Disabled, check) {
+			cfg.Package.Checks.Disabled = append(cfg.Package.Checks.Disabled, check)
+		}
+	}
+}
+
+// validateArchOverrides checks that the overrides are keyed by known
+// architectures.
+func (cfg Configuration) validateArchOverrides() error {
+	for _, k := range cfg.archOverrideKeys() {
+		if !slices.Contains(apko_types.AllArchs, apko_types.ParseArchitecture(k)) {
+			return fmt.Errorf("arch-overrides: unknown architecture %q", k)
+		}
+	}
+	return nil
+}
@@ -32,8 +32,35 @@ type EnvironmentOption struct {
 	Contents ContentsOption `yaml:"contents,omitempty"`
 }
 
+// DependenciesOption describes an optional deviation to a package's
+// dependencies.
+type DependenciesOption struct {
+	Runtime  ListOption `yaml:"runtime,omitempty"`
+	Provides ListOption `yaml:"provides,omitempty"`
+}
+
+// SubpackagesOption describes an optional deviation to the subpackages that
+// are built.
+type SubpackagesOption struct {
+	// Names of subpackages to build that are disabled in the configuration
+	Enable []string `yaml:"enable,omitempty"`
+	// Names of subpackages not to build
+	Disable []string `yaml:"disable,omitempty"`
+}
+
+// PipelineOption describes an optional deviation to a package's pipeline.
+type PipelineOption struct {
+	// Steps to append to the pipeline
+	Append []Pipeline `yaml:"append,omitempty"`
+	// Steps replacing the steps of the pipeline with the same name
+	Replace []Pipeline `yaml:"replace,omitempty"`
+}
+
 // BuildOption describes an optional deviation to a package build.
 type BuildOption struct {
-	Vars        map[string]string `yaml:"vars,omitempty"`
-	Environment EnvironmentOption `yaml:"environment,omitempty"`
+	Vars         map[string]string  `yaml:"vars,omitempty"`
+	Environment  EnvironmentOption  `yaml:"environment,omitempty"`
+	Dependencies DependenciesOption `yaml:"dependencies,omitempty"`
+	Subpackages  SubpackagesOption  `yaml:"subpackages,omitempty"`
+	Pipeline     PipelineOption     `yaml:"pipeline,omitempty"`
 }
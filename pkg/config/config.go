@@ -19,11 +19,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"regexp"
-	"sort"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -80,7 +81,8 @@ type PackageOption struct {
 }
 
 type Checks struct {
-	// Optional: disable these linters that are not enabled by default.
+	// Optional: disable these linters that are not enabled by default, and
+	// these lint-config rules.
 	Disabled []string `json:"disabled,omitempty" yaml:"disabled,omitempty"`
 }
 
@@ -136,8 +138,7 @@ func (p Package) PackageURL(distro string) string {
 	)
 }
 
-func (cfg *Configuration) applySubstitutionsForProvides() error {
-	nw := buildConfigMap(cfg)
+func (cfg *Configuration) applySubstitutionsForProvides(nw map[string]string) error {
 	for i, prov := range cfg.Package.Dependencies.Provides {
 		var err error
 		cfg.Package.Dependencies.Provides[i], err = util.MutateStringFromMap(nw, prov)
@@ -157,8 +158,7 @@ func (cfg *Configuration) applySubstitutionsForProvides() error {
 	return nil
 }
 
-func (cfg *Configuration) applySubstitutionsForPriorities() error {
-	nw := buildConfigMap(cfg)
+func (cfg *Configuration) applySubstitutionsForPriorities(nw map[string]string) error {
 	var err error
 	cfg.Package.Dependencies.ProviderPriority, err = util.MutateStringFromMap(nw, cfg.Package.Dependencies.ProviderPriority)
 	if err != nil {
@@ -181,8 +181,7 @@ func (cfg *Configuration) applySubstitutionsForPriorities() error {
 	return nil
 }
 
-func (cfg *Configuration) applySubstitutionsForRuntime() error {
-	nw := buildConfigMap(cfg)
+func (cfg *Configuration) applySubstitutionsForRuntime(nw map[string]string) error {
 	for i, runtime := range cfg.Package.Dependencies.Runtime {
 		var err error
 		cfg.Package.Dependencies.Runtime[i], err = util.MutateStringFromMap(nw, runtime)
@@ -202,8 +201,7 @@ func (cfg *Configuration) applySubstitutionsForRuntime() error {
 	return nil
 }
 
-func (cfg *Configuration) applySubstitutionsForReplaces() error {
-	nw := buildConfigMap(cfg)
+func (cfg *Configuration) applySubstitutionsForReplaces(nw map[string]string) error {
 	for i, replaces := range cfg.Package.Dependencies.Replaces {
 		var err error
 		cfg.Package.Dependencies.Replaces[i], err = util.MutateStringFromMap(nw, replaces)
@@ -223,8 +221,7 @@ func (cfg *Configuration) applySubstitutionsForReplaces() error {
 	return nil
 }
 
-func (cfg *Configuration) applySubstitutionsForPackages() error {
-	nw := buildConfigMap(cfg)
+func (cfg *Configuration) applySubstitutionsForPackages(nw map[string]string) error {
 	for i, runtime := range cfg.Environment.Contents.Packages {
 		var err error
 		cfg.Environment.Contents.Packages[i], err = util.MutateStringFromMap(nw, runtime)
@@ -308,6 +305,17 @@ type PipelineAssertions struct {
 	RequiredSteps int `json:"required-steps,omitempty" yaml:"required-steps,omitempty"`
 }
 
+type PipelineRetry struct {
+	// Required: The number of times to run the pipeline before giving up,
+	// including the first attempt
+	Attempts int `json:"attempts" yaml:"attempts"`
+	// Optional: The time to wait before the first retry, doubled after each
+	// further failed attempt
+	Backoff time.Duration `json:"backoff,omitempty" yaml:"backoff,omitempty"`
+	// Optional: The exit codes to retry on.  If empty, any failure is retried.
+	ExitCodes []int `json:"exit-codes,omitempty" yaml:"exit-codes,omitempty"`
+}
+
 type Pipeline struct {
 	// Optional: A user defined name for the pipeline
 	Name string `json:"name,omitempty" yaml:"name,omitempty"`
@@ -344,13 +352,35 @@ type Pipeline struct {
 	WorkDir string `json:"working-directory,omitempty" yaml:"working-directory,omitempty"`
 	// Optional: environment variables to override the apko environment
 	Environment map[string]string `json:"environment,omitempty" yaml:"environment,omitempty"`
+	// Optional: Policy for retrying the pipeline, including any nested
+	// pipelines, when it fails
+	Retry *PipelineRetry `json:"retry,omitempty" yaml:"retry,omitempty"`
+	// Optional: The amount of time to allow each attempt at running the
+	// pipeline, including any nested pipelines, to take before timing out
+	Timeout time.Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	// Optional: Continue the build if the pipeline fails, reporting it as a
+	// soft failure
+	ContinueOnError bool `json:"continue-on-error,omitempty" yaml:"continue-on-error,omitempty"`
+
+	// The positions of the values of the fields in the configuration file
+	positions map[string]*fieldPosition
 }
 
 type Subpackage struct {
 	// Optional: A conditional statement to evaluate for the subpackage
 	If string `json:"if,omitempty" yaml:"if,omitempty"`
+	// Optional: Whether the subpackage is only built when a build option
+	// enables it
+	Disabled bool `json:"disabled,omitempty" yaml:"disabled,omitempty"`
 	// Optional: The iterable used to generate multiple subpackages
 	Range string `json:"range,omitempty" yaml:"range,omitempty"`
+	// Optional: The iterables used to generate a subpackage for each
+	// combination of their items
+	Ranges []string `json:"ranges,omitempty" yaml:"ranges,omitempty"`
+	// Optional: A conditional statement to evaluate for each item or
+	// combination of items of the ranges, which generates no subpackage if it
+	// is false
+	RangeIf string `json:"range-if,omitempty" yaml:"range-if,omitempty"`
 	// Required: Name of the subpackage
 	Name string `json:"name" yaml:"name"`
 	// Optional: The list of pipelines that produce subpackage.
@@ -397,6 +427,16 @@ type Input struct {
 	Default string `json:"default,omitempty"`
 	// Optional: A toggle denoting whether the input is required or not
 	Required bool `json:"required,omitempty"`
+	// Optional: The type of the input, one of string (the default), bool, int,
+	// enum or path
+	Type string `json:"type,omitempty"`
+	// Optional: The values the input may take. Required for enum inputs.
+	Values []string `json:"values,omitempty"`
+	// Optional: A regular expression that the value of the input must match
+	Pattern string `json:"pattern,omitempty"`
+	// Optional: A message explaining what to use instead of the input, which
+	// is deprecated when set
+	Deprecated string `json:"deprecated,omitempty"`
 }
 
 // The root melange configuration
@@ -422,12 +462,26 @@ type Configuration struct {
 	VarTransforms []VarTransforms `json:"var-transforms,omitempty" yaml:"var-transforms,omitempty"`
 	// Optional: Deviations to the build
 	Options map[string]BuildOption `json:"options,omitempty" yaml:"options,omitempty"`
+	// Optional: Changes to the build for specific architectures, keyed by
+	// architecture
+	ArchOverrides map[string]ArchOverride `json:"arch-overrides,omitempty" yaml:"arch-overrides,omitempty"`
+	// Optional: A matrix of variants of the package, keyed by the variable
+	// set to each of the values
+	Variants map[string][]VariantValue `json:"variants,omitempty" yaml:"variants,omitempty"`
 
 	// Test section for the main package.
 	Test *Test `json:"test,omitempty" yaml:"test,omitempty"`
 
+	// Optional: Configuration fragments to merge into this configuration,
+	// relative to it or found in the include directories
+	Include []string `json:"include,omitempty" yaml:"include,omitempty"`
+
 	// Parsed AST for this configuration
 	root *yaml.Node
+	// The files merged into this configuration
+	includedFiles []string
+	// The variant this configuration was parsed for
+	variant Variant
 }
 
 type Test struct {
@@ -526,7 +580,8 @@ type RangeData struct {
 	Items DataItems `json:"items" yaml:"items"`
 }
 
-type DataItems map[string]string
+// DataItems are the items of a data set, by key.
+type DataItems map[string]DataItem
 
 type Dependencies struct {
 	// Optional: List of runtime dependencies
@@ -556,6 +611,12 @@ type configOptions struct {
 	timeout     time.Duration
 
 	varsFilePath string
+
+	allowUnresolved bool
+	strict          bool
+	includeDirs     []string
+	arch            apko_types.Architecture
+	variant         Variant
 }
 
 // include reconciles all given opts into the receiver variable, such that it is
@@ -608,6 +669,48 @@ func WithVarsFileForParsing(path string) ConfigurationParsingOption {
 	}
 }
 
+// WithAllowUnresolved sets whether references to variables that are not
+// defined are allowed.  If so, they are reported as warnings and left in
+// place.
+func WithAllowUnresolved(allowUnresolved bool) ConfigurationParsingOption {
+	return func(options *configOptions) {
+		options.allowUnresolved = allowUnresolved
+	}
+}
+
+// WithStrict sets whether the configuration must conform to its schema.  If
+// not, the problems are reported as warnings.  Unknown keys are an error
+// either way.
+func WithStrict(strict bool) ConfigurationParsingOption {
+	return func(options *configOptions) {
+		options.strict = strict
+	}
+}
+
+// WithIncludeDirs sets the directories in which to look for the files included
+// by a configuration that are not found relative to it.
+func WithIncludeDirs(dirs []string) ConfigurationParsingOption {
+	return func(options *configOptions) {
+		options.includeDirs = dirs
+	}
+}
+
+// WithArch sets the architecture the configuration is parsed for, applying
+// its arch-overrides for that architecture.
+func WithArch(arch apko_types.Architecture) ConfigurationParsingOption {
+	return func(options *configOptions) {
+		options.arch = arch
+	}
+}
+
+// WithVariant sets the variant of the variants matrix the configuration is
+// parsed for.  By default, the first variant is used.
+func WithVariant(v Variant) ConfigurationParsingOption {
+	return func(options *configOptions) {
+		options.variant = v
+	}
+}
+
 func detectCommit(ctx context.Context, dirPath string) string {
 	log := clog.FromContext(ctx)
 	// Best-effort detection of current commit, to be used when not specified in the config file
@@ -646,6 +749,38 @@ func buildConfigMap(cfg *Configuration) map[string]string {
 	return out
 }
 
+// replacePipelines returns copies of the pipelines, and of their nested
+// pipelines, with the substitutions of replacer applied to their commands,
+// conditions, working directories and arguments.
+func replacePipelines(replacer *strings.Replacer, pipelines []Pipeline) []Pipeline {
+	if len(pipelines) == 0 {
+		return nil
+	}
+
+	replaced := make([]Pipeline, 0, len(pipelines))
+	for _, p := range pipelines {
+		// take a copy of the with map, so we can replace the values
+		replacedWith := make(map[string]string)
+		for key, value := range p.With {
+			replacedWith[key] = replacer.Replace(value)
+		}
+
+		// if the map is empty, set it to nil to avoid serializing an empty map
+		if len(replacedWith) == 0 {
+			replacedWith = nil
+		}
+
+		np := p
+		np.With = replacedWith
+		np.Runs = replacer.Replace(p.Runs)
+		np.If = replacer.Replace(p.If)
+		np.WorkDir = replacer.Replace(p.WorkDir)
+		np.Pipeline = replacePipelines(replacer, p.Pipeline)
+		replaced = append(replaced, np)
+	}
+	return replaced
+}
+
 func replacerFromMap(with map[string]string) *strings.Replacer {
 	replacements := []string{}
 	for k, v := range with {
@@ -698,6 +833,7 @@ func ParseConfiguration(ctx context.Context, configurationFilePath string, opts
 	configurationDirPath := filepath.Dir(configurationFilePath)
 	options.include(opts...)
 
+	source := includeSource{fsys: options.filesystem, path: configurationFilePath}
 	if options.filesystem == nil {
 		// TODO: this is an abstraction leak, and we can remove this `if statement` once
 		//  ParseConfiguration relies solely on an abstract fs.FS.
@@ -716,19 +852,56 @@ func ParseConfiguration(ctx context.Context, configurationFilePath string, opts
 	}
 	defer f.Close()
 
+	src, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read configuration file %q: %w", configurationFilePath, err)
+	}
+	lines := strings.Split(string(src), "\n")
+
 	root := yaml.Node{}
 
 	cfg := Configuration{root: &root}
 
 	// Unmarshal into a node first
-	decoderNode := yaml.NewDecoder(f)
+	decoderNode := yaml.NewDecoder(bytes.NewReader(src))
 	err = decoderNode.Decode(&root)
 	if err != nil {
 		return nil, fmt.Errorf("unable to decode configuration file %q: %w", configurationFilePath, err)
 	}
 
+	// Merge any included fragments before anything is substituted.  They are
+	// merged into a copy, so that Root holds the document as it was written
+	// and can be edited and written back without the fragments.
+	merged := root
+	merged.Content = slices.Clone(root.Content)
+	cfg.includedFiles, err = includeFragments(&merged, source, options.includeDirs)
+	if err != nil {
+		return nil, fmt.Errorf("unable to include fragments in configuration file %q: %w", configurationFilePath, err)
+	}
+
+	// Check the configuration against its schema, reporting every problem
+	// with its position rather than just the first one the decoder finds.
+	if problems := validateSchema(&merged, source.String()); len(problems) > 0 {
+		if options.strict {
+			return nil, ErrInvalidConfiguration{Problem: &SchemaError{Problems: problems}}
+		}
+		// Unknown keys are an error either way, as the decoder rejects them
+		// too, only without their position.
+		var unknown []SchemaProblem
+		for _, p := range problems {
+			if p.unknownKey() {
+				unknown = append(unknown, p)
+				continue
+			}
+			clog.FromContext(ctx).Warnf("%s", p)
+		}
+		if len(unknown) > 0 {
+			return nil, ErrInvalidConfiguration{Problem: &SchemaError{Problems: unknown}}
+		}
+	}
+
 	// XXX(Elizafox) - Node.Decode doesn't allow setting of KnownFields, so we do this cheesy hack below
-	data, err := yaml.Marshal(&root)
+	data, err := yaml.Marshal(&merged)
 	if err != nil {
 		return nil, fmt.Errorf("unable to decode configuration file %q: %w", configurationFilePath, err)
 	}
@@ -741,6 +914,16 @@ func ParseConfiguration(ctx context.Context, configurationFilePath string, opts
 	if err != nil {
 		return nil, fmt.Errorf("unable to decode configuration file %q: %w", configurationFilePath, err)
 	}
+	cfg.recordPositions(&merged, lines)
+
+	// Apply the variant and the overrides for the architecture before
+	// anything is substituted, so the variables they set are used.
+	if err := cfg.applyVariant(options.variant); err != nil {
+		return nil, fmt.Errorf("unable to parse configuration file %q: %w", configurationFilePath, err)
+	}
+	if options.arch != "" {
+		cfg.applyArchOverrides(options.arch)
+	}
 
 	detectedCommit := detectCommit(ctx, configurationDirPath)
 	if cfg.Package.Commit == "" {
@@ -757,28 +940,17 @@ func ParseConfiguration(ctx context.Context, configurationFilePath string, opts
 			sp.Commit = detectedCommit
 		}
 
-		if sp.Range == "" {
+		if sp.Range == "" && len(sp.Ranges) == 0 {
 			subpackages = append(subpackages, sp)
 			continue
 		}
-		items, ok := datas[sp.Range]
-		if !ok {
-			return nil, fmt.Errorf("unable to parse configuration file %q: subpackage %q specified undefined range: %q", configurationFilePath, sp.Name, sp.Range)
-		}
-
-		// Ensure iterating over items is deterministic by sorting keys alphabetically
-		keys := make([]string, 0, len(items))
-		for k := range items {
-			keys = append(keys, k)
+		combinations, err := sp.rangeCombinations(datas, buildConfigMap(&cfg))
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse configuration file %q: %w", configurationFilePath, err)
 		}
-		sort.Strings(keys)
 
-		for _, k := range keys {
-			v := items[k]
-			replacer := replacerFromMap(map[string]string{
-				"${{range.key}}":   k,
-				"${{range.value}}": v,
-			})
+		for _, c := range combinations {
+			replacer := replacerFromMap(c)
 
 			thingToAdd := Subpackage{
 				Name:        replacer.Replace(sp.Name),
@@ -791,9 +963,10 @@ func ParseConfiguration(ctx context.Context, configurationFilePath string, opts
 					ProviderPriority: replacer.Replace(sp.Dependencies.ProviderPriority),
 					ReplacesPriority: replacer.Replace(sp.Dependencies.ReplacesPriority),
 				},
-				Options: sp.Options,
-				URL:     replacer.Replace(sp.URL),
-				If:      replacer.Replace(sp.If),
+				Options:  sp.Options,
+				URL:      replacer.Replace(sp.URL),
+				If:       replacer.Replace(sp.If),
+				Disabled: sp.Disabled,
 			}
 
 			if script := sp.Scriptlets; script != nil {
@@ -811,54 +984,9 @@ func ParseConfiguration(ctx context.Context, configurationFilePath string, opts
 				}
 			}
 
-			for _, p := range sp.Pipeline {
-				// take a copy of the with map, so we can replace the values
-				replacedWith := make(map[string]string)
-				for key, value := range p.With {
-					replacedWith[key] = replacer.Replace(value)
-				}
-
-				// if the map is empty, set it to nil to avoid serializing an empty map
-				if len(replacedWith) == 0 {
-					replacedWith = nil
-				}
-
-				thingToAdd.Pipeline = append(thingToAdd.Pipeline, Pipeline{
-					Name:   p.Name,
-					Uses:   p.Uses,
-					With:   replacedWith,
-					Inputs: p.Inputs,
-					Needs:  p.Needs,
-					Label:  p.Label,
-					Runs:   replacer.Replace(p.Runs),
-					// TODO: p.Pipeline?
-				})
-			}
+			thingToAdd.Pipeline = replacePipelines(replacer, sp.Pipeline)
 			if sp.Test != nil {
-				thingToAdd.Test = &Test{}
-				for _, p := range sp.Test.Pipeline {
-					// take a copy of the with map, so we can replace the values
-					replacedWith := make(map[string]string)
-					for key, value := range p.With {
-						replacedWith[key] = replacer.Replace(value)
-					}
-
-					// if the map is empty, set it to nil to avoid serializing an empty map
-					if len(replacedWith) == 0 {
-						replacedWith = nil
-					}
-
-					thingToAdd.Test.Pipeline = append(thingToAdd.Test.Pipeline, Pipeline{
-						Name:   p.Name,
-						Uses:   p.Uses,
-						With:   replacedWith,
-						Inputs: p.Inputs,
-						Needs:  p.Needs,
-						Label:  p.Label,
-						Runs:   replacer.Replace(p.Runs),
-						// TODO: p.Pipeline?
-					})
-				}
+				thingToAdd.Test = &Test{Pipeline: replacePipelines(replacer, sp.Test.Pipeline)}
 			}
 			subpackages = append(subpackages, thingToAdd)
 		}
@@ -938,6 +1066,18 @@ func ParseConfiguration(ctx context.Context, configurationFilePath string, opts
 		}
 	}
 
+	// Report all the references to variables that are not defined, rather
+	// than just the first one substituted.
+	unresolved := cfg.unresolvedReferences(&merged, lines)
+	if len(unresolved) > 0 {
+		if !options.allowUnresolved {
+			return nil, fmt.Errorf("unable to parse configuration file %q: %w", configurationFilePath, &UnresolvedError{References: unresolved})
+		}
+		for _, ref := range unresolved {
+			clog.FromContext(ctx).Warnf("%s", ref)
+		}
+	}
+
 	// Mutate config properties with substitutions.
 	configMap := buildConfigMap(&cfg)
 	replacer := replacerFromMap(configMap)
@@ -946,6 +1086,11 @@ func ParseConfiguration(ctx context.Context, configurationFilePath string, opts
 	cfg.Package.Version = replacer.Replace(cfg.Package.Version)
 	cfg.Package.Description = replacer.Replace(cfg.Package.Description)
 
+	// The package name and version may refer to variables, such as those of
+	// a variant, so the names of subpackages are substituted with their
+	// substituted values.
+	replacer = replacerFromMap(buildConfigMap(&cfg))
+
 	subpackages = []Subpackage{}
 
 	for _, sp := range cfg.Subpackages {
@@ -957,19 +1102,26 @@ func ParseConfiguration(ctx context.Context, configurationFilePath string, opts
 
 	cfg.Subpackages = subpackages
 
-	if err := cfg.applySubstitutionsForProvides(); err != nil {
+	nw := buildConfigMap(&cfg)
+	// Allowed references to variables that are not defined are left in
+	// place, as written.
+	for _, ref := range unresolved {
+		nw[ref.Name] = fmt.Sprintf("${{%s}}", ref.Name)
+	}
+
+	if err := cfg.applySubstitutionsForProvides(nw); err != nil {
 		return nil, err
 	}
-	if err := cfg.applySubstitutionsForRuntime(); err != nil {
+	if err := cfg.applySubstitutionsForRuntime(nw); err != nil {
 		return nil, err
 	}
-	if err := cfg.applySubstitutionsForReplaces(); err != nil {
+	if err := cfg.applySubstitutionsForReplaces(nw); err != nil {
 		return nil, err
 	}
-	if err := cfg.applySubstitutionsForPackages(); err != nil {
+	if err := cfg.applySubstitutionsForPackages(nw); err != nil {
 		return nil, err
 	}
-	if err := cfg.applySubstitutionsForPriorities(); err != nil {
+	if err := cfg.applySubstitutionsForPriorities(nw); err != nil {
 		return nil, err
 	}
 
@@ -998,6 +1150,11 @@ func (cfg Configuration) Root() *yaml.Node {
 	return cfg.root
 }
 
+// IncludedFiles returns the files merged into the configuration by include.
+func (cfg Configuration) IncludedFiles() []string {
+	return cfg.includedFiles
+}
+
 type ErrInvalidConfiguration struct {
 	Problem error
 }
@@ -1029,6 +1186,9 @@ func (cfg Configuration) validate() error {
 	if err := validatePipelines(cfg.Pipeline); err != nil {
 		return ErrInvalidConfiguration{Problem: err}
 	}
+	if err := cfg.validateArchOverrides(); err != nil {
+		return ErrInvalidConfiguration{Problem: err}
+	}
 
 	saw := map[string]int{}
 	for i, sp := range cfg.Subpackages {
@@ -1065,6 +1225,19 @@ func validatePipelines(ps []Pipeline) error {
 			return fmt.Errorf("pipeline cannot contain both with and runs")
 		}
 
+		if p.Timeout < 0 {
+			return fmt.Errorf("pipeline timeout must not be negative")
+		}
+
+		if p.Retry != nil {
+			if p.Retry.Attempts < 1 {
+				return fmt.Errorf("pipeline retry attempts must be at least 1")
+			}
+			if p.Retry.Backoff < 0 {
+				return fmt.Errorf("pipeline retry backoff must not be negative")
+			}
+		}
+
 		if err := validatePipelines(p.Pipeline); err != nil {
 			return err
 		}
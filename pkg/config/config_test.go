@@ -1,10 +1,13 @@
 package config
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	apko_types "chainguard.dev/apko/pkg/build/types"
 	"github.com/chainguard-dev/clog/slogtest"
 	"github.com/stretchr/testify/require"
 )
@@ -177,6 +180,112 @@ subpackages:
 	require.Equal(t, cfg.Subpackages[0].Dependencies.ReplacesPriority, "10")
 }
 
+func Test_rangeCombinations(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	fp := filepath.Join(os.TempDir(), "melange-test-rangeCombinations")
+	if err := os.WriteFile(fp, []byte(`
+package:
+  name: range-combinations
+  version: 0.0.1
+  epoch: 7
+  description: example using several ranges in subpackages
+
+data:
+  - name: modules
+    items:
+      foo:
+        path: lib/foo
+      bar:
+        path: lib/bar
+  - name: locales
+    items:
+      de: German
+      fr: French
+
+subpackages:
+  - ranges:
+      - modules
+      - locales
+    range-if: ${{range.modules.key}} != 'bar' || ${{range.locales.key}} == 'de'
+    name: ${{package.name}}-${{range.modules.key}}-${{range.locales.key}}
+    description: ${{range.path}} in ${{range.value}}
+    pipeline:
+      - runs: install ${{range.path}}/${{range.locales.key}}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ParseConfiguration(ctx, fp)
+	if err != nil {
+		t.Fatalf("failed to parse configuration: %s", err)
+	}
+
+	names := []string{}
+	for _, sp := range cfg.Subpackages {
+		names = append(names, sp.Name)
+	}
+	require.Equal(t, []string{
+		"range-combinations-bar-de",
+		"range-combinations-foo-de",
+		"range-combinations-foo-fr",
+	}, names)
+	require.Equal(t, "lib/foo in French", cfg.Subpackages[2].Description)
+	require.Equal(t, "install lib/foo/fr", cfg.Subpackages[2].Pipeline[0].Runs)
+}
+
+func Test_rangePipelines(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	fp := filepath.Join(t.TempDir(), "melange.yaml")
+	if err := os.WriteFile(fp, []byte(`
+package:
+  name: range-pipelines
+  version: 0.0.1
+  epoch: 0
+
+data:
+  - name: modules
+    items:
+      foo: lib/foo
+
+subpackages:
+  - range: modules
+    name: ${{package.name}}-${{range.key}}
+    pipeline:
+      - name: install ${{range.key}}
+        runs: install ${{range.value}}
+        retry:
+          attempts: 3
+          backoff: 1s
+        timeout: 10m
+        continue-on-error: true
+        pipeline:
+          - runs: strip ${{range.value}}
+    test:
+      pipeline:
+        - runs: test -d ${{range.value}}
+          timeout: 1m
+          continue-on-error: true
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ParseConfiguration(ctx, fp)
+	require.NoError(t, err)
+	require.Len(t, cfg.Subpackages, 1)
+
+	p := cfg.Subpackages[0].Pipeline[0]
+	require.Equal(t, "install lib/foo", p.Runs)
+	require.Equal(t, &PipelineRetry{Attempts: 3, Backoff: time.Second}, p.Retry)
+	require.Equal(t, 10*time.Minute, p.Timeout)
+	require.True(t, p.ContinueOnError)
+	require.Equal(t, "strip lib/foo", p.Pipeline[0].Runs)
+
+	tp := cfg.Subpackages[0].Test.Pipeline[0]
+	require.Equal(t, "test -d lib/foo", tp.Runs)
+	require.Equal(t, time.Minute, tp.Timeout)
+	require.True(t, tp.ContinueOnError)
+}
+
 func Test_propagatePipelines(t *testing.T) {
 	ctx := slogtest.TestContextWithLogger(t)
 
@@ -364,6 +473,27 @@ func TestValidatePipelines(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "valid pipeline with retry",
+			p: []Pipeline{
+				{Runs: "make check", Retry: &PipelineRetry{Attempts: 3, Backoff: time.Second, ExitCodes: []int{75}}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid pipeline with no retry attempts",
+			p: []Pipeline{
+				{Runs: "make check", Retry: &PipelineRetry{}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid nested pipeline with negative retry backoff",
+			p: []Pipeline{
+				{Pipeline: []Pipeline{{Runs: "make check", Retry: &PipelineRetry{Attempts: 2, Backoff: -time.Second}}}},
+			},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -375,3 +505,481 @@ func TestValidatePipelines(t *testing.T) {
 		})
 	}
 }
+
+func TestInputValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   Input
+		wantErr bool
+	}{
+		{name: "untyped", input: Input{Default: "anything"}},
+		{name: "int", input: Input{Type: "int", Default: "1"}},
+		{name: "enum", input: Input{Type: "enum", Values: []string{"gz", "xz"}, Default: "xz"}},
+		{name: "substituted default", input: Input{Type: "int", Default: "${{vars.jobs}}"}},
+		{name: "unknown type", input: Input{Type: "float"}, wantErr: true},
+		{name: "enum without values", input: Input{Type: "enum"}, wantErr: true},
+		{name: "invalid pattern", input: Input{Pattern: "["}, wantErr: true},
+		{name: "invalid default", input: Input{Type: "bool", Default: "yes"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.input.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestInputCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   Input
+		value   string
+		wantErr bool
+	}{
+		{name: "string", input: Input{}, value: "hello world"},
+		{name: "bool", input: Input{Type: "bool"}, value: "false"},
+		{name: "not a bool", input: Input{Type: "bool"}, value: "no", wantErr: true},
+		{name: "int", input: Input{Type: "int"}, value: "-1"},
+		{name: "not an int", input: Input{Type: "int"}, value: "5s", wantErr: true},
+		{name: "enum", input: Input{Type: "enum", Values: []string{"gz", "xz"}}, value: "gz"},
+		{name: "not in enum", input: Input{Type: "enum", Values: []string{"gz", "xz"}}, value: "zst", wantErr: true},
+		{name: "path", input: Input{Type: "path"}, value: "src/foo"},
+		{name: "not a path", input: Input{Type: "path"}, value: "src\nfoo", wantErr: true},
+		{name: "pattern", input: Input{Pattern: "^[0-9a-f]+$"}, value: "deadbeef"},
+		{name: "pattern mismatch", input: Input{Pattern: "^[0-9a-f]+$"}, value: "main", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.input.Check(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Check(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWithPositions(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	fp := filepath.Join(t.TempDir(), "melange.yaml")
+	if err := os.WriteFile(fp, []byte(`
+package:
+  name: positions
+  version: 0.0.1
+
+pipeline:
+  - uses: fetch
+    with:
+      uri: https://example.com/foo.tar.gz
+      strip-components: 2
+
+subpackages:
+  - name: positions-dev
+    pipeline:
+      - pipeline:
+          - uses: split/dev
+            with:
+              package: positions
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := ParseConfiguration(ctx, fp)
+	require.NoError(t, err)
+
+	pos, ok := cfg.Pipeline[0].WithPosition("strip-components")
+	require.True(t, ok)
+	require.Equal(t, Position{Line: 10, Column: 25}, pos)
+
+	pos, ok = cfg.Subpackages[0].Pipeline[0].Pipeline[0].WithPosition("package")
+	require.True(t, ok)
+	require.Equal(t, Position{Line: 18, Column: 24}, pos)
+
+	_, ok = cfg.Pipeline[0].WithPosition("expected-sha256")
+	require.False(t, ok)
+}
+
+func TestReferencePositions(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	fp := filepath.Join(t.TempDir(), "melange.yaml")
+	if err := os.WriteFile(fp, []byte(`
+package:
+  name: positions
+  version: 0.0.1
+
+pipeline:
+  - uses: fetch
+    with:
+      uri: "https://example.com/foo-${{vars.mangled}}.tar.gz"
+  - runs: |
+      echo start
+      make install VERSION=${{vars.version}}
+  - if: ${{build.arch}} == 'x86_64'
+    runs: >
+      echo ${{vars.folded}}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := ParseConfiguration(ctx, fp)
+	require.NoError(t, err)
+
+	pos, ok := cfg.Pipeline[0].ReferencePosition("with.uri", 24, "${{vars.mangled}}")
+	require.True(t, ok)
+	require.Equal(t, Position{Line: 9, Column: 37}, pos)
+
+	pos, ok = cfg.Pipeline[1].ReferencePosition("runs", 32, "${{vars.version}}")
+	require.True(t, ok)
+	require.Equal(t, Position{Line: 12, Column: 28}, pos)
+
+	pos, ok = cfg.Pipeline[2].ReferencePosition("if", 0, "${{build.arch}}")
+	require.True(t, ok)
+	require.Equal(t, Position{Line: 13, Column: 9}, pos)
+
+	// References that cannot be located are reported at their value.
+	pos, ok = cfg.Pipeline[2].ReferencePosition("runs", 5, "${{vars.folded}}")
+	require.True(t, ok)
+	require.Equal(t, Position{Line: 14, Column: 11}, pos)
+
+	_, ok = cfg.Pipeline[0].ReferencePosition("runs", 0, "${{vars.mangled}}")
+	require.False(t, ok)
+}
+
+func TestParseConfigurationUnresolved(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	fp := filepath.Join(t.TempDir(), "melange.yaml")
+	if err := os.WriteFile(fp, []byte(`
+package:
+  name: unresolved
+  version: 0.0.1
+  dependencies:
+    runtime:
+      - foo=${{package.version}}
+      - bar-${{vars.mangled-verison}}
+
+environment:
+  contents:
+    packages:
+      - "baz-${{vars.typo | major}}"
+
+vars:
+  mangled-version: 0_0_1
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := ParseConfiguration(ctx, fp)
+	var uerr *UnresolvedError
+	require.ErrorAs(t, err, &uerr)
+	require.Len(t, uerr.References, 2)
+	require.Equal(t, "line 8, column 13: variable ${{vars.mangled-verison}} in package.dependencies.runtime is not defined", uerr.References[0].String())
+	require.Equal(t, "line 13, column 14: variable ${{vars.typo | major}} in environment.contents.packages is not defined", uerr.References[1].String())
+
+	cfg, err := ParseConfiguration(ctx, fp, WithAllowUnresolved(true))
+	require.NoError(t, err)
+	require.Equal(t, []string{"foo=0.0.1", "bar-${{vars.mangled-verison}}"}, cfg.Package.Dependencies.Runtime)
+	require.Equal(t, []string{"baz-${{vars.typo | major}}"}, cfg.Environment.Contents.Packages)
+}
+
+func TestParseConfigurationInclude(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	dir, search := t.TempDir(), t.TempDir()
+	write := func(p, content string) {
+		t.Helper()
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+		require.NoError(t, os.WriteFile(p, []byte(content), 0o644))
+	}
+
+	write(filepath.Join(dir, "common", "env.yaml"), `
+include:
+  - base.yaml
+environment:
+  contents:
+    packages:
+      - busybox
+      - ca-certificates-bundle
+  environment:
+    CGO_ENABLED: "0"
+`)
+	write(filepath.Join(dir, "common", "base.yaml"), `
+environment:
+  contents:
+    packages:
+      - build-base
+vars:
+  prefix: /usr
+`)
+	write(filepath.Join(search, "lint.yaml"), `
+package:
+  checks:
+    disabled:
+      - empty
+`)
+	fp := filepath.Join(dir, "melange.yaml")
+	write(fp, `
+package:
+  name: include
+  version: 0.0.1
+
+include:
+  - common/env.yaml
+  - lint.yaml
+
+environment:
+  contents:
+    packages:
+      - busybox
+      - go-${{vars.go}}
+  environment:
+    CGO_ENABLED: "1"
+
+pipeline:
+  - runs: make install PREFIX=${{vars.prefix}}
+
+vars:
+  go: "1.22"
+`)
+
+	cfg, err := ParseConfiguration(ctx, fp, WithIncludeDirs([]string{search}))
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"build-base", "busybox", "ca-certificates-bundle", "go-1.22"}, cfg.Environment.Contents.Packages)
+	require.Equal(t, "1", cfg.Environment.Environment["CGO_ENABLED"])
+	require.Equal(t, map[string]string{"prefix": "/usr", "go": "1.22"}, cfg.Vars)
+	require.Equal(t, []string{"empty"}, cfg.Package.Checks.Disabled)
+	require.Equal(t, []string{
+		filepath.Join(dir, "common", "base.yaml"),
+		filepath.Join(dir, "common", "env.yaml"),
+		filepath.Join(search, "lint.yaml"),
+	}, cfg.IncludedFiles())
+
+	// Positions are still those in the configuration file.
+	pos, ok := cfg.Pipeline[0].ReferencePosition("runs", 20, "${{vars.prefix}}")
+	require.True(t, ok)
+	require.Equal(t, Position{Line: 19, Column: 31}, pos)
+
+	_, err = ParseConfiguration(ctx, fp)
+	require.ErrorContains(t, err, `included file "lint.yaml" not found`)
+}
+
+func TestParseConfigurationArchOverrides(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	fp := filepath.Join(t.TempDir(), "melange.yaml")
+	if err := os.WriteFile(fp, []byte(`
+package:
+  name: overrides
+  version: 0.0.1
+  dependencies:
+    runtime:
+      - foo
+    provides:
+      - bar=${{package.full-version}}
+
+environment:
+  contents:
+    packages:
+      - busybox
+      - gcc
+
+vars:
+  jit: enabled
+
+arch-overrides:
+  aarch64:
+    vars:
+      jit: disabled
+    environment:
+      contents:
+        packages:
+          remove:
+            - gcc
+          add:
+            - clang
+    dependencies:
+      runtime:
+        - foo-${{vars.jit}}
+    checks:
+      disabled:
+        - empty
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := ParseConfiguration(ctx, fp, WithArch(apko_types.ParseArchitecture("arm64")))
+	require.NoError(t, err)
+	require.Equal(t, "disabled", cfg.Vars["jit"])
+	require.Equal(t, []string{"busybox", "clang"}, cfg.Environment.Contents.Packages)
+	require.Equal(t, []string{"foo-disabled"}, cfg.Package.Dependencies.Runtime)
+	require.Equal(t, []string{"bar=0.0.1-r0"}, cfg.Package.Dependencies.Provides)
+	require.Equal(t, []string{"empty"}, cfg.Package.Checks.Disabled)
+
+	cfg, err = ParseConfiguration(ctx, fp, WithArch(apko_types.ParseArchitecture("x86_64")))
+	require.NoError(t, err)
+	require.Equal(t, "enabled", cfg.Vars["jit"])
+	require.Equal(t, []string{"busybox", "gcc"}, cfg.Environment.Contents.Packages)
+	require.Equal(t, []string{"foo"}, cfg.Package.Dependencies.Runtime)
+	require.Empty(t, cfg.Package.Checks.Disabled)
+}
+
+func TestParseConfigurationVariants(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	fp := filepath.Join(t.TempDir(), "melange.yaml")
+	if err := os.WriteFile(fp, []byte(`
+package:
+  name: py${{vars.python}}-foo
+  version: 0.0.1
+  dependencies:
+    runtime:
+      - python-${{vars.python}}
+
+environment:
+  contents:
+    packages:
+      - python-${{vars.python}}-dev
+
+variants:
+  python:
+    - "3.11"
+    - "3.12"
+  libc:
+    - glibc
+    - value: musl
+      vars:
+        cflags: -static
+      environment:
+        contents:
+          packages:
+            add:
+              - musl-dev
+
+subpackages:
+  - name: ${{package.name}}-doc
+    dependencies:
+      runtime:
+        - ${{package.name}}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := ParseConfiguration(ctx, fp)
+	require.NoError(t, err)
+	require.Equal(t, []Variant{
+		{"libc": "glibc", "python": "3.11"},
+		{"libc": "glibc", "python": "3.12"},
+		{"libc": "musl", "python": "3.11"},
+		{"libc": "musl", "python": "3.12"},
+	}, cfg.VariantMatrix())
+	// The first variant is used by default.
+	require.Equal(t, "libc=glibc,python=3.11", cfg.Variant().String())
+	require.Equal(t, "py3.11-foo", cfg.Package.Name)
+
+	cfg, err = ParseConfiguration(ctx, fp, WithVariant(Variant{"libc": "musl", "python": "3.12"}))
+	require.NoError(t, err)
+	require.Equal(t, "py3.12-foo", cfg.Package.Name)
+	require.Equal(t, "py3.12-foo-doc", cfg.Subpackages[0].Name)
+	require.Equal(t, []string{"py3.12-foo"}, cfg.Subpackages[0].Dependencies.Runtime)
+	require.Equal(t, []string{"python-3.12"}, cfg.Package.Dependencies.Runtime)
+	require.Equal(t, []string{"python-3.12-dev", "musl-dev"}, cfg.Environment.Contents.Packages)
+	require.Equal(t, "-static", cfg.Vars["cflags"])
+
+	selector, err := ParseVariantSelector([]string{"python=3.12"})
+	require.NoError(t, err)
+	require.True(t, cfg.Variant().Matches(selector))
+
+	_, err = ParseConfiguration(ctx, fp, WithVariant(Variant{"libc": "uclibc", "python": "3.12"}))
+	require.ErrorContains(t, err, `"uclibc" is not a value of axis "libc"`)
+}
+
+func TestParseConfigurationStrict(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	fp := filepath.Join(t.TempDir(), "melange.yaml")
+	if err := os.WriteFile(fp, []byte(`
+package:
+  name: strict
+  version: 0.0.1
+  dependencies:
+    runtim:
+      - foo
+
+pipline:
+  - runs: echo
+
+subpackages:
+  - name: strict-doc
+    pipeline:
+      - runs: echo
+        wiht:
+          foo: bar
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := ParseConfiguration(ctx, fp, WithStrict(true))
+	require.ErrorAs(t, err, &ErrInvalidConfiguration{})
+	var serr *SchemaError
+	require.ErrorAs(t, err, &serr)
+	require.Equal(t, []SchemaProblem{{
+		Path:       "package.dependencies",
+		Problem:    `unknown key "runtim"`,
+		Suggestion: "runtime",
+		File:       fp,
+		Position:   &Position{Line: 6, Column: 5},
+	}, {
+		Problem:    `unknown key "pipline"`,
+		Suggestion: "pipeline",
+		File:       fp,
+		Position:   &Position{Line: 9, Column: 1},
+	}, {
+		Path:       "subpackages[0].pipeline[0]",
+		Problem:    `unknown key "wiht"`,
+		Suggestion: "with",
+		File:       fp,
+		Position:   &Position{Line: 16, Column: 9},
+	}}, serr.Problems)
+	require.Equal(t, fp+`:6:5: package.dependencies: unknown key "runtim", did you mean "runtime"?`, serr.Problems[0].String())
+
+	// Without strict validation, the problems are reported as warnings, but
+	// unknown keys are still an error.
+	_, err = ParseConfiguration(ctx, fp)
+	require.ErrorAs(t, err, &ErrInvalidConfiguration{})
+	require.ErrorAs(t, err, &serr)
+	require.Len(t, serr.Problems, 3)
+
+	// Without strict validation, other problems are only warned about, and
+	// left to the decoder.
+	if err := os.WriteFile(fp, []byte(`
+package:
+  name: strict
+  version: 0.0.1
+  dependencies:
+    runtime: foo
+
+pipeline:
+  - runs: echo
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ParseConfiguration(ctx, fp, WithStrict(true))
+	require.ErrorAs(t, err, &serr)
+	require.Equal(t, []SchemaProblem{{
+		Path:     "package.dependencies.runtime",
+		Problem:  "expected a list, found a scalar",
+		File:     fp,
+		Position: &Position{Line: 6, Column: 14},
+	}}, serr.Problems)
+
+	_, err = ParseConfiguration(ctx, fp)
+	require.ErrorContains(t, err, "cannot unmarshal")
+	require.False(t, errors.As(err, &serr))
+}
@@ -0,0 +1,105 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SortKeys orders the keys of the mappings of the configuration document in
+// root in canonical order: the order of the fields of Configuration, and of
+// the types of its fields, recursively.  Keys that are not fields, and the
+// keys of maps such as vars, keep their order, after the fields.  Comments
+// stay with the keys and values they are attached to.
+func SortKeys(root *yaml.Node) {
+	if root == nil || root.Kind != yaml.DocumentNode {
+		return
+	}
+	for _, doc := range root.Content {
+		sortKeys(doc, reflect.TypeOf(Configuration{}))
+	}
+}
+
+func sortKeys(node *yaml.Node, t reflect.Type) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch node.Kind {
+	case yaml.SequenceNode:
+		if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+			return
+		}
+		for _, n := range node.Content {
+			sortKeys(n, t.Elem())
+		}
+
+	case yaml.MappingNode:
+		switch t.Kind() {
+		case reflect.Map:
+			for i := 1; i < len(node.Content); i += 2 {
+				sortKeys(node.Content[i], t.Elem())
+			}
+
+		case reflect.Struct:
+			fields := yamlFields(t)
+			pairs := make([][2]*yaml.Node, 0, len(node.Content)/2)
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				pairs = append(pairs, [2]*yaml.Node{node.Content[i], node.Content[i+1]})
+			}
+			rank := func(key *yaml.Node) int {
+				if f, ok := fields[key.Value]; ok {
+					return f.Index[0]
+				}
+				return t.NumField()
+			}
+			sort.SliceStable(pairs, func(i, j int) bool {
+				return rank(pairs[i][0]) < rank(pairs[j][0])
+			})
+
+			node.Content = node.Content[:0]
+			for _, p := range pairs {
+				if f, ok := fields[p[0].Value]; ok {
+					sortKeys(p[1], f.Type)
+				}
+				node.Content = append(node.Content, p[0], p[1])
+			}
+		}
+	}
+}
+
+// yamlFields returns the fields of the struct type t by their names in YAML.
+func yamlFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		switch name {
+		case "-":
+			continue
+		case "":
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f
+	}
+	return fields
+}
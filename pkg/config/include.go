@@ -0,0 +1,280 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// includeSource is a configuration file or fragment, in a file system or, if
+// fsys is nil, in the OS file system.
+type includeSource struct {
+	fsys fs.FS
+	path string
+}
+
+func (s includeSource) String() string {
+	return s.path
+}
+
+func (s includeSource) read() ([]byte, error) {
+	if s.fsys != nil {
+		return fs.ReadFile(s.fsys, s.path)
+	}
+	return os.ReadFile(s.path)
+}
+
+func (s includeSource) exists() bool {
+	var err error
+	if s.fsys != nil {
+		_, err = fs.Stat(s.fsys, s.path)
+	} else {
+		_, err = os.Stat(s.path)
+	}
+	return err == nil
+}
+
+// resolve returns the fragment name included by the source, which is looked
+// up relative to the source, then in each of dirs.
+func (s includeSource) resolve(name string, dirs []string) (includeSource, error) {
+	if filepath.IsAbs(name) {
+		return includeSource{path: name}, nil
+	}
+
+	candidates := []includeSource{}
+	if s.fsys != nil {
+		candidates = append(candidates, includeSource{fsys: s.fsys, path: path.Join(path.Dir(s.path), name)})
+	} else {
+		candidates = append(candidates, includeSource{path: filepath.Join(filepath.Dir(s.path), name)})
+	}
+	for _, dir := range dirs {
+		candidates = append(candidates, includeSource{path: filepath.Join(dir, name)})
+	}
+
+	for _, c := range candidates {
+		if c.exists() {
+			return c, nil
+		}
+	}
+	return includeSource{}, fmt.Errorf("included file %q not found relative to %s or in the include directories", name, s)
+}
+
+type includer struct {
+	dirs []string
+	// The files being included, to detect cycles
+	active map[string]bool
+	// The files included, in the order they were merged
+	files []string
+}
+
+// includeFragments merges the fragments included by the configuration
+// document in root, parsed from src, into it.  Fragments are merged in the
+// order they are listed, each taking precedence over the ones before it, and
+// the configuration takes precedence over all of them.  Fragments can include
+// other fragments.  It returns the files that were merged.
+//
+// Mappings are merged key by key.  Sequences are concatenated, the entries of
+// the fragments first, without repeating scalar entries.  Otherwise, the
+// value taking precedence replaces the other.
+func includeFragments(root *yaml.Node, src includeSource, dirs []string) ([]string, error) {
+	inc := &includer{
+		dirs:   dirs,
+		active: map[string]bool{src.String(): true},
+	}
+	if err := inc.include(root, src); err != nil {
+		return nil, err
+	}
+	return inc.files, nil
+}
+
+func (inc *includer) include(root *yaml.Node, src includeSource) error {
+	if root.Kind != yaml.DocumentNode || len(root.Content) == 0 {
+		return nil
+	}
+	doc := root.Content[0]
+
+	names := mappingValue(doc, "include")
+	if names == nil {
+		return nil
+	}
+	if names.Kind != yaml.SequenceNode {
+		return fmt.Errorf("%s: include must be a list of files", src)
+	}
+
+	var merged *yaml.Node
+	for _, name := range names.Content {
+		if name.Kind != yaml.ScalarNode {
+			return fmt.Errorf("%s: include must be a list of files", src)
+		}
+
+		fsrc, err := src.resolve(name.Value, inc.dirs)
+		if err != nil {
+			return err
+		}
+		if inc.active[fsrc.String()] {
+			return fmt.Errorf("%s: include cycle through %s", src, fsrc)
+		}
+
+		data, err := fsrc.read()
+		if err != nil {
+			return fmt.Errorf("reading included file: %w", err)
+		}
+		fragment := yaml.Node{}
+		if err := yaml.Unmarshal(data, &fragment); err != nil {
+			return fmt.Errorf("parsing included file %s: %w", fsrc, err)
+		}
+		if len(fragment.Content) == 0 {
+			continue
+		}
+
+		inc.active[fsrc.String()] = true
+		err = inc.include(&fragment, fsrc)
+		delete(inc.active, fsrc.String())
+		if err != nil {
+			return err
+		}
+		inc.files = append(inc.files, fsrc.String())
+
+		fdoc := fragment.Content[0]
+		if fdoc.Kind != yaml.MappingNode {
+			return fmt.Errorf("included file %s must be a mapping", fsrc)
+		}
+		removeKey(fdoc, "include")
+		// Positions are reported relative to the configuration file, so
+		// the nodes of fragments have none.
+		clearPositions(fdoc)
+
+		if merged == nil {
+			merged = fdoc
+			continue
+		}
+		if merged, err = mergeNodes(merged, fdoc); err != nil {
+			return fmt.Errorf("merging included file %s: %w", fsrc, err)
+		}
+	}
+
+	if merged == nil {
+		return nil
+	}
+
+	doc, err := mergeNodes(merged, doc)
+	if err != nil {
+		return fmt.Errorf("%s: %w", src, err)
+	}
+	root.Content[0] = doc
+
+	return nil
+}
+
+// mergeNodes merges the nodes low and high, high taking precedence.
+func mergeNodes(low, high *yaml.Node) (*yaml.Node, error) {
+	if isNull(high) {
+		return low, nil
+	}
+	if isNull(low) {
+		return high, nil
+	}
+
+	if low.Kind != high.Kind {
+		err := fmt.Errorf("cannot merge %s into %s", kindName(low), kindName(high))
+		if high.Line > 0 {
+			err = fmt.Errorf("%s: %w", Position{Line: high.Line, Column: high.Column}, err)
+		}
+		return nil, err
+	}
+
+	switch high.Kind {
+	case yaml.MappingNode:
+		out := *high
+		out.Content = nil
+		for i := 0; i+1 < len(low.Content); i += 2 {
+			key, value := low.Content[i], low.Content[i+1]
+			if hv := mappingValue(high, key.Value); hv != nil {
+				merged, err := mergeNodes(value, hv)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", key.Value, err)
+				}
+				value = merged
+			}
+			out.Content = append(out.Content, key, value)
+		}
+		for i := 0; i+1 < len(high.Content); i += 2 {
+			if mappingValue(low, high.Content[i].Value) == nil {
+				out.Content = append(out.Content, high.Content[i], high.Content[i+1])
+			}
+		}
+		return &out, nil
+
+	case yaml.SequenceNode:
+		out := *high
+		out.Content = append([]*yaml.Node{}, low.Content...)
+		seen := map[string]bool{}
+		for _, n := range low.Content {
+			if n.Kind == yaml.ScalarNode {
+				seen[n.Value] = true
+			}
+		}
+		for _, n := range high.Content {
+			if n.Kind == yaml.ScalarNode && seen[n.Value] {
+				continue
+			}
+			out.Content = append(out.Content, n)
+		}
+		return &out, nil
+
+	default:
+		return high, nil
+	}
+}
+
+func isNull(node *yaml.Node) bool {
+	return node.Kind == yaml.ScalarNode && node.Tag == "!!null"
+}
+
+func kindName(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.MappingNode:
+		return "a mapping"
+	case yaml.SequenceNode:
+		return "a list"
+	case yaml.AliasNode:
+		return "an alias"
+	default:
+		return "a scalar"
+	}
+}
+
+// removeKey removes key and its value from a mapping node.
+func removeKey(node *yaml.Node, key string) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content = append(node.Content[:i], node.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+func clearPositions(node *yaml.Node) {
+	node.Line, node.Column = 0, 0
+	for _, n := range node.Content {
+		clearPositions(n)
+	}
+}
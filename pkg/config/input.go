@@ -0,0 +1,95 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The types an Input can have.
+const (
+	InputTypeString = "string"
+	InputTypeBool   = "bool"
+	InputTypeInt    = "int"
+	InputTypeEnum   = "enum"
+	InputTypePath   = "path"
+)
+
+// Validate checks that the declaration of the input is well formed, and that
+// its default value, unless it needs substituting, is a valid value.
+func (i Input) Validate() error {
+	switch i.Type {
+	case "", InputTypeString, InputTypeBool, InputTypeInt, InputTypePath:
+	case InputTypeEnum:
+		if len(i.Values) == 0 {
+			return errors.New("enum input must list its values")
+		}
+	default:
+		return fmt.Errorf("unknown input type %q", i.Type)
+	}
+
+	if i.Pattern != "" {
+		if _, err := regexp.Compile(i.Pattern); err != nil {
+			return fmt.Errorf("invalid pattern: %w", err)
+		}
+	}
+
+	if i.Default != "" && !strings.Contains(i.Default, "${{") {
+		if err := i.Check(i.Default); err != nil {
+			return fmt.Errorf("invalid default: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Check reports whether value is a valid value for the input.
+func (i Input) Check(value string) error {
+	switch i.Type {
+	case InputTypeBool:
+		if value != "true" && value != "false" {
+			return fmt.Errorf("expected true or false, got %q", value)
+		}
+	case InputTypeInt:
+		if _, err := strconv.Atoi(value); err != nil {
+			return fmt.Errorf("expected an integer, got %q", value)
+		}
+	case InputTypePath:
+		if strings.ContainsAny(value, "\x00\n") {
+			return fmt.Errorf("expected a path, got %q", value)
+		}
+	}
+
+	if len(i.Values) > 0 && !slices.Contains(i.Values, value) {
+		return fmt.Errorf("expected one of %s, got %q", strings.Join(i.Values, ", "), value)
+	}
+
+	if i.Pattern != "" {
+		re, err := regexp.Compile(i.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern: %w", err)
+		}
+		if !re.MatchString(value) {
+			return fmt.Errorf("%q does not match %q", value, i.Pattern)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,207 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Position is a location in a configuration file.
+type Position struct {
+	Line   int
+	Column int
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("line %d, column %d", p.Line, p.Column)
+}
+
+// fieldPosition is where the value of a field of a pipeline is in the
+// configuration file.
+type fieldPosition struct {
+	Position
+	value string
+	// The positions of the ${{}} expressions in the value, by their offset
+	refs map[int]Position
+}
+
+// WithPosition returns the position of the with parameter key in the
+// configuration file the pipeline was parsed from, if it is known.
+func (p *Pipeline) WithPosition(key string) (Position, bool) {
+	fp, ok := p.positions["with."+key]
+	if !ok {
+		return Position{}, false
+	}
+	return fp.Position, true
+}
+
+// ReferencePosition returns the position of the ${{}} expression text, at
+// offset off of the value of a field of the pipeline, in the configuration
+// file the pipeline was parsed from.  The field is one of runs, if,
+// working-directory or with.<key>.  If the expression cannot be located, the
+// position of the value is returned.
+func (p *Pipeline) ReferencePosition(field string, off int, text string) (Position, bool) {
+	fp, ok := p.positions[field]
+	if !ok {
+		return Position{}, false
+	}
+	if pos, ok := fp.refs[off]; ok && strings.HasPrefix(fp.value[off:], text) {
+		return pos, true
+	}
+	return fp.Position, true
+}
+
+// mappingValue returns the value of key in a mapping node, or nil.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// scalarPosition returns where a scalar node and the ${{}} expressions in its
+// value are in the source lines it was parsed from.
+func scalarPosition(node *yaml.Node, lines []string) *fieldPosition {
+	fp := &fieldPosition{
+		Position: Position{Line: node.Line, Column: node.Column},
+		value:    node.Value,
+		refs:     map[int]Position{},
+	}
+
+	for off := 0; ; off += len("${{") {
+		i := strings.Index(node.Value[off:], "${{")
+		if i < 0 {
+			break
+		}
+		off += i
+
+		if pos, ok := referencePosition(node, lines, off); ok {
+			fp.refs[off] = pos
+		}
+	}
+
+	return fp
+}
+
+// referencePosition returns the position of the ${{ at offset off of the value
+// of a scalar node.  Only literal blocks and values on a single line are
+// mapped, and the position is checked against the source lines.
+func referencePosition(node *yaml.Node, lines []string, off int) (Position, bool) {
+	if node.Line == 0 {
+		return Position{}, false
+	}
+	before := node.Value[:off]
+	var pos Position
+
+	switch {
+	case node.Style&yaml.LiteralStyle != 0:
+		// The value starts on the line after the indicator, at the
+		// indentation of its first non-empty line.
+		indent := 0
+		for _, line := range lines[min(node.Line, len(lines)):] {
+			if trimmed := strings.TrimLeft(line, " "); trimmed != "" {
+				indent = len(line) - len(trimmed)
+				break
+			}
+		}
+		nl := strings.LastIndex(before, "\n")
+		pos = Position{
+			Line:   node.Line + 1 + strings.Count(before, "\n"),
+			Column: indent + utf8.RuneCountInString(before[nl+1:]) + 1,
+		}
+
+	case node.Style&yaml.FoldedStyle != 0:
+		return Position{}, false
+
+	default:
+		pos = Position{Line: node.Line, Column: node.Column + utf8.RuneCountInString(before)}
+		if node.Style&(yaml.SingleQuotedStyle|yaml.DoubleQuotedStyle) != 0 {
+			pos.Column++
+		}
+	}
+
+	if pos.Line < 1 || pos.Line > len(lines) {
+		return Position{}, false
+	}
+	line := []rune(lines[pos.Line-1])
+	if pos.Column+2 > len(line) || string(line[pos.Column-1:pos.Column+2]) != "${{" {
+		return Position{}, false
+	}
+
+	return pos, true
+}
+
+// recordPositions records where the values of the fields of the pipelines in
+// the configuration are in the source lines it was parsed from.  Values merged
+// from included fragments have no position.
+func (cfg *Configuration) recordPositions(root *yaml.Node, lines []string) {
+	if root == nil || root.Kind != yaml.DocumentNode || len(root.Content) == 0 {
+		return
+	}
+	doc := root.Content[0]
+
+	recordPipelinePositions(cfg.Pipeline, mappingValue(doc, "pipeline"), lines)
+	if cfg.Test != nil {
+		recordPipelinePositions(cfg.Test.Pipeline, mappingValue(mappingValue(doc, "test"), "pipeline"), lines)
+	}
+
+	subpackages := mappingValue(doc, "subpackages")
+	if subpackages == nil || subpackages.Kind != yaml.SequenceNode || len(subpackages.Content) != len(cfg.Subpackages) {
+		return
+	}
+	for i, node := range subpackages.Content {
+		sp := &cfg.Subpackages[i]
+		recordPipelinePositions(sp.Pipeline, mappingValue(node, "pipeline"), lines)
+		if sp.Test != nil {
+			recordPipelinePositions(sp.Test.Pipeline, mappingValue(mappingValue(node, "test"), "pipeline"), lines)
+		}
+	}
+}
+
+func recordPipelinePositions(pipelines []Pipeline, node *yaml.Node, lines []string) {
+	if node == nil || node.Kind != yaml.SequenceNode || len(node.Content) != len(pipelines) {
+		return
+	}
+
+	for i, n := range node.Content {
+		p := &pipelines[i]
+		p.positions = map[string]*fieldPosition{}
+
+		for _, field := range []string{"runs", "if", "working-directory"} {
+			if v := mappingValue(n, field); v != nil && v.Kind == yaml.ScalarNode && v.Line > 0 {
+				p.positions[field] = scalarPosition(v, lines)
+			}
+		}
+
+		if with := mappingValue(n, "with"); with != nil && with.Kind == yaml.MappingNode {
+			for j := 0; j+1 < len(with.Content); j += 2 {
+				if v := with.Content[j+1]; v.Kind == yaml.ScalarNode && v.Line > 0 {
+					p.positions["with."+with.Content[j].Value] = scalarPosition(v, lines)
+				}
+			}
+		}
+
+		recordPipelinePositions(p.Pipeline, mappingValue(n, "pipeline"), lines)
+	}
+}
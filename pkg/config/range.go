@@ -0,0 +1,179 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"sort"
+
+	"github.com/invopop/jsonschema"
+	"gopkg.in/yaml.v3"
+
+	"chainguard.dev/melange/pkg/cond"
+	"chainguard.dev/melange/pkg/util"
+)
+
+// DataItem is an item of a data set.  It is either a single value, written as
+// a scalar, or structured fields, written as a mapping.
+type DataItem struct {
+	// The value of the item, if it is a scalar
+	Value string
+	// The fields of the item, if it is a mapping
+	Fields map[string]string
+}
+
+// UnmarshalYAML decodes an item from a scalar or a mapping of fields.
+func (it *DataItem) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*it = DataItem{Value: node.Value}
+		return nil
+	}
+
+	fields := map[string]string{}
+	if err := node.Decode(&fields); err != nil {
+		return err
+	}
+	for _, f := range []string{"key", "value"} {
+		if _, ok := fields[f]; ok {
+			return fmt.Errorf("line %d: data item field %q is reserved", node.Line, f)
+		}
+	}
+	*it = DataItem{Fields: fields}
+	return nil
+}
+
+// MarshalYAML encodes the item as it is written.
+func (it DataItem) MarshalYAML() (any, error) {
+	if it.Fields != nil {
+		return it.Fields, nil
+	}
+	return it.Value, nil
+}
+
+// MarshalJSON encodes the item as it is written.
+func (it DataItem) MarshalJSON() ([]byte, error) {
+	if it.Fields != nil {
+		return json.Marshal(it.Fields)
+	}
+	return json.Marshal(it.Value)
+}
+
+// JSONSchema allows items to be written as scalars or mappings of fields in
+// the schema.
+func (DataItem) JSONSchema() *jsonschema.Schema {
+	return &jsonschema.Schema{
+		OneOf: []*jsonschema.Schema{
+			{Type: "string"},
+			{Type: "object", AdditionalProperties: &jsonschema.Schema{Type: "string"}},
+		},
+	}
+}
+
+// addVariables adds the range variables of the item with key in the data set
+// named set to vars: range.<set>.key, and range.<set>.value or
+// range.<set>.<field> for each of its fields.  The same variables without the
+// name of the set are added too, unless a previous data set defined them.
+func (it DataItem) addVariables(vars map[string]string, set, key string) {
+	add := func(name, value string) {
+		vars[fmt.Sprintf("${{range.%s.%s}}", set, name)] = value
+		nk := fmt.Sprintf("${{range.%s}}", name)
+		if _, ok := vars[nk]; !ok {
+			vars[nk] = value
+		}
+	}
+
+	add("key", key)
+	if it.Fields == nil {
+		add("value", it.Value)
+		return
+	}
+	for f, v := range it.Fields {
+		add(f, v)
+	}
+}
+
+func (items DataItems) keys() []string {
+	keys := make([]string, 0, len(items))
+	for k := range items {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// rangeNames returns the names of the data sets the subpackage ranges over.
+func (sp Subpackage) rangeNames() ([]string, error) {
+	if sp.Range != "" && len(sp.Ranges) > 0 {
+		return nil, fmt.Errorf("subpackage %q specifies both range and ranges", sp.Name)
+	}
+	if sp.Range != "" {
+		return []string{sp.Range}, nil
+	}
+	return sp.Ranges, nil
+}
+
+// rangeCombinations returns the substitutions of the range variables for each
+// combination of the items of the data sets the subpackage ranges over.  The
+// combinations are ordered by the items of the first data set, then the
+// second and so on, and the items of each set are ordered by key.  Those for
+// which the range-if condition of the subpackage is false are left out; the
+// condition is evaluated with the variables of the combination and nw.
+func (sp Subpackage) rangeCombinations(datas map[string]DataItems, nw map[string]string) ([]map[string]string, error) {
+	names, err := sp.rangeNames()
+	if err != nil {
+		return nil, err
+	}
+
+	combinations := []map[string]string{{}}
+	for _, name := range names {
+		items, ok := datas[name]
+		if !ok {
+			return nil, fmt.Errorf("subpackage %q specified undefined range: %q", sp.Name, name)
+		}
+
+		next := make([]map[string]string, 0, len(combinations)*len(items))
+		for _, c := range combinations {
+			for _, k := range items.keys() {
+				nc := maps.Clone(c)
+				items[k].addVariables(nc, name, k)
+				next = append(next, nc)
+			}
+		}
+		combinations = next
+	}
+
+	if sp.RangeIf == "" {
+		return combinations, nil
+	}
+
+	selected := make([]map[string]string, 0, len(combinations))
+	for _, c := range combinations {
+		expr, err := util.MutateAndQuoteStringFromMap(util.RightJoinMap(nw, c), sp.RangeIf)
+		if err != nil {
+			return nil, fmt.Errorf("subpackage %q: range-if: %w", sp.Name, err)
+		}
+
+		ok, err := cond.Evaluate(expr)
+		if err != nil {
+			return nil, fmt.Errorf("subpackage %q: evaluating range-if %q: %w", sp.Name, sp.RangeIf, err)
+		}
+		if ok {
+			selected = append(selected, c)
+		}
+	}
+	return selected, nil
+}
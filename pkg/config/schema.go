@@ -0,0 +1,284 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/invopop/jsonschema"
+	"gopkg.in/yaml.v3"
+)
+
+// A SchemaProblem is a part of a configuration that does not conform to the
+// schema of the configuration.
+type SchemaProblem struct {
+	// Where the problem is in the configuration, e.g.
+	// subpackages[0].dependencies
+	Path string
+	// What the problem is, e.g. unknown key "runtim"
+	Problem string
+	// What the configuration may have meant, e.g. runtime
+	Suggestion string
+	// The configuration file
+	File string
+	// The position of the problem in the configuration file, if known.  It
+	// is not known for problems in included files.
+	Position *Position
+}
+
+func (p SchemaProblem) String() string {
+	msg := p.Problem
+	if p.Path != "" {
+		msg = p.Path + ": " + msg
+	}
+	if p.Suggestion != "" {
+		msg += fmt.Sprintf(", did you mean %q?", p.Suggestion)
+	}
+
+	switch {
+	case p.Position != nil:
+		return fmt.Sprintf("%s:%d:%d: %s", p.File, p.Position.Line, p.Position.Column, msg)
+	case p.File != "":
+		return fmt.Sprintf("%s (included): %s", p.File, msg)
+	default:
+		return msg
+	}
+}
+
+// unknownKey reports whether the problem is a key the schema does not know.
+func (p SchemaProblem) unknownKey() bool {
+	return strings.HasPrefix(p.Problem, "unknown key ")
+}
+
+// SchemaError reports all the problems of a configuration that does not
+// conform to its schema.
+type SchemaError struct {
+	Problems []SchemaProblem
+}
+
+func (e *SchemaError) Error() string {
+	lines := make([]string, 0, len(e.Problems)+1)
+	lines = append(lines, fmt.Sprintf("%d problems with the configuration:", len(e.Problems)))
+	for _, p := range e.Problems {
+		lines = append(lines, "  "+p.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+type yamlUnmarshaler interface {
+	UnmarshalYAML(unmarshal func(any) error) error
+}
+
+type schemaDefiner interface {
+	JSONSchema() *jsonschema.Schema
+}
+
+type schemaExtender interface {
+	JSONSchemaExtend(*jsonschema.Schema)
+}
+
+// configurationSchema returns the schema of the configuration.  It is
+// reflected like the published schema, but with the names of the fields in
+// YAML, and allows anything for types that decode themselves without
+// describing their schema.
+var configurationSchema = sync.OnceValue(func() *jsonschema.Schema {
+	r := &jsonschema.Reflector{
+		FieldNameTag: "yaml",
+		// Fields without a name in their yaml tag are named in lower case.
+		KeyNamer: strings.ToLower,
+		Mapper: func(t reflect.Type) *jsonschema.Schema {
+			pt := reflect.PointerTo(t)
+			if pt.Implements(reflect.TypeFor[schemaDefiner]()) || pt.Implements(reflect.TypeFor[schemaExtender]()) {
+				return nil
+			}
+			if pt.Implements(reflect.TypeFor[yaml.Unmarshaler]()) || pt.Implements(reflect.TypeFor[yamlUnmarshaler]()) {
+				return &jsonschema.Schema{}
+			}
+			return nil
+		},
+	}
+	return r.Reflect(Configuration{})
+})
+
+type schemaValidator struct {
+	root     *jsonschema.Schema
+	file     string
+	problems []SchemaProblem
+}
+
+// validateSchema returns the problems of the configuration document in root,
+// parsed from file, with the schema of the configuration.
+func validateSchema(root *yaml.Node, file string) []SchemaProblem {
+	if root == nil || root.Kind != yaml.DocumentNode || len(root.Content) == 0 {
+		return nil
+	}
+	v := &schemaValidator{root: configurationSchema(), file: file}
+	v.validate(root.Content[0], v.root, "")
+	return v.problems
+}
+
+func (v *schemaValidator) report(node *yaml.Node, path, problem, suggestion string) {
+	p := SchemaProblem{
+		Path:       path,
+		Problem:    problem,
+		Suggestion: suggestion,
+		File:       v.file,
+	}
+	if node.Line > 0 {
+		p.Position = &Position{Line: node.Line, Column: node.Column}
+	}
+	v.problems = append(v.problems, p)
+}
+
+// resolve follows the references of the schema s to its definition.
+func (v *schemaValidator) resolve(s *jsonschema.Schema) *jsonschema.Schema {
+	for s != nil && s.Ref != "" {
+		s = v.root.Definitions[strings.TrimPrefix(s.Ref, "#/$defs/")]
+	}
+	return s
+}
+
+func (v *schemaValidator) validate(node *yaml.Node, s *jsonschema.Schema, path string) {
+	s = v.resolve(s)
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if s == nil || node == nil || isNull(node) {
+		return
+	}
+
+	if len(s.OneOf) > 0 {
+		v.validateOneOf(node, s, path)
+		return
+	}
+
+	switch s.Type {
+	case "object":
+		if node.Kind != yaml.MappingNode {
+			v.report(node, path, fmt.Sprintf("expected a mapping, found %s", kindName(node)), "")
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Value == "<<" {
+				continue
+			}
+
+			kpath := key.Value
+			if path != "" {
+				kpath = path + "." + key.Value
+			}
+			if s.Properties != nil {
+				if ps, ok := s.Properties.Get(key.Value); ok {
+					v.validate(value, ps, kpath)
+					continue
+				}
+			}
+			if s.AdditionalProperties == jsonschema.FalseSchema {
+				v.report(key, path, fmt.Sprintf("unknown key %q", key.Value), suggestKey(key.Value, s))
+				continue
+			}
+			v.validate(value, s.AdditionalProperties, kpath)
+		}
+
+	case "array":
+		if node.Kind != yaml.SequenceNode {
+			v.report(node, path, fmt.Sprintf("expected a list, found %s", kindName(node)), "")
+			return
+		}
+		for i, n := range node.Content {
+			v.validate(n, s.Items, fmt.Sprintf("%s[%d]", path, i))
+		}
+
+	case "string", "integer", "number", "boolean":
+		if node.Kind != yaml.ScalarNode {
+			v.report(node, path, fmt.Sprintf("expected a scalar, found %s", kindName(node)), "")
+		}
+	}
+}
+
+// validateOneOf validates the node against the first alternative of s it
+// conforms to.  If there is none, the problems with the alternative for the
+// kind of node are reported.
+func (v *schemaValidator) validateOneOf(node *yaml.Node, s *jsonschema.Schema, path string) {
+	var closest *jsonschema.Schema
+	for _, alt := range s.OneOf {
+		av := &schemaValidator{root: v.root, file: v.file}
+		av.validate(node, alt, path)
+		if len(av.problems) == 0 {
+			return
+		}
+		if closest == nil && kindMatches(node, v.resolve(alt)) {
+			closest = alt
+		}
+	}
+
+	if closest == nil {
+		v.report(node, path, fmt.Sprintf("unexpected %s", kindName(node)), "")
+		return
+	}
+	v.validate(node, closest, path)
+}
+
+func kindMatches(node *yaml.Node, s *jsonschema.Schema) bool {
+	switch s.Type {
+	case "object":
+		return node.Kind == yaml.MappingNode
+	case "array":
+		return node.Kind == yaml.SequenceNode
+	default:
+		return node.Kind == yaml.ScalarNode
+	}
+}
+
+// suggestKey returns the property of s that key is most likely a misspelling
+// of, or "" if there is none.
+func suggestKey(key string, s *jsonschema.Schema) string {
+	if s.Properties == nil {
+		return ""
+	}
+
+	best, bestDist := "", len(key)/3+2
+	for pair := s.Properties.Oldest(); pair != nil; pair = pair.Next() {
+		if d := editDistance(key, pair.Key); d < bestDist {
+			best, bestDist = pair.Key, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
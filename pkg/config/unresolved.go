@@ -0,0 +1,179 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"chainguard.dev/melange/pkg/util"
+)
+
+// An UnresolvedReference is a ${{}} expression referring to a variable that
+// is not defined.
+type UnresolvedReference struct {
+	// The name of the variable
+	Name string
+	// The expression as written, e.g. ${{vars.foo}}
+	Text string
+	// What the expression is in, e.g. runs of pipeline "build"
+	Field string
+	// The position of the expression in the configuration file, if known
+	Position *Position
+}
+
+func (r UnresolvedReference) String() string {
+	if r.Position != nil {
+		return fmt.Sprintf("%s: variable %s in %s is not defined", r.Position, r.Text, r.Field)
+	}
+	return fmt.Sprintf("variable %s in %s is not defined", r.Text, r.Field)
+}
+
+// UnresolvedError reports all the references to variables that are not
+// defined.
+type UnresolvedError struct {
+	References []UnresolvedReference
+}
+
+func (e *UnresolvedError) Error() string {
+	lines := make([]string, 0, len(e.References)+1)
+	lines = append(lines, fmt.Sprintf("%d unresolved variable references:", len(e.References)))
+	for _, ref := range e.References {
+		lines = append(lines, "  "+ref.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// unresolvedReferences returns the references to variables that are not
+// defined in the dependencies and environment packages of the configuration,
+// which was parsed into root from the source lines.
+func (cfg *Configuration) unresolvedReferences(root *yaml.Node, lines []string) []UnresolvedReference {
+	if root == nil || root.Kind != yaml.DocumentNode || len(root.Content) == 0 {
+		return nil
+	}
+	doc := root.Content[0]
+	nw := buildConfigMap(cfg)
+
+	var refs []UnresolvedReference
+	check := func(node *yaml.Node, field string, nw map[string]string) {
+		if node == nil || node.Kind != yaml.ScalarNode {
+			return
+		}
+
+		_, err := util.MutateStringFromMap(nw, node.Value)
+		var uerr *util.UndefinedError
+		if !errors.As(err, &uerr) {
+			return
+		}
+
+		for _, v := range uerr.Variables {
+			ref := UnresolvedReference{Name: v.Name, Text: v.Text, Field: field}
+			if pos, ok := referencePosition(node, lines, v.Offset); ok {
+				ref.Position = &pos
+			} else if node.Line > 0 {
+				ref.Position = &Position{Line: node.Line, Column: node.Column}
+			}
+			refs = append(refs, ref)
+		}
+	}
+	checkList := func(node *yaml.Node, field string, nw map[string]string) {
+		if node == nil || node.Kind != yaml.SequenceNode {
+			return
+		}
+		for _, n := range node.Content {
+			check(n, field, nw)
+		}
+	}
+	checkDependencies := func(node *yaml.Node, prefix string, nw map[string]string) {
+		for _, field := range []string{"runtime", "provides", "replaces"} {
+			checkList(mappingValue(node, field), prefix+"."+field, nw)
+		}
+		for _, field := range []string{"provider-priority", "replaces-priority"} {
+			check(mappingValue(node, field), prefix+"."+field, nw)
+		}
+	}
+
+	checkDependencies(mappingValue(mappingValue(doc, "package"), "dependencies"), "package.dependencies", nw)
+
+	if subpackages := mappingValue(doc, "subpackages"); subpackages != nil && subpackages.Kind == yaml.SequenceNode {
+		for i, node := range subpackages.Content {
+			spw := nw
+			// Subpackages with a range are expanded before substitution.
+			if mappingValue(node, "range") != nil || mappingValue(node, "ranges") != nil {
+				spw = util.RightJoinMap(nw, rangeVariables(doc, node))
+			}
+			checkDependencies(mappingValue(node, "dependencies"), fmt.Sprintf("subpackages[%d].dependencies", i), spw)
+		}
+	}
+
+	checkList(mappingValue(mappingValue(mappingValue(doc, "environment"), "contents"), "packages"), "environment.contents.packages", nw)
+	checkList(mappingValue(mappingValue(mappingValue(mappingValue(doc, "test"), "environment"), "contents"), "packages"), "test.environment.contents.packages", nw)
+
+	return refs
+}
+
+// rangeVariables returns the range variables of the subpackage node, for the
+// data sets of the configuration document doc it ranges over, mapped to
+// themselves.
+func rangeVariables(doc, node *yaml.Node) map[string]string {
+	names := []string{}
+	if n := mappingValue(node, "range"); n != nil && n.Kind == yaml.ScalarNode {
+		names = append(names, n.Value)
+	}
+	if n := mappingValue(node, "ranges"); n != nil && n.Kind == yaml.SequenceNode {
+		for _, name := range n.Content {
+			names = append(names, name.Value)
+		}
+	}
+
+	vars := map[string]string{}
+	define := func(name string) {
+		vars[name] = fmt.Sprintf("${{%s}}", name)
+	}
+
+	data := mappingValue(doc, "data")
+	for _, name := range names {
+		fields := []string{"key", "value"}
+		if data != nil && data.Kind == yaml.SequenceNode {
+			for _, d := range data.Content {
+				if n := mappingValue(d, "name"); n == nil || n.Value != name {
+					continue
+				}
+				items := mappingValue(d, "items")
+				if items == nil || items.Kind != yaml.MappingNode {
+					continue
+				}
+				for i := 1; i < len(items.Content); i += 2 {
+					item := items.Content[i]
+					if item.Kind != yaml.MappingNode {
+						continue
+					}
+					for j := 0; j+1 < len(item.Content); j += 2 {
+						fields = append(fields, item.Content[j].Value)
+					}
+				}
+			}
+		}
+
+		for _, f := range fields {
+			define("range." + f)
+			define("range." + name + "." + f)
+		}
+	}
+	return vars
+}
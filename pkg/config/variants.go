@@ -0,0 +1,196 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/invopop/jsonschema"
+	"gopkg.in/yaml.v3"
+)
+
+// VariantValue is a value of an axis of the variants matrix.
+type VariantValue struct {
+	// The value of the variable named after the axis
+	Value string `json:"value" yaml:"value"`
+	// Optional: Variables to set for the variant
+	Vars map[string]string `json:"vars,omitempty" yaml:"vars,omitempty"`
+	// Optional: Packages to add to or remove from the build environment
+	Environment EnvironmentOption `json:"environment,omitempty" yaml:"environment,omitempty"`
+	// Optional: Dependencies replacing those of the package. Only the lists
+	// and priorities given are replaced.
+	Dependencies Dependencies `json:"dependencies,omitempty" yaml:"dependencies,omitempty"`
+}
+
+// UnmarshalYAML allows values that only set the variable to be written as
+// scalars.
+func (v *VariantValue) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*v = VariantValue{Value: node.Value}
+		return nil
+	}
+
+	type plain VariantValue
+	return node.Decode((*plain)(v))
+}
+
+// JSONSchemaExtend allows values to be written as scalars in the schema.
+func (VariantValue) JSONSchemaExtend(s *jsonschema.Schema) {
+	object := *s
+	*s = jsonschema.Schema{
+		OneOf: []*jsonschema.Schema{{Type: "string"}, &object},
+	}
+}
+
+// A Variant is a combination of values of the variables of the variants
+// matrix, one for each axis.
+type Variant map[string]string
+
+func (v Variant) keys() []string {
+	keys := make([]string, 0, len(v))
+	for k := range v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// String returns the variant as a list of variable=value pairs, e.g.
+// libc=musl,python=3.12.
+func (v Variant) String() string {
+	pairs := make([]string, 0, len(v))
+	for _, k := range v.keys() {
+		pairs = append(pairs, k+"="+v[k])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Matches reports whether the variant has the values of all the variables of
+// selector.
+func (v Variant) Matches(selector Variant) bool {
+	for k, val := range selector {
+		if v[k] != val {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseVariantSelector parses variable=value pairs, as given to --variant,
+// into a selector for Variant.Matches.
+func ParseVariantSelector(pairs []string) (Variant, error) {
+	selector := Variant{}
+	for _, pair := range pairs {
+		k, val, ok := strings.Cut(pair, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid variant selector %q, expected variable=value", pair)
+		}
+		selector[k] = val
+	}
+	return selector, nil
+}
+
+// VariantMatrix returns the variants of the configuration: every combination
+// of the values of the axes of its variants matrix, in order.  It returns nil
+// if the configuration has no variants.
+func (cfg Configuration) VariantMatrix() []Variant {
+	if len(cfg.Variants) == 0 {
+		return nil
+	}
+
+	axes := make([]string, 0, len(cfg.Variants))
+	for axis := range cfg.Variants {
+		axes = append(axes, axis)
+	}
+	sort.Strings(axes)
+
+	variants := []Variant{{}}
+	for _, axis := range axes {
+		next := make([]Variant, 0, len(variants)*len(cfg.Variants[axis]))
+		for _, v := range variants {
+			for _, val := range cfg.Variants[axis] {
+				nv := make(Variant, len(v)+1)
+				for k, kv := range v {
+					nv[k] = kv
+				}
+				nv[axis] = val.Value
+				next = append(next, nv)
+			}
+		}
+		variants = next
+	}
+	return variants
+}
+
+// Variant returns the variant the configuration was parsed for, or nil if it
+// has no variants.
+func (cfg Configuration) Variant() Variant {
+	return cfg.variant
+}
+
+// applyVariant sets the variables of the variant v, and applies the changes
+// of its values to the configuration.  If v is nil, the first variant of the
+// matrix is used.
+func (cfg *Configuration) applyVariant(v Variant) error {
+	if len(cfg.Variants) == 0 {
+		if v != nil {
+			return fmt.Errorf("variant %s selected, but the configuration has no variants", v)
+		}
+		return nil
+	}
+
+	if v == nil {
+		matrix := cfg.VariantMatrix()
+		if len(matrix) == 0 {
+			return errors.New("variants matrix is empty")
+		}
+		v = matrix[0]
+	}
+
+	if len(v) != len(cfg.Variants) {
+		return fmt.Errorf("variant %s does not give a value for every axis of the variants matrix", v)
+	}
+
+	if cfg.Vars == nil {
+		cfg.Vars = make(map[string]string, len(v))
+	}
+	for _, axis := range v.keys() {
+		values, ok := cfg.Variants[axis]
+		if !ok {
+			return fmt.Errorf("variant %s: no axis %q in the variants matrix", v, axis)
+		}
+
+		i := slices.IndexFunc(values, func(val VariantValue) bool {
+			return val.Value == v[axis]
+		})
+		if i < 0 {
+			return fmt.Errorf("variant %s: %q is not a value of axis %q", v, v[axis], axis)
+		}
+
+		cfg.Vars[axis] = v[axis]
+		cfg.applyOverride(ArchOverride{
+			Vars:         values[i].Vars,
+			Environment:  values[i].Environment,
+			Dependencies: values[i].Dependencies,
+		})
+	}
+	cfg.variant = v
+
+	return nil
+}
@@ -0,0 +1,313 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package configlint checks melange configurations for supply-chain hygiene
+// problems, such as sources fetched without checksums.
+package configlint
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/github/go-spdx/v2/spdxexp"
+	"golang.org/x/exp/maps"
+	"gopkg.in/yaml.v3"
+
+	"chainguard.dev/melange/pkg/cond"
+	"chainguard.dev/melange/pkg/config"
+)
+
+// A Finding is a problem a rule found in a configuration.
+type Finding struct {
+	// The name of the rule
+	Rule string
+	// What the problem is
+	Message string
+	// The position of the problem in the configuration file, if known
+	Position *config.Position
+}
+
+func (f Finding) String() string {
+	if f.Position != nil {
+		return fmt.Sprintf("%d:%d: %s [%s]", f.Position.Line, f.Position.Column, f.Message, f.Rule)
+	}
+	return fmt.Sprintf("%s [%s]", f.Message, f.Rule)
+}
+
+type ruleFunc func(cfg *config.Configuration, doc *yaml.Node) []Finding
+
+type rule struct {
+	RuleFunc ruleFunc
+	Explain  string
+}
+
+var ruleMap = map[string]rule{
+	"duplicate-subpackage": {
+		RuleFunc: duplicateSubpackageRule,
+		Explain:  "Give every subpackage a name distinct from the package",
+	},
+	"fetch-checksum": {
+		RuleFunc: fetchChecksumRule,
+		Explain:  "Set expected-sha256 or expected-sha512 on fetch, so the source cannot change unnoticed",
+	},
+	"git-checkout-commit": {
+		RuleFunc: gitCheckoutCommitRule,
+		Explain:  "Set expected-commit on git-checkout, so the tag cannot be moved unnoticed",
+	},
+	"spdx-license": {
+		RuleFunc: spdxLicenseRule,
+		Explain:  "Use a valid SPDX license expression, or a LicenseRef- for custom licenses",
+	},
+	"unused-vars": {
+		RuleFunc: unusedVarsRule,
+		Explain:  "Remove the variables that are not referred to",
+	},
+	"update-monitor": {
+		RuleFunc: updateMonitorRule,
+		Explain:  "Configure release-monitor or github for automatic updates, or set update.manual",
+	},
+}
+
+// Rules returns the names of the rules, sorted.
+func Rules() []string {
+	names := maps.Keys(ruleMap)
+	sort.Strings(names)
+	return names
+}
+
+// Explain returns how to fix the problems the rule finds.
+func Explain(name string) string {
+	return ruleMap[name].Explain
+}
+
+// Lint returns the findings of the rules that are not disabled in the checks
+// of the package, ordered by position.
+func Lint(cfg *config.Configuration) []Finding {
+	var doc *yaml.Node
+	if root := cfg.Root(); root != nil && len(root.Content) > 0 {
+		doc = root.Content[0]
+	}
+
+	findings := []Finding{}
+	for _, name := range Rules() {
+		if slices.Contains(cfg.Package.Checks.Disabled, name) {
+			continue
+		}
+		for _, f := range ruleMap[name].RuleFunc(cfg, doc) {
+			f.Rule = name
+			findings = append(findings, f)
+		}
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		pi, pj := findings[i].Position, findings[j].Position
+		switch {
+		case pi == nil || pj == nil:
+			return pi != nil && pj == nil
+		case pi.Line != pj.Line:
+			return pi.Line < pj.Line
+		default:
+			return pi.Column < pj.Column
+		}
+	})
+	return findings
+}
+
+func fetchChecksumRule(_ *config.Configuration, doc *yaml.Node) []Finding {
+	findings := []Finding{}
+	forEachStep(doc, func(step *yaml.Node) {
+		uses := mappingValue(step, "uses")
+		if uses == nil || uses.Value != "fetch" {
+			return
+		}
+		with := mappingValue(step, "with")
+		if mappingValue(with, "expected-sha256") != nil || mappingValue(with, "expected-sha512") != nil {
+			return
+		}
+		findings = append(findings, Finding{
+			Message:  fmt.Sprintf("fetch of %s has no expected-sha256 or expected-sha512", scalarValue(mappingValue(with, "uri"))),
+			Position: position(uses),
+		})
+	})
+	return findings
+}
+
+func gitCheckoutCommitRule(_ *config.Configuration, doc *yaml.Node) []Finding {
+	findings := []Finding{}
+	forEachStep(doc, func(step *yaml.Node) {
+		uses := mappingValue(step, "uses")
+		if uses == nil || uses.Value != "git-checkout" {
+			return
+		}
+		with := mappingValue(step, "with")
+		if mappingValue(with, "expected-commit") != nil {
+			return
+		}
+		findings = append(findings, Finding{
+			Message:  fmt.Sprintf("git-checkout of %s has no expected-commit", scalarValue(mappingValue(with, "repository"))),
+			Position: position(uses),
+		})
+	})
+	return findings
+}
+
+func unusedVarsRule(_ *config.Configuration, doc *yaml.Node) []Finding {
+	vars := mappingValue(doc, "vars")
+	if vars == nil || vars.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	used := map[string]bool{}
+	var scan func(node *yaml.Node)
+	scan = func(node *yaml.Node) {
+		if node.Kind == yaml.ScalarNode {
+			// Malformed expressions are reported when the configuration
+			// is parsed.
+			_, _ = cond.Expand(node.Value, func(v *cond.Variable) (string, error) {
+				if name, ok := strings.CutPrefix(v.Name, "vars."); ok {
+					used[name] = true
+				}
+				return v.Text, nil
+			})
+		}
+		for _, n := range node.Content {
+			scan(n)
+		}
+	}
+	scan(doc)
+
+	findings := []Finding{}
+	for i := 0; i+1 < len(vars.Content); i += 2 {
+		key := vars.Content[i]
+		if !used[key.Value] {
+			findings = append(findings, Finding{
+				Message:  fmt.Sprintf("variable %s is not used", key.Value),
+				Position: position(key),
+			})
+		}
+	}
+	return findings
+}
+
+func updateMonitorRule(cfg *config.Configuration, doc *yaml.Node) []Finding {
+	u := cfg.Update
+	if !u.Enabled || u.Manual || u.ReleaseMonitor != nil || u.GitHubMonitor != nil {
+		return nil
+	}
+	return []Finding{{
+		Message:  "update is enabled, but neither release-monitor nor github is configured",
+		Position: position(mappingValue(mappingValue(doc, "update"), "enabled")),
+	}}
+}
+
+func spdxLicenseRule(cfg *config.Configuration, doc *yaml.Node) []Finding {
+	var nodes []*yaml.Node
+	if n := mappingValue(mappingValue(doc, "package"), "copyright"); n != nil && n.Kind == yaml.SequenceNode {
+		nodes = n.Content
+	}
+
+	findings := []Finding{}
+	for i, c := range cfg.Package.Copyright {
+		if c.License == "" {
+			continue
+		}
+		if valid, _ := spdxexp.ValidateLicenses([]string{c.License}); valid {
+			continue
+		}
+		f := Finding{Message: fmt.Sprintf("license %q is not a valid SPDX expression", c.License)}
+		if len(nodes) == len(cfg.Package.Copyright) {
+			f.Position = position(mappingValue(nodes[i], "license"))
+		}
+		findings = append(findings, f)
+	}
+	return findings
+}
+
+// duplicateSubpackageRule finds subpackages named after the package.
+// Subpackages sharing a name with each other are not reported here, as parsing
+// the configuration already fails for them.
+func duplicateSubpackageRule(cfg *config.Configuration, doc *yaml.Node) []Finding {
+	var nodes []*yaml.Node
+	if n := mappingValue(doc, "subpackages"); n != nil && n.Kind == yaml.SequenceNode {
+		nodes = n.Content
+	}
+
+	findings := []Finding{}
+	for i, sp := range cfg.Subpackages {
+		if sp.Name != cfg.Package.Name {
+			continue
+		}
+		f := Finding{Message: fmt.Sprintf("subpackage name %s is the name of the package", sp.Name)}
+		if len(nodes) == len(cfg.Subpackages) {
+			f.Position = position(mappingValue(nodes[i], "name"))
+		}
+		findings = append(findings, f)
+	}
+	return findings
+}
+
+// forEachStep calls fn with the node of every pipeline step of the
+// configuration document doc, including those of subpackages, tests and
+// nested pipelines.
+func forEachStep(doc *yaml.Node, fn func(step *yaml.Node)) {
+	var walk func(pipeline *yaml.Node)
+	walk = func(pipeline *yaml.Node) {
+		if pipeline == nil || pipeline.Kind != yaml.SequenceNode {
+			return
+		}
+		for _, step := range pipeline.Content {
+			fn(step)
+			walk(mappingValue(step, "pipeline"))
+		}
+	}
+
+	walk(mappingValue(doc, "pipeline"))
+	walk(mappingValue(mappingValue(doc, "test"), "pipeline"))
+	if subpackages := mappingValue(doc, "subpackages"); subpackages != nil {
+		for _, sp := range subpackages.Content {
+			walk(mappingValue(sp, "pipeline"))
+			walk(mappingValue(mappingValue(sp, "test"), "pipeline"))
+		}
+	}
+}
+
+// mappingValue returns the value of key in a mapping node, or nil.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func scalarValue(node *yaml.Node) string {
+	if node == nil || node.Kind != yaml.ScalarNode {
+		return "an unknown source"
+	}
+	return node.Value
+}
+
+// position returns the position of the node, if it is known.
+func position(node *yaml.Node) *config.Position {
+	if node == nil || node.Line == 0 {
+		return nil
+	}
+	return &config.Position{Line: node.Line, Column: node.Column}
+}
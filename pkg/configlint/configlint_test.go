@@ -0,0 +1,125 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configlint
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+const lintConfig = `package:
+  name: lint
+  version: 1.2.3
+  epoch: 0
+  copyright:
+    - license: Apache-2.0
+    - license: GPL-2.0-or-later AND Not-A-License
+  checks:
+    disabled:
+      - %s
+
+vars:
+  used: foo
+  unused: bar
+
+update:
+  enabled: true
+
+pipeline:
+  - uses: fetch
+    with:
+      uri: https://example.com/lint-${{package.version}}.tar.gz
+  - uses: fetch
+    with:
+      uri: https://example.com/${{vars.used}}.tar.gz
+      expected-sha512: abc
+  - pipeline:
+      - uses: git-checkout
+        with:
+          repository: https://github.com/example/lint
+
+subpackages:
+  - name: lint
+    pipeline:
+      - uses: git-checkout
+        with:
+          repository: https://github.com/example/lint-extra
+          expected-commit: abc
+`
+
+func parse(t *testing.T, disabled string) *config.Configuration {
+	ctx := slogtest.TestContextWithLogger(t)
+
+	fp := filepath.Join(t.TempDir(), "lint.yaml")
+	src := bytes.Replace([]byte(lintConfig), []byte("%s"), []byte(disabled), 1)
+	if err := os.WriteFile(fp, src, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.ParseConfiguration(ctx, fp, config.WithAllowUnresolved(true))
+	if err != nil {
+		t.Fatalf("failed to parse configuration: %s", err)
+	}
+	return cfg
+}
+
+func TestLint(t *testing.T) {
+	findings := Lint(parse(t, "dev"))
+
+	got := []string{}
+	for _, f := range findings {
+		got = append(got, f.String())
+	}
+	require.Equal(t, []string{
+		`7:16: license "GPL-2.0-or-later AND Not-A-License" is not a valid SPDX expression [spdx-license]`,
+		`14:3: variable unused is not used [unused-vars]`,
+		`17:12: update is enabled, but neither release-monitor nor github is configured [update-monitor]`,
+		`20:11: fetch of https://example.com/lint-${{package.version}}.tar.gz has no expected-sha256 or expected-sha512 [fetch-checksum]`,
+		`28:15: git-checkout of https://github.com/example/lint has no expected-commit [git-checkout-commit]`,
+		`33:11: subpackage name lint is the name of the package [duplicate-subpackage]`,
+	}, got)
+}
+
+func TestLintDisabled(t *testing.T) {
+	for _, f := range Lint(parse(t, "unused-vars")) {
+		require.NotEqual(t, "unused-vars", f.Rule)
+	}
+}
+
+func TestWriteSARIF(t *testing.T) {
+	findings := Lint(parse(t, "dev"))
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteSARIF(&buf, map[string][]Finding{"lint.yaml": findings}))
+
+	var log sarifLog
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &log))
+	require.Equal(t, "2.1.0", log.Version)
+	require.Len(t, log.Runs, 1)
+	require.Len(t, log.Runs[0].Tool.Driver.Rules, len(Rules()))
+	require.Len(t, log.Runs[0].Results, len(findings))
+
+	r := log.Runs[0].Results[1]
+	require.Equal(t, "unused-vars", r.RuleID)
+	require.Equal(t, "lint.yaml", r.Locations[0].PhysicalLocation.ArtifactLocation.URI)
+	require.Equal(t, &sarifRegion{StartLine: 14, StartColumn: 3}, r.Locations[0].PhysicalLocation.Region)
+}
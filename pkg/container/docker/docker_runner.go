@@ -272,7 +272,7 @@ func (dk *docker) Run(ctx context.Context, cfg *mcontainer.Config, args ...strin
 	case 0:
 		return nil
 	default:
-		return fmt.Errorf("task exited with code %d", inspectResp.ExitCode)
+		return &mcontainer.ExitError{Code: inspectResp.ExitCode}
 	}
 }
 
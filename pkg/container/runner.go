@@ -16,7 +16,10 @@ package container
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"os/exec"
 
 	apko_build "chainguard.dev/apko/pkg/build"
 	apko_types "chainguard.dev/apko/pkg/build/types"
@@ -50,3 +53,28 @@ type Loader interface {
 	LoadImage(ctx context.Context, layer v1.Layer, arch apko_types.Architecture, bc *apko_build.Context) (ref string, err error)
 	RemoveImage(ctx context.Context, ref string) error
 }
+
+// ExitError is returned by Run when the command exits with a non-zero status.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("task exited with code %d", e.Code)
+}
+
+// ExitCode returns the exit status of the command that caused err to be
+// returned from Run, if the runner reported it.
+func ExitCode(err error) (int, bool) {
+	var ee *ExitError
+	if errors.As(err, &ee) {
+		return ee.Code, true
+	}
+
+	var xe *exec.ExitError
+	if errors.As(err, &xe) {
+		return xe.ExitCode(), true
+	}
+
+	return 0, false
+}
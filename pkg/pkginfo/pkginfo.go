@@ -0,0 +1,60 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pkginfo parses the .PKGINFO file of apk packages.
+package pkginfo
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// PkgInfo holds the fields of a .PKGINFO.  Fields like depend and provides
+// appear once per value, so every field maps to the list of its values, in
+// the order they appear.
+type PkgInfo map[string][]string
+
+// Parse reads the fields of a .PKGINFO from r.  Comments and lines that are
+// not of the form key = value are skipped.
+func Parse(r io.Reader) (PkgInfo, error) {
+	info := PkgInfo{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+
+		key = strings.TrimSpace(key)
+		info[key] = append(info[key], strings.TrimSpace(value))
+	}
+
+	return info, scanner.Err()
+}
+
+// Get returns the first value of the field key, or "" if the field is not
+// set.
+func (p PkgInfo) Get(key string) string {
+	if values := p[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
@@ -0,0 +1,45 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkginfo
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	info, err := Parse(strings.NewReader(`# Generated by melange
+pkgname = hello
+pkgver = 1.2.3-r0
+# vendored = ignored
+depend = so:libc.so.6
+depend = busybox
+not a field
+size=1024
+`))
+	require.NoError(t, err)
+	require.Equal(t, PkgInfo{
+		"pkgname": {"hello"},
+		"pkgver":  {"1.2.3-r0"},
+		"depend":  {"so:libc.so.6", "busybox"},
+		"size":    {"1024"},
+	}, info)
+
+	require.Equal(t, "hello", info.Get("pkgname"))
+	require.Equal(t, "so:libc.so.6", info.Get("depend"))
+	require.Equal(t, "", info.Get("inputhash"))
+}
@@ -18,13 +18,14 @@ import (
 	"context"
 	"crypto/sha256"
 	"crypto/sha512"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"strconv"
 	"strings"
 
 	"github.com/chainguard-dev/clog"
-	"github.com/dprotaso/go-yit"
 	"gopkg.in/yaml.v3"
 
 	"chainguard.dev/melange/pkg/config"
@@ -37,6 +38,9 @@ import (
 type BumpConfig struct {
 	TargetVersion  string
 	ExpectedCommit string
+	Summary        io.Writer
+	// Local mirrors of git repositories, keyed by repository
+	GitMirrors map[string]string
 }
 
 // Option sets a config option on a BumpConfig.
@@ -60,6 +64,27 @@ func WithExpectedCommit(expectedCommit string) Option {
 	}
 }
 
+// WithGitMirror sets a local mirror of a git repository, where the bump
+// renovator resolves the tags of the repository rather than querying it.
+func WithGitMirror(repository, path string) Option {
+	return func(cfg *BumpConfig) error {
+		if cfg.GitMirrors == nil {
+			cfg.GitMirrors = map[string]string{}
+		}
+		cfg.GitMirrors[repository] = path
+		return nil
+	}
+}
+
+// WithSummary sets where the bump renovator writes the values it changed,
+// one per line.
+func WithSummary(w io.Writer) Option {
+	return func(cfg *BumpConfig) error {
+		cfg.Summary = w
+		return nil
+	}
+}
+
 // New returns a renovator which performs a version bump.
 func New(ctx context.Context, opts ...Option) renovate.Renovator {
 	log := clog.FromContext(ctx)
@@ -76,6 +101,14 @@ func New(ctx context.Context, opts ...Option) renovate.Renovator {
 	return func(ctx context.Context, rc *renovate.RenovationContext) error {
 		log.Infof("attempting to bump version to %s", bcfg.TargetVersion)
 
+		changes := []Change{}
+		report := func(path string, node *yaml.Node, value string) {
+			if node.Value != value {
+				changes = append(changes, Change{Path: path, Old: node.Value, New: value})
+			}
+			node.Value = value
+		}
+
 		packageNode, err := renovate.NodeFromMapping(rc.Configuration.Root().Content[0], "package")
 		if err != nil {
 			return err
@@ -93,16 +126,16 @@ func New(ctx context.Context, opts ...Option) renovate.Renovator {
 		}
 
 		if versionNode.Value != bcfg.TargetVersion {
-			epochNode.Value = "0"
+			report("package.epoch", epochNode, "0")
 		} else {
 			epoch, err := strconv.Atoi(epochNode.Value)
 			if err != nil {
 				return err
 			}
-			epochNode.Value = fmt.Sprintf("%d", epoch+1)
+			report("package.epoch", epochNode, fmt.Sprintf("%d", epoch+1))
 		}
 
-		versionNode.Value = bcfg.TargetVersion
+		report("package.version", versionNode, bcfg.TargetVersion)
 		versionNode.Style = yaml.FlowStyle
 		versionNode.Tag = "!!str"
 
@@ -115,41 +148,121 @@ func New(ctx context.Context, opts ...Option) renovate.Renovator {
 			return err
 		}
 
-		// Find our main pipeline YAML node.
-		pipelineNode, err := renovate.NodeFromMapping(rc.Configuration.Root().Content[0], "pipeline")
-		if err != nil {
-			return err
-		}
+		// Update the fetch and git-checkout steps of every pipeline.
+		hashes := map[string]fileHashes{}
+		for _, st := range pipelineSteps(rc.Configuration.Root().Content[0]) {
+			usesNode, err := renovate.NodeFromMapping(st.node, "uses")
+			if err != nil {
+				continue
+			}
 
-		// Look for fetch nodes.
-		it := yit.FromNode(pipelineNode).
-			RecurseNodes().
-			Filter(yit.WithMapValue("fetch"))
+			switch usesNode.Value {
+			case "fetch":
+				if err := updateFetch(ctx, rc, st, hashes, report); err != nil {
+					return err
+				}
+			case "git-checkout":
+				if err := updateGitCheckout(ctx, rc, st, bcfg, report); err != nil {
+					return err
+				}
+			}
+		}
 
-		for fetchNode, ok := it(); ok; fetchNode, ok = it() {
-			if err := updateFetch(ctx, rc, fetchNode, bcfg.TargetVersion); err != nil {
-				return err
+		log.Infof("bumped %d values:", len(changes))
+		for _, c := range changes {
+			log.Infof("  %s", c)
+		}
+		if bcfg.Summary != nil {
+			for _, c := range changes {
+				if _, err := fmt.Fprintln(bcfg.Summary, c); err != nil {
+					return err
+				}
 			}
 		}
+		return nil
+	}
+}
 
-		// Look for git-checkout nodes.
-		it = yit.FromNode(pipelineNode).
-			RecurseNodes().
-			Filter(yit.WithMapValue("git-checkout"))
+// A Change is a value of the configuration changed by a bump.
+type Change struct {
+	// The path of the value, e.g. subpackages[0].pipeline[1].with.expected-sha256
+	Path string
+	Old  string
+	New  string
+}
 
-		for gitCheckoutNode, ok := it(); ok; gitCheckoutNode, ok = it() {
-			if err := updateGitCheckout(ctx, gitCheckoutNode, bcfg.ExpectedCommit); err != nil {
-				return err
-			}
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %s -> %s", c.Path, c.Old, c.New)
+}
+
+// A step is a pipeline step node of the configuration, and its path.
+type step struct {
+	path string
+	node *yaml.Node
+	// Whether the step is in the main pipeline of the package
+	main bool
+}
+
+// pipelineSteps returns the steps of all the pipelines of the configuration
+// document doc: those of the package, the subpackages, their tests and build
+// options, and those nested in other steps.
+func pipelineSteps(doc *yaml.Node) []step {
+	steps := []step{}
+	var walk func(path string, node *yaml.Node)
+	walk = func(path string, node *yaml.Node) {
+		if node == nil || node.Kind != yaml.SequenceNode {
+			return
 		}
+		for i, n := range node.Content {
+			st := step{path: fmt.Sprintf("%s[%d]", path, i), node: n, main: strings.HasPrefix(path, "pipeline")}
+			steps = append(steps, st)
+			walk(st.path+".pipeline", mappingValue(n, "pipeline"))
+		}
+	}
+
+	walk("pipeline", mappingValue(doc, "pipeline"))
+	walk("test.pipeline", mappingValue(mappingValue(doc, "test"), "pipeline"))
+	if subpackages := mappingValue(doc, "subpackages"); subpackages != nil {
+		for i, sp := range subpackages.Content {
+			path := fmt.Sprintf("subpackages[%d]", i)
+			walk(path+".pipeline", mappingValue(sp, "pipeline"))
+			walk(path+".test.pipeline", mappingValue(mappingValue(sp, "test"), "pipeline"))
+		}
+	}
+	if options := mappingValue(doc, "options"); options != nil && options.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(options.Content); i += 2 {
+			path := fmt.Sprintf("options.%s.pipeline", options.Content[i].Value)
+			pipeline := mappingValue(options.Content[i+1], "pipeline")
+			walk(path+".append", mappingValue(pipeline, "append"))
+			walk(path+".replace", mappingValue(pipeline, "replace"))
+		}
+	}
+	return steps
+}
+
+// mappingValue returns the value of key in the mapping node, or nil.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
 		return nil
 	}
+	n, err := renovate.NodeFromMapping(node, key)
+	if err != nil {
+		return nil
+	}
+	return n
+}
+
+// fileHashes are the hashes of a fetched file.
+type fileHashes struct {
+	sha256 string
+	sha512 string
 }
 
-// updateFetch takes a "fetch" pipeline node and updates the parameters of it.
-func updateFetch(ctx context.Context, rc *renovate.RenovationContext, node *yaml.Node, targetVersion string) error {
+// updateFetch takes a "fetch" pipeline step and updates the expected hashes
+// of it.  Files are fetched once per URI, and their hashes kept in hashes.
+func updateFetch(ctx context.Context, rc *renovate.RenovationContext, st step, hashes map[string]fileHashes, report func(string, *yaml.Node, string)) error {
 	log := clog.FromContext(ctx)
-	withNode, err := renovate.NodeFromMapping(node, "with")
+	withNode, err := renovate.NodeFromMapping(st.node, "with")
 	if err != nil {
 		return err
 	}
@@ -159,19 +272,51 @@ func updateFetch(ctx context.Context, rc *renovate.RenovationContext, node *yaml
 		return err
 	}
 
-	log.Infof("processing fetch node:")
+	log.Infof("processing fetch node %s:", st.path)
 
 	// Fetch the new sources.
 	evaluatedURI, err := util.MutateStringFromMap(rc.Vars, uriNode.Value)
-	if err != nil {
+	var uerr *util.UndefinedError
+	if errors.As(err, &uerr) {
+		log.Warnf("  skipping %s, which refers to variables only defined when building: %v", uriNode.Value, err)
+		return nil
+	} else if err != nil {
 		return err
 	}
 	log.Infof("  uri: %s", uriNode.Value)
 	log.Infof("  evaluated: %s", evaluatedURI)
 
-	downloadedFile, err := util.DownloadFile(ctx, evaluatedURI)
+	h, ok := hashes[evaluatedURI]
+	if !ok {
+		h, err = fetchHashes(ctx, evaluatedURI)
+		if err != nil {
+			return err
+		}
+		hashes[evaluatedURI] = h
+	}
+	log.Infof("  expected-sha256: %s", h.sha256)
+	log.Infof("  expected-sha512: %s", h.sha512)
+
+	// Update expected hash nodes.
+	if nodeSHA256, err := renovate.NodeFromMapping(withNode, "expected-sha256"); err == nil {
+		report(st.path+".with.expected-sha256", nodeSHA256, h.sha256)
+		nodeSHA256.Tag = "!!str"
+	}
+	if nodeSHA512, err := renovate.NodeFromMapping(withNode, "expected-sha512"); err == nil {
+		report(st.path+".with.expected-sha512", nodeSHA512, h.sha512)
+		nodeSHA512.Tag = "!!str"
+	}
+
+	return nil
+}
+
+// fetchHashes downloads the file at uri and returns its hashes.
+func fetchHashes(ctx context.Context, uri string) (fileHashes, error) {
+	log := clog.FromContext(ctx)
+
+	downloadedFile, err := util.DownloadFile(ctx, uri)
 	if err != nil {
-		return err
+		return fileHashes{}, err
 	}
 	defer os.Remove(downloadedFile)
 	log.Infof("  fetched-as: %s", downloadedFile)
@@ -179,35 +324,24 @@ func updateFetch(ctx context.Context, rc *renovate.RenovationContext, node *yaml
 	// Calculate SHA2-256 and SHA2-512 hashes.
 	fileSHA256, err := util.HashFile(downloadedFile, sha256.New())
 	if err != nil {
-		return err
+		return fileHashes{}, err
 	}
-	log.Infof("  expected-sha256: %s", fileSHA256)
-
 	fileSHA512, err := util.HashFile(downloadedFile, sha512.New())
 	if err != nil {
-		return err
-	}
-	log.Infof("  expected-sha512: %s", fileSHA512)
-
-	// Update expected hash nodes.
-	nodeSHA256, err := renovate.NodeFromMapping(withNode, "expected-sha256")
-	if err == nil {
-		nodeSHA256.Value = fileSHA256
+		return fileHashes{}, err
 	}
 
-	nodeSHA512, err := renovate.NodeFromMapping(withNode, "expected-sha512")
-	if err == nil {
-		nodeSHA512.Value = fileSHA512
-	}
-
-	return nil
+	return fileHashes{sha256: fileSHA256, sha512: fileSHA512}, nil
 }
 
-// updateGitCheckout takes a "git-checkout" pipeline node and updates the parameters of it.
-func updateGitCheckout(ctx context.Context, node *yaml.Node, expectedGitSha string) error {
+// updateGitCheckout takes a "git-checkout" pipeline step and updates the parameters of it.
+// The expected commit, if set, is used for the steps of the main pipeline.  Otherwise, and
+// for the steps of other pipelines, which may check out other repositories, the commit is
+// resolved from the tag of the step.
+func updateGitCheckout(ctx context.Context, rc *renovate.RenovationContext, st step, bcfg BumpConfig, report func(string, *yaml.Node, string)) error {
 	log := clog.FromContext(ctx)
 
-	withNode, err := renovate.NodeFromMapping(node, "with")
+	withNode, err := renovate.NodeFromMapping(st.node, "with")
 	if err != nil {
 		return err
 	}
@@ -215,24 +349,53 @@ func updateGitCheckout(ctx context.Context, node *yaml.Node, expectedGitSha stri
 	// If the tag does not contain a version substitution then we assume it is not the main checkout so we skip updating the expected-commit sha.
 	tag, err := renovate.NodeFromMapping(withNode, "tag")
 	if err != nil {
-		log.Infof("git-checkout node does not contain a tag, assume we need to update the expected-commit sha")
+		log.Infof("git-checkout node %s does not contain a tag, assume we need to update the expected-commit sha", st.path)
 	} else {
 		if !strings.Contains(tag.Value, "${{package.version}}") {
-			log.Infof("Skipping git-checkout node as it does not contain a version substitution so assuming it is not the main checkout")
+			log.Infof("Skipping git-checkout node %s as it does not contain a version substitution so assuming it is not the main checkout", st.path)
 			return nil
 		}
 	}
 
-	log.Infof("processing git-checkout node")
+	log.Infof("processing git-checkout node %s", st.path)
+
+	nodeCommit, err := renovate.NodeFromMapping(withNode, "expected-commit")
+	if err != nil {
+		return nil
+	}
 
-	if expectedGitSha != "" {
-		// Update expected hash nodes.
-		nodeCommit, err := renovate.NodeFromMapping(withNode, "expected-commit")
-		if err == nil {
-			nodeCommit.Value = expectedGitSha
-			log.Infof("  expected-commit: %s", expectedGitSha)
+	expectedGitSha := ""
+	if st.main {
+		expectedGitSha = bcfg.ExpectedCommit
+	}
+	if expectedGitSha == "" {
+		if tag == nil {
+			return nil
+		}
+		repoNode, err := renovate.NodeFromMapping(withNode, "repository")
+		if err != nil {
+			return err
+		}
+		repository, err := util.MutateStringFromMap(rc.Vars, repoNode.Value)
+		if err != nil {
+			return err
+		}
+		evaluatedTag, err := util.MutateStringFromMap(rc.Vars, tag.Value)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("  resolving tag %s of %s", evaluatedTag, repository)
+		expectedGitSha, err = resolveTag(ctx, repository, bcfg.GitMirrors[repository], evaluatedTag)
+		if err != nil {
+			return fmt.Errorf("resolving expected-commit of %s: %w", st.path, err)
 		}
 	}
 
+	// Update expected hash nodes.
+	report(st.path+".with.expected-commit", nodeCommit, expectedGitSha)
+	nodeCommit.Tag = "!!str"
+	log.Infof("  expected-commit: %s", expectedGitSha)
+
 	return nil
 }
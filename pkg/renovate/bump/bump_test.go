@@ -1,8 +1,13 @@
 package bump
 
 import (
+	"bytes"
+
 	"chainguard.dev/melange/pkg/config"
 	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/stretchr/testify/require"
 
 	"net/http"
@@ -11,6 +16,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"chainguard.dev/melange/pkg/renovate"
 	"github.com/stretchr/testify/assert"
@@ -152,3 +158,199 @@ func setupTestServer(t *testing.T) (error, *httptest.Server) {
 	}))
 	return err, server
 }
+
+func TestBump_allPipelines(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	dir := t.TempDir()
+	filename := "all_pipelines.yaml"
+
+	packageData, err := os.ReadFile(filepath.Join("testdata", "cheese-7.0.1.tar.gz"))
+	require.NoError(t, err)
+
+	// serve the same tarball under several URIs, counting the requests
+	requests := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests[req.URL.Path]++
+		_, err := rw.Write(packageData)
+		assert.NoError(t, err)
+	}))
+	defer server.Close()
+
+	data, err := os.ReadFile(filepath.Join("testdata", filename))
+	require.NoError(t, err)
+	melangeConfig := strings.ReplaceAll(string(data), "REPLACE_ME", server.URL)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, filename), []byte(melangeConfig), 0755))
+
+	rctx, err := renovate.New(renovate.WithConfig(filepath.Join(dir, filename)))
+	require.NoError(t, err)
+
+	var summary bytes.Buffer
+	bumpRenovator := New(ctx,
+		WithTargetVersion("7.0.1"),
+		WithSummary(&summary),
+	)
+	require.NoError(t, rctx.Renovate(ctx, bumpRenovator))
+
+	// each URI is fetched once
+	assert.Equal(t, map[string]int{
+		"/wine/cheese/cheese-7.0.1.tar.gz":     1,
+		"/wine/crackers/crackers-7.0.1.tar.gz": 1,
+		"/wine/crisps/crisps-7.0.1.tar.gz":     1,
+	}, requests)
+
+	sha256 := "cc2c52929ace57623ff517408a577e783e10042655963b2c8f0633e109337d7a"
+	sha512 := "3676c02e883fc26800bcd8542c4cc476a00fb5505c5019433c8316a401565317630803150d8a75d1f3111909c445b700dd123d3c0310a56849d76ed9f72da5cd"
+	assert.Equal(t, strings.Join([]string{
+		"package.epoch: 2 -> 0",
+		"package.version: 6.8 -> 7.0.1",
+		"pipeline[0].with.expected-sha512: 0000 -> " + sha512,
+		"pipeline[1].pipeline[0].with.expected-sha256: 0000 -> " + sha256,
+		"test.pipeline[0].with.expected-sha256: 0000 -> " + sha256,
+		"subpackages[0].pipeline[0].with.expected-sha256: 0000 -> " + sha256,
+		"subpackages[0].pipeline[0].with.expected-sha512: 0000 -> " + sha512,
+		"subpackages[0].test.pipeline[0].with.expected-sha256: 0000 -> " + sha256,
+		"options.crisps.pipeline.append[0].with.expected-sha256: 0000 -> " + sha256,
+		"",
+	}, "\n"), summary.String())
+
+	rs, err := config.ParseConfiguration(ctx, filepath.Join(dir, filename))
+	require.NoError(t, err)
+	assert.Equal(t, sha256, rs.Subpackages[0].Test.Pipeline[0].With["expected-sha256"])
+	assert.Equal(t, sha256, rs.Options["crisps"].Pipeline.Append[0].With["expected-sha256"])
+}
+
+// crispsMirror creates a mirror of cheese/crisps with an annotated tag v6.9
+// and a lightweight tag v7.0, and returns it and the tagged commit.
+func crispsMirror(t *testing.T) (string, plumbing.Hash) {
+	mirror := t.TempDir()
+	repo, err := git.PlainInit(mirror, false)
+	require.NoError(t, err)
+	wt, err := repo.Worktree()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(mirror, "crisps"), []byte("salted"), 0644))
+	_, err = wt.Add("crisps")
+	require.NoError(t, err)
+	sig := &object.Signature{Name: "cheese", Email: "cheese@example.com", When: time.Unix(0, 0)}
+	commit, err := wt.Commit("crisps", &git.CommitOptions{Author: sig})
+	require.NoError(t, err)
+	_, err = repo.CreateTag("v6.9", commit, &git.CreateTagOptions{Tagger: sig, Message: "v6.9"})
+	require.NoError(t, err)
+	_, err = repo.CreateTag("v7.0", commit, nil)
+	require.NoError(t, err)
+	return mirror, commit
+}
+
+func TestBump_resolveExpectedCommit(t *testing.T) {
+	mirror, commit := crispsMirror(t)
+
+	tests := []struct {
+		newVersion string
+		wantErr    string
+	}{
+		{newVersion: "6.9"},
+		{newVersion: "7.0"},
+		{newVersion: "8.0", wantErr: "tag v8.0 does not exist"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.newVersion, func(t *testing.T) {
+			ctx := slogtest.TestContextWithLogger(t)
+			dir := t.TempDir()
+			filename := "multiple_checkouts.yaml"
+
+			data, err := os.ReadFile(filepath.Join("testdata", filename))
+			require.NoError(t, err)
+			require.NoError(t, os.WriteFile(filepath.Join(dir, filename), data, 0755))
+
+			rctx, err := renovate.New(renovate.WithConfig(filepath.Join(dir, filename)))
+			require.NoError(t, err)
+
+			bumpRenovator := New(ctx,
+				WithTargetVersion(tt.newVersion),
+				WithGitMirror("cheese/crisps", mirror),
+			)
+
+			err = rctx.Renovate(ctx, bumpRenovator)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			rs, err := config.ParseConfiguration(ctx, filepath.Join(dir, filename))
+			require.NoError(t, err)
+			assert.Equal(t, commit.String(), rs.Pipeline[0].With["expected-commit"])
+			assert.Equal(t, "bar", rs.Pipeline[1].With["expected-commit"])
+		})
+	}
+}
+
+func TestBump_expectedCommitOfMainCheckout(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	mirror, commit := crispsMirror(t)
+
+	dir := t.TempDir()
+	filename := "two_repositories.yaml"
+	data, err := os.ReadFile(filepath.Join("testdata", filename))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, filename), data, 0755))
+
+	rctx, err := renovate.New(renovate.WithConfig(filepath.Join(dir, filename)))
+	require.NoError(t, err)
+
+	// The expected commit is that of cheese/cheese, checked out by the main
+	// pipeline.  The subpackage checks out cheese/crisps, whose commit is
+	// resolved from its tag.
+	bumpRenovator := New(ctx,
+		WithTargetVersion("7.0"),
+		WithExpectedCommit("dbd7bc96fd6cd383b8e895dc4a928d808541bb17"),
+		WithGitMirror("cheese/crisps", mirror),
+	)
+	require.NoError(t, rctx.Renovate(ctx, bumpRenovator))
+
+	rs, err := config.ParseConfiguration(ctx, filepath.Join(dir, filename))
+	require.NoError(t, err)
+	assert.Equal(t, "dbd7bc96fd6cd383b8e895dc4a928d808541bb17", rs.Pipeline[0].With["expected-commit"])
+	assert.Equal(t, commit.String(), rs.Subpackages[0].Pipeline[0].With["expected-commit"])
+}
+
+func TestBump_withInclude(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	dir := t.TempDir()
+
+	err, server := setupTestServer(t)
+	require.NoError(t, err)
+
+	for _, name := range []string{"include.yaml", "include_fragment.yaml"} {
+		data, err := os.ReadFile(filepath.Join("testdata", name))
+		require.NoError(t, err)
+		data = []byte(strings.ReplaceAll(string(data), "REPLACE_ME", server.URL))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), data, 0755))
+	}
+	fragment, err := os.ReadFile(filepath.Join(dir, "include_fragment.yaml"))
+	require.NoError(t, err)
+
+	// Bumping twice must neither bump the steps of the fragment, which the
+	// test server would reject, nor write them into the configuration.
+	for i := 0; i < 2; i++ {
+		rctx, err := renovate.New(renovate.WithConfig(filepath.Join(dir, "include.yaml")))
+		require.NoError(t, err)
+		require.NoError(t, rctx.Renovate(ctx, New(ctx, WithTargetVersion("7.0.1"))))
+	}
+
+	resultData, err := os.ReadFile(filepath.Join(dir, "include.yaml"))
+	require.NoError(t, err)
+	assert.Contains(t, string(resultData), "version: 7.0.1")
+	assert.Contains(t, string(resultData), "- include_fragment.yaml")
+	assert.NotContains(t, string(resultData), "crackers")
+
+	// The fragment is left alone.
+	got, err := os.ReadFile(filepath.Join(dir, "include_fragment.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, string(fragment), string(got))
+
+	cfg, err := config.ParseConfiguration(ctx, filepath.Join(dir, "include.yaml"))
+	require.NoError(t, err)
+	require.Len(t, cfg.Pipeline, 2)
+	assert.Contains(t, cfg.Pipeline[0].With["uri"], "crackers")
+	assert.Contains(t, cfg.Pipeline[1].With["uri"], "cheese")
+}
@@ -0,0 +1,92 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bump
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// resolveTag returns the commit the tag of the git repository points to.  If
+// mirror is set, the tag is resolved in the local mirror of the repository at
+// that path, otherwise by listing the references of the repository.
+func resolveTag(ctx context.Context, repository, mirror, tag string) (string, error) {
+	if mirror != "" {
+		return resolveMirrorTag(mirror, tag)
+	}
+
+	remote := git.NewRemote(memory.NewStorage(), &gitconfig.RemoteConfig{
+		Name: "origin",
+		URLs: []string{repository},
+	})
+	refs, err := remote.ListContext(ctx, &git.ListOptions{PeelingOption: git.AppendPeeled})
+	if err != nil {
+		return "", fmt.Errorf("listing references of %s: %w", repository, err)
+	}
+
+	// Annotated tags are listed along with the commit they point to, as
+	// the peeled reference.
+	name := plumbing.NewTagReferenceName(tag)
+	var commit plumbing.Hash
+	for _, ref := range refs {
+		switch ref.Name() {
+		case name + "^{}":
+			return ref.Hash().String(), nil
+		case name:
+			commit = ref.Hash()
+		}
+	}
+	if commit.IsZero() {
+		return "", fmt.Errorf("tag %s does not exist in %s", tag, repository)
+	}
+	return commit.String(), nil
+}
+
+// resolveMirrorTag returns the commit the tag of the git repository at path
+// points to.
+func resolveMirrorTag(path, tag string) (string, error) {
+	repo, err := git.PlainOpen(path)
+	if err != nil {
+		return "", fmt.Errorf("opening mirror %s: %w", path, err)
+	}
+
+	ref, err := repo.Tag(tag)
+	if errors.Is(err, git.ErrTagNotFound) {
+		return "", fmt.Errorf("tag %s does not exist in mirror %s", tag, path)
+	} else if err != nil {
+		return "", fmt.Errorf("resolving tag %s in mirror %s: %w", tag, path, err)
+	}
+
+	obj, err := repo.TagObject(ref.Hash())
+	switch {
+	case errors.Is(err, plumbing.ErrObjectNotFound):
+		// A lightweight tag points to the commit itself.
+		return ref.Hash().String(), nil
+	case err != nil:
+		return "", fmt.Errorf("reading tag %s in mirror %s: %w", tag, path, err)
+	}
+
+	commit, err := obj.Commit()
+	if err != nil {
+		return "", fmt.Errorf("reading commit of tag %s in mirror %s: %w", tag, path, err)
+	}
+	return commit.Hash.String(), nil
+}
@@ -0,0 +1,144 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package renovate
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+// Format writes the configuration in src to w in canonical form: with the
+// keys in the order of the fields of the configuration, and formatted like
+// the configurations renovations write.  Comments are kept.
+func Format(w io.Writer, src []byte) error {
+	root := yaml.Node{}
+	if err := yaml.Unmarshal(src, &root); err != nil {
+		return fmt.Errorf("parsing configuration: %w", err)
+	}
+	if root.Kind != yaml.DocumentNode || len(root.Content) == 0 {
+		return nil
+	}
+	doc := root.Content[0]
+
+	// The comments at the end of the configuration are attached to its last
+	// key, which may not be last once the keys are sorted.
+	foot := root.FootComment
+	if n := len(doc.Content); doc.Kind == yaml.MappingNode && n >= 2 {
+		foot = joinComments(doc.Content[n-2].FootComment, foot)
+		doc.Content[n-2].FootComment = ""
+	}
+
+	trailing := detachFootComments(doc, nil)
+	config.SortKeys(&root)
+	for _, t := range trailing {
+		attachTrailingComment(t.mapping, t.comment)
+	}
+
+	if root.HeadComment != "" {
+		if _, err := fmt.Fprintf(w, "%s\n\n", root.HeadComment); err != nil {
+			return err
+		}
+	}
+	if err := Encode(w, doc); err != nil {
+		return err
+	}
+	if foot != "" {
+		if _, err := fmt.Fprintf(w, "\n%s\n", foot); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// trailingComment is a comment following the last value of a mapping.
+type trailingComment struct {
+	mapping *yaml.Node
+	comment string
+}
+
+// detachFootComments moves the comments following the values of mappings,
+// which are attached to their keys, so that they stay in place when the keys
+// are sorted.  Those following a value that is not the last of its mapping
+// precede the next key, and are attached to it.  Those following the last
+// value of a mapping are appended to trailing, innermost first, which is
+// returned.
+func detachFootComments(node *yaml.Node, trailing []trailingComment) []trailingComment {
+	for _, n := range node.Content {
+		trailing = detachFootComments(n, trailing)
+	}
+	if node.Kind != yaml.MappingNode {
+		return trailing
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i]
+		if key.FootComment == "" {
+			continue
+		}
+		if i+2 < len(node.Content) {
+			next := node.Content[i+2]
+			next.HeadComment = joinComments(key.FootComment, next.HeadComment)
+		} else {
+			trailing = append(trailing, trailingComment{mapping: node, comment: key.FootComment})
+		}
+		key.FootComment = ""
+	}
+	return trailing
+}
+
+// attachTrailingComment attaches the comment following the last value of the
+// mapping node to the last scalar of the value, where the encoder keeps it.
+func attachTrailingComment(node *yaml.Node, comment string) {
+	n := len(node.Content)
+	if last := lastScalar(node.Content[n-1]); last != nil {
+		last.FootComment = joinComments(last.FootComment, comment)
+		return
+	}
+	node.Content[n-2].HeadComment = joinComments(node.Content[n-2].HeadComment, comment)
+}
+
+// lastScalar returns the last scalar node with a value of node, if any.
+func lastScalar(node *yaml.Node) *yaml.Node {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.Tag == "!!null" {
+			return nil
+		}
+		return node
+	case yaml.MappingNode, yaml.SequenceNode:
+		if len(node.Content) == 0 {
+			return nil
+		}
+		return lastScalar(node.Content[len(node.Content)-1])
+	default:
+		return nil
+	}
+}
+
+func joinComments(comments ...string) string {
+	nonEmpty := make([]string, 0, len(comments))
+	for _, c := range comments {
+		if c != "" {
+			nonEmpty = append(nonEmpty, c)
+		}
+	}
+	return strings.Join(nonEmpty, "\n")
+}
@@ -0,0 +1,79 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package renovate
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormat(t *testing.T) {
+	src := `# Copyright header
+
+# Variables
+vars:
+    z: 1
+    a: 2
+pipeline:
+    - runs: |
+        make
+          install
+      uses: fetch # the source
+      with:
+          uri: https://example.com
+          expected-sha256: abc
+      name: fetch
+    # after the step
+package:
+    version: 1.0.0  # the version
+    name: foo
+    # after the version
+# the end
+`
+	want := `# Copyright header
+
+package:
+  name: foo
+  version: 1.0.0 # the version
+  # after the version
+pipeline:
+  - name: fetch
+    uses: fetch # the source
+    with:
+      uri: https://example.com
+      expected-sha256: abc
+    runs: |
+      make
+        install
+    # after the step
+# Variables
+vars:
+  z: 1
+  a: 2
+
+# the end
+`
+
+	var buf bytes.Buffer
+	require.NoError(t, Format(&buf, []byte(src)))
+	require.Equal(t, want, buf.String())
+
+	// Formatting is idempotent.
+	var again bytes.Buffer
+	require.NoError(t, Format(&again, buf.Bytes()))
+	require.Equal(t, want, again.String())
+}
@@ -16,11 +16,13 @@ package renovate
 
 import (
 	"context"
+	"io"
 	"os"
 	"runtime"
 	"strconv"
 
 	"github.com/chainguard-dev/yam/pkg/yam/formatted"
+	"gopkg.in/yaml.v3"
 
 	apko_types "chainguard.dev/apko/pkg/build/types"
 
@@ -127,9 +129,15 @@ func (rc *RenovationContext) WriteConfig() error {
 	}
 	defer configFile.Close()
 
-	enc := formatted.NewEncoder(configFile).AutomaticConfig()
+	return Encode(configFile, rc.Configuration.Root().Content[0])
+}
+
+// Encode writes the configuration node to w, formatted like the
+// configurations renovations write.
+func Encode(w io.Writer, node *yaml.Node) error {
+	enc := formatted.NewEncoder(w).AutomaticConfig()
 
-	if err := enc.Encode(rc.Configuration.Root().Content[0]); err != nil {
+	if err := enc.Encode(node); err != nil {
 		return err
 	}
 
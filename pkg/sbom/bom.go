@@ -44,6 +44,7 @@ type pkg struct {
 	LicenseConcluded string
 	Namespace        string
 	Arch             string
+	SourceInfo       string
 	Checksums        map[string]string
 	Relationships    []relationship
 	ExternalRefs     []purl.PackageURL
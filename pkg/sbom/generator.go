@@ -35,6 +35,7 @@ type Spec struct {
 	Namespace       string
 	Arch            string
 	SourceDateEpoch time.Time
+	BuildOptions    []string // The build options applied to the configuration
 }
 
 // Generate runs the main SBOM generation process.
@@ -102,6 +102,10 @@ func generateAPKPackage(spec *Spec) (pkg, error) {
 		newPackage.LicenseDeclared = spec.License
 	}
 
+	if len(spec.BuildOptions) > 0 {
+		newPackage.SourceInfo = "built with build options: " + strings.Join(spec.BuildOptions, ", ")
+	}
+
 	return newPackage, nil
 }
 
@@ -120,6 +124,7 @@ func addPackage(doc *spdx.Document, p *pkg) {
 		ExternalRefs:     []spdx.ExternalRef{},
 		Originator:       p.Originator,
 		Supplier:         p.Supplier,
+		SourceInfo:       p.SourceInfo,
 	}
 
 	algos := []string{}
@@ -0,0 +1,132 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package update
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-github/v54/github"
+)
+
+// DefaultReleaseMonitorURL is the URL of the release-monitoring.org API.
+const DefaultReleaseMonitorURL = "https://release-monitoring.org"
+
+// ReleaseMonitor lists the versions of projects on release-monitoring.org.
+type ReleaseMonitor interface {
+	// Versions returns the stable versions of the project.
+	Versions(ctx context.Context, identifier int) ([]string, error)
+}
+
+// GitHub lists the tags and releases of GitHub repositories.
+type GitHub interface {
+	// Tags returns the names of the tags of the repository.
+	Tags(ctx context.Context, owner, repo string) ([]string, error)
+	// Releases returns the tags of the releases of the repository that are
+	// neither drafts nor prereleases.
+	Releases(ctx context.Context, owner, repo string) ([]string, error)
+}
+
+// NewReleaseMonitorClient returns a ReleaseMonitor that queries the API at
+// baseURL.
+func NewReleaseMonitorClient(baseURL string, client *http.Client) ReleaseMonitor {
+	return &releaseMonitorClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  client,
+	}
+}
+
+type releaseMonitorClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+func (c *releaseMonitorClient) Versions(ctx context.Context, identifier int) ([]string, error) {
+	url := fmt.Sprintf("%s/api/v2/versions/?project_id=%d", c.baseURL, identifier)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%d when getting %s", resp.StatusCode, url)
+	}
+
+	var versions struct {
+		StableVersions []string `json:"stable_versions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&versions); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", url, err)
+	}
+	return versions.StableVersions, nil
+}
+
+// NewGitHubClient returns a GitHub that queries the API with client.
+func NewGitHubClient(client *github.Client) GitHub {
+	return &gitHubClient{client: client}
+}
+
+type gitHubClient struct {
+	client *github.Client
+}
+
+func (c *gitHubClient) Tags(ctx context.Context, owner, repo string) ([]string, error) {
+	names := []string{}
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		tags, resp, err := c.client.Repositories.ListTags(ctx, owner, repo, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range tags {
+			names = append(names, t.GetName())
+		}
+		if resp.NextPage == 0 {
+			return names, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+func (c *gitHubClient) Releases(ctx context.Context, owner, repo string) ([]string, error) {
+	names := []string{}
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		releases, resp, err := c.client.Repositories.ListReleases(ctx, owner, repo, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range releases {
+			if r.GetDraft() || r.GetPrerelease() {
+				continue
+			}
+			names = append(names, r.GetTagName())
+		}
+		if resp.NextPage == 0 {
+			return names, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package update checks the upstream sources configured in the update block
+// of configurations for new versions.
+package update
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"chainguard.dev/apko/pkg/apk/apk"
+	"github.com/chainguard-dev/clog"
+	"github.com/google/go-github/v54/github"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+// ErrNotMonitored is returned for configurations that are not updated
+// automatically: updates are disabled or manual, or no upstream source is
+// configured.
+var ErrNotMonitored = errors.New("package is not monitored for updates")
+
+// Checker checks the upstream sources of configurations for new versions.
+type Checker struct {
+	releaseMonitor ReleaseMonitor
+	github         GitHub
+}
+
+// Option sets an option on a Checker.
+type Option func(c *Checker) error
+
+// WithReleaseMonitor sets the client used for configurations tracked via
+// release-monitoring.org.
+func WithReleaseMonitor(rm ReleaseMonitor) Option {
+	return func(c *Checker) error {
+		c.releaseMonitor = rm
+		return nil
+	}
+}
+
+// WithGitHub sets the client used for configurations tracked via the GitHub
+// API.
+func WithGitHub(gh GitHub) Option {
+	return func(c *Checker) error {
+		c.github = gh
+		return nil
+	}
+}
+
+// New returns a Checker.  Unless set, it queries release-monitoring.org and
+// the GitHub API without authentication.
+func New(opts ...Option) (*Checker, error) {
+	c := &Checker{
+		releaseMonitor: NewReleaseMonitorClient(DefaultReleaseMonitorURL, http.DefaultClient),
+		github:         NewGitHubClient(github.NewClient(nil)),
+	}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Result is the outcome of checking a configuration for a new version.
+type Result struct {
+	// The name of the package
+	Package string
+	// The version of the package in the configuration
+	Current string
+	// The latest upstream version, as an APK version
+	Latest string
+	// Whether the latest upstream version is newer than the current one
+	UpdateAvailable bool
+}
+
+// Check returns the latest upstream version of the package of the
+// configuration.  Upstream versions are stripped of the configured prefix
+// and suffix, filtered, and transformed into APK versions, and those that are
+// not valid APK versions are skipped.
+func (c *Checker) Check(ctx context.Context, cfg *config.Configuration) (*Result, error) {
+	log := clog.FromContext(ctx)
+	u := cfg.Update
+
+	var (
+		versions []string
+		err      error
+	)
+	switch {
+	case !u.Enabled || u.Manual:
+		return nil, ErrNotMonitored
+	case u.ReleaseMonitor != nil:
+		versions, err = c.releaseMonitorVersions(ctx, u)
+	case u.GitHubMonitor != nil:
+		versions, err = c.gitHubVersions(ctx, u)
+	default:
+		return nil, ErrNotMonitored
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ignore := make([]*regexp.Regexp, 0, len(u.IgnoreRegexPatterns))
+	for _, p := range u.IgnoreRegexPatterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("compiling ignore-regex-pattern %q: %w", p, err)
+		}
+		ignore = append(ignore, re)
+	}
+	transforms := make([]*regexp.Regexp, 0, len(u.VersionTransform))
+	for _, vt := range u.VersionTransform {
+		re, err := regexp.Compile(vt.Match)
+		if err != nil {
+			return nil, fmt.Errorf("compiling version-transform %q: %w", vt.Match, err)
+		}
+		transforms = append(transforms, re)
+	}
+
+	current, err := apk.ParseVersion(cfg.Package.Version)
+	if err != nil {
+		return nil, fmt.Errorf("parsing version %s: %w", cfg.Package.Version, err)
+	}
+
+	var latest *apk.Version
+	result := &Result{Package: cfg.Package.Name, Current: cfg.Package.Version}
+	for _, v := range versions {
+		if u.VersionSeparator != "" {
+			v = strings.ReplaceAll(v, u.VersionSeparator, ".")
+		}
+		if matchesAny(ignore, v) {
+			log.Debugf("ignoring version %s", v)
+			continue
+		}
+		for i, re := range transforms {
+			v = re.ReplaceAllString(v, u.VersionTransform[i].Replace)
+		}
+
+		pv, err := apk.ParseVersion(v)
+		if err != nil {
+			log.Debugf("skipping %s, which is not an APK version: %v", v, err)
+			continue
+		}
+		if latest == nil || apk.CompareVersions(pv, *latest) > 0 {
+			latest, result.Latest = &pv, v
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("no upstream versions found for %s", cfg.Package.Name)
+	}
+
+	result.UpdateAvailable = apk.CompareVersions(*latest, current) > 0
+	return result, nil
+}
+
+func (c *Checker) releaseMonitorVersions(ctx context.Context, u config.Update) ([]string, error) {
+	rm := u.ReleaseMonitor
+	versions, err := c.releaseMonitor.Versions(ctx, rm.Identifier)
+	if err != nil {
+		return nil, fmt.Errorf("listing versions of release-monitor project %d: %w", rm.Identifier, err)
+	}
+
+	stripped := make([]string, 0, len(versions))
+	for _, v := range versions {
+		stripped = append(stripped, strip(v, rm.StripPrefix, rm.StripSuffix))
+	}
+	return stripped, nil
+}
+
+func (c *Checker) gitHubVersions(ctx context.Context, u config.Update) ([]string, error) {
+	gm := u.GitHubMonitor
+	owner, repo, ok := strings.Cut(gm.Identifier, "/")
+	if !ok {
+		return nil, fmt.Errorf("github identifier %q is not of the form org/repo", gm.Identifier)
+	}
+
+	list, what := c.github.Releases, "releases"
+	if gm.UseTags {
+		list, what = c.github.Tags, "tags"
+	}
+	tags, err := list(ctx, owner, repo)
+	if err != nil {
+		return nil, fmt.Errorf("listing %s of %s: %w", what, gm.Identifier, err)
+	}
+
+	prefix := gm.TagFilterPrefix
+	if prefix == "" {
+		prefix = gm.TagFilter
+	}
+	versions := make([]string, 0, len(tags))
+	for _, t := range tags {
+		if !strings.HasPrefix(t, prefix) || !strings.Contains(t, gm.TagFilterContains) {
+			continue
+		}
+		versions = append(versions, strip(t, gm.StripPrefix, gm.StripSuffix))
+	}
+	return versions, nil
+}
+
+func strip(version, prefix, suffix string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(version, prefix), suffix)
+}
+
+func matchesAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,164 @@
+// Copyright 2024 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package update
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/chainguard-dev/clog/slogtest"
+	"github.com/google/go-github/v54/github"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+// fixture serves the responses of release-monitoring.org and the GitHub API
+// for the checks.
+func fixture(t *testing.T) *Checker {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/versions/", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "1234", r.URL.Query().Get("project_id"))
+		_, _ = w.Write([]byte(`{
+  "latest_version": "v2.0.0-rc1",
+  "stable_versions": ["v1.10.0", "v1.9.2", "v1.2.0-beta", "v1.1.0"],
+  "versions": ["v2.0.0-rc1", "v1.10.0", "v1.9.2", "v1.2.0-beta", "v1.1.0"]
+}`))
+	})
+	mux.HandleFunc("/repos/example/tagged/tags", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`[
+  {"name": "release-1_4_0"},
+  {"name": "release-1_3_1"},
+  {"name": "nightly-1_5_0"},
+  {"name": "release-1_5_0-alpha"}
+]`))
+	})
+	mux.HandleFunc("/repos/example/released/releases", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`[
+  {"tag_name": "v3.1.0", "prerelease": true},
+  {"tag_name": "v3.0.0"},
+  {"tag_name": "v2.9.0"},
+  {"tag_name": "v4.0.0", "draft": true}
+]`))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	gh := github.NewClient(srv.Client())
+	base, err := url.Parse(srv.URL + "/")
+	require.NoError(t, err)
+	gh.BaseURL = base
+
+	c, err := New(
+		WithReleaseMonitor(NewReleaseMonitorClient(srv.URL, srv.Client())),
+		WithGitHub(NewGitHubClient(gh)),
+	)
+	require.NoError(t, err)
+	return c
+}
+
+func TestCheck(t *testing.T) {
+	ctx := slogtest.TestContextWithLogger(t)
+	c := fixture(t)
+
+	for _, tt := range []struct {
+		name    string
+		version string
+		update  config.Update
+		want    *Result
+		wantErr error
+	}{{
+		name:    "release monitor",
+		version: "1.9.2",
+		update: config.Update{
+			Enabled:        true,
+			ReleaseMonitor: &config.ReleaseMonitor{Identifier: 1234, StripPrefix: "v"},
+		},
+		want: &Result{Current: "1.9.2", Latest: "1.10.0", UpdateAvailable: true},
+	}, {
+		name:    "up to date",
+		version: "1.10.0",
+		update: config.Update{
+			Enabled:        true,
+			ReleaseMonitor: &config.ReleaseMonitor{Identifier: 1234, StripPrefix: "v"},
+		},
+		want: &Result{Current: "1.10.0", Latest: "1.10.0"},
+	}, {
+		name:    "ignored versions",
+		version: "1.1.0",
+		update: config.Update{
+			Enabled:             true,
+			IgnoreRegexPatterns: []string{`^1\.(9|10)\.`},
+			ReleaseMonitor:      &config.ReleaseMonitor{Identifier: 1234, StripPrefix: "v"},
+		},
+		// 1.2.0-beta is not an APK version.
+		want: &Result{Current: "1.1.0", Latest: "1.1.0"},
+	}, {
+		name:    "tags",
+		version: "1.3.1",
+		update: config.Update{
+			Enabled:          true,
+			VersionSeparator: "_",
+			GitHubMonitor: &config.GitHubMonitor{
+				Identifier:      "example/tagged",
+				UseTags:         true,
+				TagFilterPrefix: "release-",
+				StripPrefix:     "release-",
+			},
+			VersionTransform: []config.VersionTransform{{Match: `-alpha$`, Replace: "_alpha"}},
+		},
+		want: &Result{Current: "1.3.1", Latest: "1.5.0_alpha", UpdateAvailable: true},
+	}, {
+		name:    "releases",
+		version: "2.9.0",
+		update: config.Update{
+			Enabled:       true,
+			GitHubMonitor: &config.GitHubMonitor{Identifier: "example/released", StripPrefix: "v"},
+		},
+		want: &Result{Current: "2.9.0", Latest: "3.0.0", UpdateAvailable: true},
+	}, {
+		name:    "manual",
+		version: "1.0.0",
+		update: config.Update{
+			Enabled:        true,
+			Manual:         true,
+			ReleaseMonitor: &config.ReleaseMonitor{Identifier: 1234},
+		},
+		wantErr: ErrNotMonitored,
+	}, {
+		name:    "no monitor",
+		version: "1.0.0",
+		update:  config.Update{Enabled: true},
+		wantErr: ErrNotMonitored,
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Configuration{
+				Package: config.Package{Name: "example", Version: tt.version},
+				Update:  tt.update,
+			}
+			got, err := c.Check(ctx, cfg)
+			if tt.wantErr != nil {
+				require.True(t, errors.Is(err, tt.wantErr), "got error %v", err)
+				return
+			}
+			require.NoError(t, err)
+			tt.want.Package = "example"
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -17,26 +17,85 @@ package util
 import (
 	"fmt"
 	"strconv"
+	"strings"
 
 	"chainguard.dev/melange/pkg/cond"
 )
 
-// Given a string and a map, replace the variables in the string with values in the map
-func MutateStringFromMap(with map[string]string, input string) (string, error) {
-	lookupWith := func(key string) (string, error) {
-		if val, ok := with[key]; ok {
-			return val, nil
+// UndefinedError reports the variables a string refers to that are not
+// defined.  The string is substituted with those variables left in place.
+type UndefinedError struct {
+	Variables []*cond.Variable
+}
+
+func (e *UndefinedError) Error() string {
+	msgs := make([]string, len(e.Variables))
+	for i, v := range e.Variables {
+		msgs[i] = fmt.Sprintf("variable %s not defined", v.Name)
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// lookupVariable returns the value of a variable in a map, keyed either by its
+// bare name or by its ${{}} form, with the filters of the variable applied.
+// Values found by their ${{}} form are quoted if quote is set.  A variable
+// whose bare name maps to its own ${{}} form is substituted later, so it is
+// left in place as written.  The boolean result reports whether the variable
+// is defined.
+func lookupVariable(with map[string]string, v *cond.Variable, quote bool) (string, bool, error) {
+	nk := fmt.Sprintf("${{%s}}", v.Name)
+
+	if val, ok := with[v.Name]; ok {
+		if val == nk {
+			return v.Text, true, nil
 		}
+		val, err := v.Apply(val)
+		return val, true, err
+	}
 
-		nk := fmt.Sprintf("${{%s}}", key)
-		if val, ok := with[nk]; ok {
-			return val, nil
+	if val, ok := with[nk]; ok {
+		val, err := v.Apply(val)
+		if err != nil {
+			return "", true, err
+		}
+		if quote {
+			return strconv.Quote(val), true, nil
 		}
+		return val, true, nil
+	}
+
+	return "", false, nil
+}
+
+// mutate replaces the variables in input with their values in with.  Variables
+// that are not defined are left in place and reported by an *UndefinedError.
+func mutate(with map[string]string, input string, quote bool) (string, error) {
+	var undefined []*cond.Variable
 
-		return "", fmt.Errorf("variable %s not defined", key)
+	out, err := cond.Expand(input, func(v *cond.Variable) (string, error) {
+		val, ok, err := lookupVariable(with, v, quote)
+		if !ok {
+			undefined = append(undefined, v)
+			return v.Text, nil
+		}
+		return val, err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if len(undefined) > 0 {
+		return out, &UndefinedError{Variables: undefined}
 	}
 
-	return cond.Subst(input, lookupWith)
+	return out, nil
+}
+
+// Given a string and a map, replace the variables in the string with values in the map.
+// Variables that are not in the map are left in place, and reported by an *UndefinedError
+// returned along with the substituted string.
+func MutateStringFromMap(with map[string]string, input string) (string, error) {
+	return mutate(with, input, false)
 }
 
 // Given a string and a map, replace the variables in the string with quoted values in the map.
@@ -44,18 +103,5 @@ func MutateStringFromMap(with map[string]string, input string) (string, error) {
 // as comparision values with == and !=. If we want to be able to resolve an "if" that can be fed
 // back into melange, we need to maintain that requirement, so all variables get quoted once replaced.
 func MutateAndQuoteStringFromMap(with map[string]string, input string) (string, error) {
-	lookupWith := func(key string) (string, error) {
-		if val, ok := with[key]; ok {
-			return val, nil
-		}
-
-		nk := fmt.Sprintf("${{%s}}", key)
-		if val, ok := with[nk]; ok {
-			return strconv.Quote(val), nil
-		}
-
-		return "", fmt.Errorf("variable %s not defined", key)
-	}
-
-	return cond.Subst(input, lookupWith)
+	return mutate(with, input, true)
 }
@@ -12,3 +12,36 @@ func TestDedup(t *testing.T) {
 
 	require.Equal(t, len(b), 12, "the deduplicated list should have 12 elements")
 }
+
+func TestMutateStringFromMapFilters(t *testing.T) {
+	with := map[string]string{
+		"${{package.version}}":         "1.2.3",
+		"steps.build.outputs.commit":   "${{steps.build.outputs.commit}}",
+		"${{steps.build.outputs.tag}}": "v1.2.3",
+	}
+
+	got, err := MutateStringFromMap(with, "${{package.version | major}} ${{ steps.build.outputs.commit | upper }}")
+	require.NoError(t, err)
+	require.Equal(t, "1 ${{ steps.build.outputs.commit | upper }}", got)
+
+	got, err = MutateAndQuoteStringFromMap(with, "${{steps.build.outputs.tag | trimprefix('v')}} == '1.2.3'")
+	require.NoError(t, err)
+	require.Equal(t, `"1.2.3" == '1.2.3'`, got)
+}
+
+func TestMutateStringFromMapUndefined(t *testing.T) {
+	with := map[string]string{
+		"${{package.version}}": "1.2.3",
+	}
+
+	got, err := MutateStringFromMap(with, "v${{package.version}} ${{vars.mangled-verison}} ${{ vars.other | major }}")
+	require.Equal(t, "v1.2.3 ${{vars.mangled-verison}} ${{ vars.other | major }}", got)
+
+	var uerr *UndefinedError
+	require.ErrorAs(t, err, &uerr)
+	require.Len(t, uerr.Variables, 2)
+	require.Equal(t, "vars.mangled-verison", uerr.Variables[0].Name)
+	require.Equal(t, 22, uerr.Variables[0].Offset)
+	require.Equal(t, "${{ vars.other | major }}", uerr.Variables[1].Text)
+	require.Equal(t, 48, uerr.Variables[1].Offset)
+}